@@ -0,0 +1,356 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix starts names of environment variables overriding settings,
+// server.addr is SIMPLEBANK_SERVER_ADDR
+const envPrefix = "SIMPLEBANK_"
+
+// defaultFile is read when no config file is given, if it exists
+const defaultFile = "config.yaml"
+
+type Config struct {
+	Server  Server  `yaml:"server"`
+	Log     Log     `yaml:"log"`
+	Storage Storage `yaml:"storage"`
+	Jobs    Jobs    `yaml:"jobs"`
+	Limits  Limits  `yaml:"limits"`
+}
+
+// Server configures the HTTP server, Mode is the gin mode: debug, release
+// or test. Zero read, write and idle timeouts mean no timeout. On stop
+// readiness fails for ShutdownDelay before requests are drained for up to
+// ShutdownTimeout.
+type Server struct {
+	Addr            string        `yaml:"addr"`
+	Mode            string        `yaml:"mode"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownDelay   time.Duration `yaml:"shutdown_delay"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// Log configures the zap logger, Outputs are file paths or stdout and stderr
+type Log struct {
+	Level   string   `yaml:"level"`
+	Outputs []string `yaml:"outputs"`
+}
+
+// Storage selects where the bank is kept: memory until restart only, wal
+// adds write-ahead log and snapshots in DataDir, file keeps everything in
+// a single file in DataDir. Rates and fees files are optional.
+type Storage struct {
+	Kind             string        `yaml:"kind"`
+	DataDir          string        `yaml:"data_dir"`
+	RatesFile        string        `yaml:"rates_file"`
+	FeesFile         string        `yaml:"fees_file"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+}
+
+// Jobs sets how often background jobs run
+type Jobs struct {
+	SchedulerInterval time.Duration `yaml:"scheduler_interval"`
+	InterestInterval  time.Duration `yaml:"interest_interval"`
+}
+
+// Limits bound what a client can send and how long retries are replayed
+type Limits struct {
+	MaxHeaderBytes int           `yaml:"max_header_bytes"`
+	MaxBodyBytes   int64         `yaml:"max_body_bytes"`
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl"`
+}
+
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:            ":8080",
+			Mode:            gin.DebugMode,
+			ReadTimeout:     30 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownDelay:   5 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Log: Log{
+			Level:   "info",
+			Outputs: []string{"log/simplebank.log"},
+		},
+		Storage: Storage{
+			Kind:             "wal",
+			DataDir:          "data",
+			RatesFile:        "fx_rates.json",
+			FeesFile:         "fees.json",
+			SnapshotInterval: time.Minute,
+		},
+		Jobs: Jobs{
+			SchedulerInterval: 10 * time.Second,
+			InterestInterval:  time.Minute,
+		},
+		Limits: Limits{
+			MaxHeaderBytes: 1 << 20,
+			MaxBodyBytes:   1 << 20,
+			IdempotencyTTL: 24 * time.Hour,
+		},
+	}
+}
+
+// Load builds the config from defaults, the YAML file, environment and
+// command-line args, later ones win, and validates it. printOnly is set
+// when --print-config is given.
+func Load(args []string, lookupEnv func(string) (string, bool)) (cfg Config, printOnly bool, err error) {
+	fs := flag.NewFlagSet("simplebank", flag.ContinueOnError)
+	path := fs.String("config", "", "YAML config file, "+defaultFile+" if it exists; env "+envPrefix+"CONFIG")
+	fs.BoolVar(&printOnly, "print-config", false, "print the resulting config and exit")
+
+	// flags are parsed into a scratch config first to find the file, then
+	// applied again on top of it
+	scratch := Default()
+	settings := settingsOf(&scratch)
+	for _, s := range settings {
+		fs.Var(s.value, s.flag, s.usage+"; env "+s.env())
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, false, errors.New("unexpected argument " + fs.Arg(0))
+	}
+
+	cfg = Default()
+	if *path == "" {
+		*path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if *path == "" {
+		if _, err := os.Stat(defaultFile); err == nil {
+			*path = defaultFile
+		}
+	}
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return Config{}, false, err
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return Config{}, false, errors.New(*path + ": " + err.Error())
+		}
+	}
+
+	byFlag := make(map[string]setting)
+	for _, s := range settingsOf(&cfg) {
+		byFlag[s.flag] = s
+		if v, ok := lookupEnv(s.env()); ok {
+			if err := s.value.Set(v); err != nil {
+				return Config{}, false, errors.New(s.env() + ": " + err.Error())
+			}
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := byFlag[f.Name]; ok {
+			s.value.Set(f.Value.String())
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, false, err
+	}
+	return cfg, printOnly, nil
+}
+
+// Validate checks settings which would make the server fail later
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		return errors.New("server.addr: " + err.Error())
+	}
+	switch c.Server.Mode {
+	case gin.DebugMode, gin.ReleaseMode, gin.TestMode:
+	default:
+		return errors.New("server.mode must be debug, release or test")
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 || c.Server.ShutdownDelay < 0 {
+		return errors.New("server timeouts can not be negative")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		return errors.New("server.shutdown_timeout must be positive")
+	}
+
+	if _, err := c.Log.ZapLevel(); err != nil {
+		return errors.New("log.level: " + err.Error())
+	}
+	if len(c.Log.Outputs) == 0 {
+		return errors.New("log.outputs can not be empty")
+	}
+
+	switch c.Storage.Kind {
+	case "memory":
+	case "wal", "file":
+		if c.Storage.DataDir == "" {
+			return errors.New("storage.data_dir can not be empty")
+		}
+	default:
+		return errors.New("storage.kind must be memory, wal or file")
+	}
+	if c.Storage.SnapshotInterval <= 0 {
+		return errors.New("storage.snapshot_interval must be positive")
+	}
+
+	if c.Jobs.SchedulerInterval <= 0 || c.Jobs.InterestInterval <= 0 {
+		return errors.New("jobs intervals must be positive")
+	}
+
+	if c.Limits.MaxHeaderBytes <= 0 || c.Limits.MaxBodyBytes <= 0 {
+		return errors.New("limits must be positive")
+	}
+	if c.Limits.IdempotencyTTL <= 0 {
+		return errors.New("limits.idempotency_ttl must be positive")
+	}
+	return nil
+}
+
+func (l Log) ZapLevel() (zapcore.Level, error) {
+	var level zapcore.Level
+	err := level.UnmarshalText([]byte(l.Level))
+	return level, err
+}
+
+// YAML returns the config in the file format
+func (c Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// setting is a config field which can be set by environment and flags
+type setting struct {
+	key   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+// env returns the environment variable of the setting
+func (s setting) env() string {
+	return envPrefix + strings.ToUpper(strings.Replace(s.key, ".", "_", -1))
+}
+
+func settingsOf(c *Config) []setting {
+	return []setting{
+		{"server.addr", "addr", "listen address", (*stringValue)(&c.Server.Addr)},
+		{"server.mode", "gin-mode", "gin mode: debug, release or test", (*stringValue)(&c.Server.Mode)},
+		{"server.read_timeout", "read-timeout", "request read timeout", (*durationValue)(&c.Server.ReadTimeout)},
+		{"server.write_timeout", "write-timeout", "response write timeout", (*durationValue)(&c.Server.WriteTimeout)},
+		{"server.idle_timeout", "idle-timeout", "keep-alive idle timeout", (*durationValue)(&c.Server.IdleTimeout)},
+		{"server.shutdown_delay", "shutdown-delay", "how long readiness fails before requests are drained on stop", (*durationValue)(&c.Server.ShutdownDelay)},
+		{"server.shutdown_timeout", "shutdown-timeout", "how long requests are drained on stop", (*durationValue)(&c.Server.ShutdownTimeout)},
+		{"log.level", "log-level", "log level", (*stringValue)(&c.Log.Level)},
+		{"log.outputs", "log-outputs", "comma separated log outputs", (*listValue)(&c.Log.Outputs)},
+		{"storage.kind", "storage", "accounts storage: memory, wal or file", (*stringValue)(&c.Storage.Kind)},
+		{"storage.data_dir", "data-dir", "directory of wal and file storage", (*stringValue)(&c.Storage.DataDir)},
+		{"storage.rates_file", "rates-file", "exchange rates file", (*stringValue)(&c.Storage.RatesFile)},
+		{"storage.fees_file", "fees-file", "transfer fees file", (*stringValue)(&c.Storage.FeesFile)},
+		{"storage.snapshot_interval", "snapshot-interval", "how often wal storage takes snapshots", (*durationValue)(&c.Storage.SnapshotInterval)},
+		{"jobs.scheduler_interval", "scheduler-interval", "how often due scheduled transfers are looked for", (*durationValue)(&c.Jobs.SchedulerInterval)},
+		{"jobs.interest_interval", "interest-interval", "how often interest is accrued", (*durationValue)(&c.Jobs.InterestInterval)},
+		{"limits.max_header_bytes", "max-header-bytes", "request header size limit", (*intValue)(&c.Limits.MaxHeaderBytes)},
+		{"limits.max_body_bytes", "max-body-bytes", "request body size limit", (*int64Value)(&c.Limits.MaxBodyBytes)},
+		{"limits.idempotency_ttl", "idempotency-ttl", "how long responses are replayed for retried requests", (*durationValue)(&c.Limits.IdempotencyTTL)},
+	}
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return string(*v)
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+func (v *durationValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return time.Duration(*v).String()
+}
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(i)
+	return nil
+}
+
+func (v *intValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*v))
+}
+
+type int64Value int64
+
+func (v *int64Value) Set(s string) error {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = int64Value(i)
+	return nil
+}
+
+func (v *int64Value) String() string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+// listValue is a comma separated list
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+func (v *listValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strings.Join(*v, ",")
+}
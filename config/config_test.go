@@ -0,0 +1,113 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, printOnly, err := Load(nil, env(nil))
+	assert.Nil(t, err)
+	assert.False(t, printOnly)
+	assert.Equal(t, Default(), cfg)
+	assert.Equal(t, ":8080", cfg.Server.Addr)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplebank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	data := "server:\n  addr: \":9000\"\n  mode: release\n  shutdown_timeout: 5s\nlog:\n  level: warn\n  outputs: [stdout]\nstorage:\n  kind: file\n"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0600))
+
+	cfg, printOnly, err := Load([]string{"-config", path, "-storage", "memory", "--print-config"}, env(map[string]string{
+		"SIMPLEBANK_SERVER_ADDR":            ":9100",
+		"SIMPLEBANK_STORAGE_KIND":           "wal",
+		"SIMPLEBANK_LOG_OUTPUTS":            "stdout, stderr",
+		"SIMPLEBANK_LIMITS_IDEMPOTENCY_TTL": "1h",
+	}))
+	assert.Nil(t, err)
+	assert.True(t, printOnly)
+
+	// file over defaults
+	assert.Equal(t, "release", cfg.Server.Mode)
+	assert.Equal(t, 5*time.Second, cfg.Server.ShutdownTimeout)
+	assert.Equal(t, "warn", cfg.Log.Level)
+	// env over file
+	assert.Equal(t, ":9100", cfg.Server.Addr)
+	assert.Equal(t, []string{"stdout", "stderr"}, cfg.Log.Outputs)
+	assert.Equal(t, time.Hour, cfg.Limits.IdempotencyTTL)
+	// flags over env
+	assert.Equal(t, "memory", cfg.Storage.Kind)
+	// untouched
+	assert.Equal(t, "data", cfg.Storage.DataDir)
+}
+
+func TestLoad_ConfigFromEnv(t *testing.T) {
+	_, _, err := Load(nil, env(map[string]string{"SIMPLEBANK_CONFIG": "/nonexistent/config.yaml"}))
+	assert.NotNil(t, err)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-addr", "8080"},
+		{"-gin-mode", "prod"},
+		{"-shutdown-timeout", "0s"},
+		{"-read-timeout", "-1s"},
+		{"-shutdown-delay", "-1s"},
+		{"-log-level", "loud"},
+		{"-log-outputs", ""},
+		{"-storage", "disk"},
+		{"-data-dir", ""},
+		{"-interest-interval", "0s"},
+		{"-max-body-bytes", "0"},
+		{"-max-header-bytes", "many"},
+		{"-idempotency-ttl", "day"},
+		{"extra"},
+	} {
+		_, _, err := Load(args, env(nil))
+		assert.NotNil(t, err, "%v", args)
+	}
+
+	_, _, err := Load(nil, env(map[string]string{"SIMPLEBANK_SERVER_READ_TIMEOUT": "soon"}))
+	assert.NotNil(t, err)
+
+	// memory storage needs no data directory
+	_, _, err = Load([]string{"-storage", "memory", "-data-dir", ""}, env(nil))
+	assert.Nil(t, err)
+}
+
+func TestConfig_YAMLRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplebank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Default()
+	cfg.Server.Addr = "127.0.0.1:8081"
+	cfg.Jobs.SchedulerInterval = 3 * time.Second
+	data, err := cfg.YAML()
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "config.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, data, 0600))
+	loaded, _, err := Load([]string{"-config", path}, env(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, cfg, loaded)
+}
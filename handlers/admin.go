@@ -0,0 +1,526 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"math/big"
+	"net/http"
+	"simple_bank/models/bank"
+	"simple_bank/reqctx"
+	"time"
+)
+
+type ReloadRatesResponse struct {
+	Rates    int    `json:"rates"`
+	Rounding string `json:"rounding"`
+}
+
+// ReloadRatesHandler reads the exchange rates file again
+func ReloadRatesHandler(c *gin.Context) {
+	rates := reqctx.Bank(c).Rates()
+	if rates == nil {
+		errorJSON(c, http.StatusUnprocessableEntity, "exchange rates are not configured")
+		return
+	}
+
+	if err := rates.Reload(); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	table := rates.Table()
+	c.JSON(http.StatusOK, &JSONResponse{0, ReloadRatesResponse{table.Len(), string(table.Rounding)}})
+}
+
+type ReloadFeesResponse struct {
+	Fees int `json:"fees"`
+}
+
+// ReloadFeesHandler reads the fees file again
+func ReloadFeesHandler(c *gin.Context) {
+	f := reqctx.Bank(c).Fees()
+	if f == nil {
+		errorJSON(c, http.StatusUnprocessableEntity, "fees are not configured")
+		return
+	}
+
+	if err := f.Reload(); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, ReloadFeesResponse{f.Schedule().Len()}})
+}
+
+type SetOverdraftLimitRequest struct {
+	Limit string `json:"limit"`
+}
+
+// SetOverdraftLimitHandler changes how far below zero the account balance
+// may go
+func SetOverdraftLimitHandler(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	var r SetOverdraftLimitRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	ac, err := _bank.GetAccount(uid)
+	if err == bank.ErrAccountNotFound {
+		errorJSON(c, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	limit, err := stringToBalanceInt64(r.Limit, currencyExponent(ac.Currency()))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if err := _bank.SetOverdraftLimit(uid, limit); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	ac, err = _bank.GetAccount(uid)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	available, err := _bank.AvailableBalance(uid)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	headroom, err := _bank.Headroom(uid)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, accountResponse(ac, available, headroom)})
+}
+
+// SpendingLimitsRequest replaces all limits of the account, empty or zero
+// ones are removed
+type SpendingLimitsRequest struct {
+	MaxAmount      string `json:"max_amount"`
+	MaxDaily       string `json:"max_daily"`
+	MaxMonthly     string `json:"max_monthly"`
+	MaxHourlyCount int    `json:"max_hourly_count"`
+}
+
+// SpendingLimitsResponse has the limits of the account, empty if not set,
+// and what is spent of them
+type SpendingLimitsResponse struct {
+	AccountID      string `json:"account_id"`
+	Currency       string `json:"currency"`
+	MaxAmount      string `json:"max_amount"`
+	MaxDaily       string `json:"max_daily"`
+	MaxMonthly     string `json:"max_monthly"`
+	MaxHourlyCount int    `json:"max_hourly_count"`
+	SpentDaily     string `json:"spent_daily"`
+	SpentMonthly   string `json:"spent_monthly"`
+	HourlyCount    int    `json:"hourly_count"`
+}
+
+// GetSpendingLimitsHandler returns spending limits of the account
+func GetSpendingLimitsHandler(c *gin.Context) {
+	ac, status, err := getAdminAccount(c)
+	if err != nil {
+		errorJSON(c, status, err.Error())
+		return
+	}
+
+	resp, err := spendingLimitsResponse(c, ac)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
+
+// SetSpendingLimitsHandler replaces spending limits of the account
+func SetSpendingLimitsHandler(c *gin.Context) {
+	ac, status, err := getAdminAccount(c)
+	if err != nil {
+		errorJSON(c, status, err.Error())
+		return
+	}
+
+	var r SpendingLimitsRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limits := bank.SpendingLimits{MaxHourlyCount: r.MaxHourlyCount}
+	exp := currencyExponent(ac.Currency())
+	if limits.MaxAmount, err = optionalAmount(r.MaxAmount, exp); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if limits.MaxDaily, err = optionalAmount(r.MaxDaily, exp); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if limits.MaxMonthly, err = optionalAmount(r.MaxMonthly, exp); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	if err := _bank.SetSpendingLimits(ac.ID(), limits); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	ac, err = _bank.GetAccount(ac.ID())
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp, err := spendingLimitsResponse(c, ac)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
+
+// getAdminAccount finds the account by the id path parameter, the status
+// to respond with is returned on errors
+func getAdminAccount(c *gin.Context) (bank.Account, int, error) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return bank.Account{}, http.StatusUnprocessableEntity, err
+	}
+
+	ac, err := reqctx.Bank(c).GetAccount(uid)
+	if err == bank.ErrAccountNotFound {
+		return bank.Account{}, http.StatusNotFound, err
+	} else if err != nil {
+		return bank.Account{}, http.StatusUnprocessableEntity, err
+	}
+	return ac, http.StatusOK, nil
+}
+
+// optionalAmount parses the amount, empty one is zero
+func optionalAmount(s string, exp int) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return stringToBalanceInt64(s, exp)
+}
+
+func spendingLimitsResponse(c *gin.Context, ac bank.Account) (SpendingLimitsResponse, error) {
+	spent, err := reqctx.Bank(c).SpendingOf(ac.ID())
+	if err != nil {
+		return SpendingLimitsResponse{}, err
+	}
+
+	exp := currencyExponent(ac.Currency())
+	amount := func(v int64) string {
+		if v == 0 {
+			return ""
+		}
+		return signedBalanceToString(v, exp)
+	}
+
+	limits := ac.Limits()
+	return SpendingLimitsResponse{
+		AccountID:      ac.ID().String(),
+		Currency:       ac.Currency(),
+		MaxAmount:      amount(limits.MaxAmount),
+		MaxDaily:       amount(limits.MaxDaily),
+		MaxMonthly:     amount(limits.MaxMonthly),
+		MaxHourlyCount: limits.MaxHourlyCount,
+		SpentDaily:     signedBalanceToString(spent.Daily, exp),
+		SpentMonthly:   signedBalanceToString(spent.Monthly, exp),
+		HourlyCount:    spent.HourlyCount,
+	}, nil
+}
+
+// InterestRatesRequest holds annual rates as decimal fractions, e.g.
+// "0.025" for 2.5%, empty for none
+type InterestRatesRequest struct {
+	CreditRate string `json:"credit_rate"`
+	DebitRate  string `json:"debit_rate"`
+}
+
+type AccountInterestRequest struct {
+	Product    string `json:"product"`
+	CreditRate string `json:"credit_rate"`
+	DebitRate  string `json:"debit_rate"`
+}
+
+type InterestSourceRequest struct {
+	AccountID string `json:"account_id"`
+}
+
+type AccountInterestResponse struct {
+	AccountID  string `json:"account_id"`
+	Currency   string `json:"currency"`
+	Product    string `json:"product,omitempty"`
+	CreditRate string `json:"credit_rate,omitempty"`
+	DebitRate  string `json:"debit_rate,omitempty"`
+	// Accrued is interest not posted yet, with sub-cent precision
+	Accrued string `json:"accrued"`
+}
+
+// accruedDigits is how many digits below the minor unit accrued interest
+// is shown with
+const accruedDigits = 6
+
+// SetInterestProductHandler creates or changes rates of the interest
+// product
+func SetInterestProductHandler(c *gin.Context) {
+	var r InterestRatesRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rates := bank.InterestRates{Credit: r.CreditRate, Debit: r.DebitRate}
+	if err := reqctx.Bank(c).SetInterestProduct(c.Param("name"), rates); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, r})
+}
+
+// SetInterestSourceHandler makes the account the one interest is paid
+// from in its currency
+func SetInterestSourceHandler(c *gin.Context) {
+	var r InterestSourceRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	uid, err := uuid.Parse(r.AccountID)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if err := reqctx.Bank(c).SetInterestAccount(uid); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, r})
+}
+
+// GetAccountInterestHandler returns the rates the account accrues at and
+// the interest accrued so far
+func GetAccountInterestHandler(c *gin.Context) {
+	ac, status, err := getAdminAccount(c)
+	if err != nil {
+		errorJSON(c, status, err.Error())
+		return
+	}
+
+	resp, err := accountInterestResponse(c, ac)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
+
+// SetAccountInterestHandler sets the product or own rates of the account,
+// an empty request stops accrual
+func SetAccountInterestHandler(c *gin.Context) {
+	ac, status, err := getAdminAccount(c)
+	if err != nil {
+		errorJSON(c, status, err.Error())
+		return
+	}
+
+	var r AccountInterestRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ai := bank.AccountInterest{Product: r.Product}
+	if r.CreditRate != "" || r.DebitRate != "" {
+		ai.Rates = &bank.InterestRates{Credit: r.CreditRate, Debit: r.DebitRate}
+	}
+
+	if err := reqctx.Bank(c).SetAccountInterest(ac.ID(), ai); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	resp, err := accountInterestResponse(c, ac)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
+
+func accountInterestResponse(c *gin.Context, ac bank.Account) (AccountInterestResponse, error) {
+	ai, rates, accrued, err := reqctx.Bank(c).InterestOf(ac.ID())
+	if err != nil {
+		return AccountInterestResponse{}, err
+	}
+
+	exp := currencyExponent(ac.Currency())
+	unit := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+	return AccountInterestResponse{
+		AccountID:  ac.ID().String(),
+		Currency:   ac.Currency(),
+		Product:    ai.Product,
+		CreditRate: rates.Credit,
+		DebitRate:  rates.Debit,
+		Accrued:    accrued.Quo(accrued, unit).FloatString(exp + accruedDigits),
+	}, nil
+}
+
+type SetAccountStatusRequest struct {
+	Status string `json:"status"`
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+}
+
+type CloseAccountRequest struct {
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+	// SweepTo receives the balance of the closed account
+	SweepTo string `json:"sweep_to"`
+}
+
+type StatusChangeResponse struct {
+	AccountID          string    `json:"account_id"`
+	From               string    `json:"from"`
+	To                 string    `json:"to"`
+	Actor              string    `json:"actor"`
+	Reason             string    `json:"reason"`
+	SweepTo            string    `json:"sweep_to,omitempty"`
+	TransferID         string    `json:"transfer_id,omitempty"`
+	CancelledSchedules []string  `json:"cancelled_schedules,omitempty"`
+	At                 time.Time `json:"at"`
+}
+
+type GetStatusHistoryResponse struct {
+	Status  string                 `json:"status"`
+	History []StatusChangeResponse `json:"history"`
+}
+
+// SetAccountStatusHandler freezes or unfreezes the account
+func SetAccountStatusHandler(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	var r SetAccountStatusRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ch, err := reqctx.Bank(c).SetAccountStatus(uid, bank.AccountStatus(r.Status), r.Actor, r.Reason)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, statusChangeResponse(ch)})
+}
+
+// CloseAccountHandler closes the account, the balance is moved to the sweep
+// account if there is any
+func CloseAccountHandler(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	var r CloseAccountRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sweepTo := uuid.Nil
+	if r.SweepTo != "" {
+		if sweepTo, err = uuid.Parse(r.SweepTo); err != nil {
+			errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	ch, err := reqctx.Bank(c).CloseAccount(uid, sweepTo, r.Actor, r.Reason)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, statusChangeResponse(ch)})
+}
+
+// GetStatusHistoryHandler returns the current status of the account and
+// who changed it and why
+func GetStatusHistoryHandler(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	ac, err := _bank.GetAccount(uid)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	history, err := _bank.StatusHistory(uid)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	resp := GetStatusHistoryResponse{Status: string(ac.Status()), History: make([]StatusChangeResponse, 0, len(history))}
+	for _, ch := range history {
+		resp.History = append(resp.History, statusChangeResponse(ch))
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
+
+func statusChangeResponse(ch bank.StatusChange) StatusChangeResponse {
+	resp := StatusChangeResponse{
+		AccountID: ch.AccountID.String(),
+		From:      string(ch.From),
+		To:        string(ch.To),
+		Actor:     ch.Actor,
+		Reason:    ch.Reason,
+		At:        ch.At,
+	}
+	if ch.SweepTo != uuid.Nil {
+		resp.SweepTo = ch.SweepTo.String()
+		resp.TransferID = ch.TxID.String()
+	}
+	for _, id := range ch.Cancelled {
+		resp.CancelledSchedules = append(resp.CancelledSchedules, id.String())
+	}
+	return resp
+}
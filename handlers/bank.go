@@ -5,35 +5,172 @@ import (
 	"github.com/JohnCGriffin/overflow"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"io"
 	"net/http"
 	"regexp"
 	"simple_bank/models/bank"
+	"simple_bank/models/currency"
+	"simple_bank/reqctx"
 	"strconv"
 	"strings"
+	"time"
 )
 
-var validBalanceRegexp = regexp.MustCompile(`^[0-9]+(.[0-9][0-9])?$`)
+// validBalanceRegexps match amounts with as many decimals as the currency
+// minor unit exponent, or with none
+var validBalanceRegexps = map[int]*regexp.Regexp{
+	0: regexp.MustCompile(`^[0-9]+$`),
+	2: regexp.MustCompile(`^[0-9]+(.[0-9][0-9])?$`),
+	3: regexp.MustCompile(`^[0-9]+(.[0-9][0-9][0-9])?$`),
+}
+
+const (
+	defaultTransactionsLimit = 50
+	maxTransactionsLimit     = 500
+
+	defaultAccountsLimit = 50
+	maxAccountsLimit     = 500
+)
 
 type CreateAccountRequest struct {
-	Balance string `json:"balance"`
+	Balance  string `json:"balance"`
+	Currency string `json:"currency"`
+	// OverdraftLimit is how far below zero the balance may go, none if empty
+	OverdraftLimit string `json:"overdraft_limit"`
+	// ExternalRef is unique per owner
+	Owner       string   `json:"owner_id"`
+	Name        string   `json:"name"`
+	ExternalRef string   `json:"external_ref"`
+	Tags        []string `json:"tags"`
 }
 
 type CreateAccountResponse struct {
-	Uid string `json:"account_id"`
+	Uid      string `json:"account_id"`
+	Currency string `json:"currency"`
 }
 
+type AccountResponse struct {
+	Uid              string    `json:"account_id"`
+	Owner            string    `json:"owner_id"`
+	Name             string    `json:"name"`
+	ExternalRef      string    `json:"external_ref"`
+	Tags             []string  `json:"tags"`
+	Currency         string    `json:"currency"`
+	Balance          string    `json:"balance"`
+	AvailableBalance string    `json:"available_balance"`
+	OverdraftLimit   string    `json:"overdraft_limit"`
+	Headroom         string    `json:"headroom"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+type ListAccountsResponse struct {
+	Accounts   []AccountResponse `json:"accounts"`
+	NextCursor string            `json:"next_cursor"`
+}
+
+// GetBalanceResponse has the ledger balance and the part of it which is not
+// held. Headroom is what can be spent, overdraft included.
 type GetBalanceResponse struct {
-	Balance string `json:"balance"`
+	Balance          string `json:"balance"`
+	AvailableBalance string `json:"available_balance"`
+	OverdraftLimit   string `json:"overdraft_limit"`
+	Headroom         string `json:"headroom"`
+	Currency         string `json:"currency"`
 }
 
+type TransactionResponse struct {
+	TransferID   string    `json:"transfer_id"`
+	Counterparty string    `json:"counterparty"`
+	Amount       string    `json:"amount"`
+	Balance      string    `json:"balance"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type GetTransactionsResponse struct {
+	Transactions []TransactionResponse `json:"transactions"`
+	NextCursor   string                `json:"next_cursor"`
+}
+
+// ErrorResponse tells why the request failed, RequestID ties it to the logs
 type ErrorResponse struct {
+	Message   string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// LimitErrorResponse tells which spending limit the transfer breaches by
+// the code, with the limit and what is used of it. Both are amounts except
+// for the hourly count limit.
+type LimitErrorResponse struct {
 	Message string `json:"error"`
+	Code    string `json:"code"`
+	Limit   string `json:"limit"`
+	Used    string `json:"used"`
+
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type TransferRequest struct {
 	From string `json:"from"`
 	To string `json:"to"`
 	Amount string `json:"amount"`
+	// Convert allows transfer between accounts in different currencies
+	Convert bool `json:"convert"`
+}
+
+// TransferResponse tells the fee charged to the sender with the transfer,
+// in the sender currency
+type TransferResponse struct {
+	TransferID    string `json:"transfer_id"`
+	Fee           string `json:"fee"`
+	Currency      string `json:"currency"`
+	FeeTransferID string `json:"fee_transfer_id,omitempty"`
+}
+
+// QuoteResponse is what the transfer would cost: Amount and Fee in
+// Currency and Total of both. Credit is what the recipient would get in
+// CreditCurrency.
+type QuoteResponse struct {
+	Amount         string `json:"amount"`
+	Fee            string `json:"fee"`
+	Total          string `json:"total"`
+	Currency       string `json:"currency"`
+	Credit         string `json:"credit"`
+	CreditCurrency string `json:"credit_currency"`
+}
+
+type BatchTransferRequest struct {
+	Transfers []TransferRequest `json:"transfers"`
+}
+
+type BatchTransferResponse struct {
+	TransferIDs []string `json:"transfer_ids"`
+}
+
+type LegErrorResponse struct {
+	Index   int    `json:"index"`
+	Message string `json:"error"`
+	// Code is set for breached spending limits
+	Code string `json:"code,omitempty"`
+}
+
+// BatchErrorResponse lists the failed transfers of a rejected batch
+type BatchErrorResponse struct {
+	Message   string             `json:"error"`
+	Legs      []LegErrorResponse `json:"legs"`
+	RequestID string             `json:"request_id,omitempty"`
+}
+
+type ReverseTransferRequest struct {
+	// Amount is what is left of the transfer if empty
+	Amount string `json:"amount"`
+}
+
+type ReverseTransferResponse struct {
+	TransferID string `json:"transfer_id"`
+	Reverses   string `json:"reverses"`
+	Amount     string `json:"amount"`
 }
 
 type JSONResponse struct {
@@ -46,25 +183,121 @@ func CreateAccountHandler(c *gin.Context) {
 	var r CreateAccountRequest
 	err := c.ShouldBindJSON(&r)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	balance, err := stringToBalanceInt64(r.Balance)
+	if r.Currency == "" {
+		r.Currency = currency.Default
+	}
+	cur, err := currency.Get(r.Currency)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	balance, err := stringToBalanceInt64(r.Balance, cur.Exponent)
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	_bank := bank.GetBank()
-	uid, err := _bank.CreateAccount(balance)
+	var overdraft int64
+	if r.OverdraftLimit != "" {
+		overdraft, err = stringToBalanceInt64(r.OverdraftLimit, cur.Exponent)
+		if err != nil {
+			errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	_bank := reqctx.Bank(c)
+	uid, err := _bank.CreateAccountWith(bank.AccountParams{
+		Balance:     balance,
+		Overdraft:   overdraft,
+		Currency:    cur.Code,
+		Owner:       r.Owner,
+		Name:        r.Name,
+		ExternalRef: r.ExternalRef,
+		Tags:        r.Tags,
+	})
 
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, &JSONResponse{0, CreateAccountResponse{uid.String()}})
+	c.JSON(http.StatusOK, &JSONResponse{0, CreateAccountResponse{uid.String(), cur.Code}})
+}
+
+func GetAccountHandler(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	ac, err := _bank.GetAccount(uid)
+	if err == bank.ErrAccountNotFound {
+		errorJSON(c, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	available, err := _bank.AvailableBalance(uid)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	headroom, err := _bank.Headroom(uid)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, accountResponse(ac, available, headroom)})
+}
+
+// ListAccountsHandler pages through accounts matching the query
+// parameters, see parseAccountQuery
+func ListAccountsHandler(c *gin.Context) {
+	q, err := parseAccountQuery(c)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	accounts, more, err := _bank.FindAccounts(q)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	resp := ListAccountsResponse{Accounts: make([]AccountResponse, 0, len(accounts))}
+	for _, ac := range accounts {
+		available, err := _bank.AvailableBalance(ac.ID())
+		if err != nil {
+			errorJSON(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		headroom, err := _bank.Headroom(ac.ID())
+		if err != nil {
+			errorJSON(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Accounts = append(resp.Accounts, accountResponse(ac, available, headroom))
+	}
+	if more && len(accounts) > 0 {
+		cursor := q.Cursor(accounts[len(accounts)-1])
+		resp.NextCursor = strconv.FormatInt(cursor.Key, 10) + "_" + cursor.ID.String()
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
 }
 
 func GetBalanceByIdHandler(c *gin.Context) {
@@ -72,19 +305,83 @@ func GetBalanceByIdHandler(c *gin.Context) {
 
 	uid, err := uuid.Parse(id)
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	_bank := bank.GetBank()
-	balance, err := _bank.GetAccountBalance(uid)
+	_bank := reqctx.Bank(c)
+	ac, err := _bank.GetAccount(uid)
+
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
 
+	available, err := _bank.AvailableBalance(uid)
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, &JSONResponse{ 0, GetBalanceResponse{balanceInt64ToString(balance)}})
+	headroom, err := _bank.Headroom(uid)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	// balances are negative once the account is overdrawn
+	exp := currencyExponent(ac.Currency())
+	c.JSON(http.StatusOK, &JSONResponse{ 0, GetBalanceResponse{
+		signedBalanceToString(ac.Balance(), exp),
+		signedBalanceToString(available, exp),
+		signedBalanceToString(ac.OverdraftLimit(), exp),
+		signedBalanceToString(headroom, exp),
+		ac.Currency(),
+	}})
+}
+
+func GetTransactionsHandler(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	filter, err := parsePostingFilter(c)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	ac, err := _bank.GetAccount(uid)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	postings, more, err := _bank.GetAccountPostings(uid, filter)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	exp := currencyExponent(ac.Currency())
+	resp := GetTransactionsResponse{Transactions: make([]TransactionResponse, 0, len(postings))}
+	for _, p := range postings {
+		resp.Transactions = append(resp.Transactions, TransactionResponse{
+			TransferID:   p.TxID.String(),
+			Counterparty: p.Counterparty.String(),
+			Amount:       signedBalanceToString(p.Signed(), exp),
+			Balance:      signedBalanceToString(p.Balance, exp),
+			CreatedAt:    p.CreatedAt,
+		})
+	}
+	if more && len(postings) > 0 {
+		resp.NextCursor = strconv.FormatUint(postings[len(postings)-1].Seq, 10)
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
 }
 
 func TransferHandler(c *gin.Context) {
@@ -94,45 +391,418 @@ func TransferHandler(c *gin.Context) {
 	// Bind JSON
 	err := c.ShouldBindJSON(&r)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// validating from UID
+	from, err := uuid.Parse(r.From)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	// validating to UID
+	to, err := uuid.Parse(r.To)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	// amount is in the currency of the originating account
+	_bank := reqctx.Bank(c)
+	fromAccount, err := _bank.GetAccount(from)
+	if err == bank.ErrAccountNotFound {
+		errorJSON(c, http.StatusUnprocessableEntity, bank.ErrFromNotFound.Error())
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
 	// validate balance
-	amount, err := stringToBalanceInt64(r.Amount)
+	amount, err := stringToBalanceInt64(r.Amount, currencyExponent(fromAccount.Currency()))
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	// validating from UID
-	from, err := uuid.Parse(r.From)
+	// attempt to transfer, the fee is charged with it
+	res, err := _bank.TransferWithFee(from, to, amount, r.Convert)
+	if limitErr, ok := err.(*bank.LimitError); ok {
+		respondError(c, http.StatusUnprocessableEntity, limitErr.Error(), limitErrorResponse(c, limitErr, fromAccount.Currency()))
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	resp := TransferResponse{
+		TransferID: res.TxID.String(),
+		Fee:        signedBalanceToString(res.Fee, currencyExponent(res.Currency)),
+		Currency:   res.Currency,
+	}
+	if res.FeeTxID != uuid.Nil {
+		resp.FeeTransferID = res.FeeTxID.String()
+	}
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
+
+// QuoteTransferHandler returns the fee of the transfer without moving
+// money, the transfer is validated as it would be made now
+func QuoteTransferHandler(c *gin.Context) {
+	var r TransferRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	leg, err := parseTransferLeg(_bank, r)
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	// validating to UID
+	q, err := _bank.QuoteTransfer(leg.From, leg.To, leg.Amount, leg.Convert)
+	if limitErr, ok := err.(*bank.LimitError); ok {
+		fromAccount, _ := _bank.GetAccount(leg.From)
+		respondError(c, http.StatusUnprocessableEntity, limitErr.Error(), limitErrorResponse(c, limitErr, fromAccount.Currency()))
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	exp := currencyExponent(q.Currency)
+	c.JSON(http.StatusOK, &JSONResponse{0, QuoteResponse{
+		Amount:         signedBalanceToString(q.Amount, exp),
+		Fee:            signedBalanceToString(q.Fee, exp),
+		Total:          signedBalanceToString(q.Total, exp),
+		Currency:       q.Currency,
+		Credit:         signedBalanceToString(q.Credit, currencyExponent(q.CreditCurrency)),
+		CreditCurrency: q.CreditCurrency,
+	}})
+}
+
+// BatchTransferHandler applies all transfers of the batch or none of them
+func BatchTransferHandler(c *gin.Context) {
+	var r BatchTransferRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	legs := make([]bank.TransferLeg, len(r.Transfers))
+	var failed []LegErrorResponse
+	for i, t := range r.Transfers {
+		leg, err := parseTransferLeg(_bank, t)
+		if err != nil {
+			failed = append(failed, LegErrorResponse{i, err.Error(), ""})
+			continue
+		}
+		legs[i] = leg
+	}
+	if len(failed) > 0 {
+		respondError(c, http.StatusUnprocessableEntity, "batch is rejected", BatchErrorResponse{"batch is rejected", failed, reqctx.RequestID(c)})
+		return
+	}
+
+	ids, err := _bank.TransferBatch(legs)
+	if batchErr, ok := err.(*bank.BatchError); ok {
+		for i := range legs {
+			if legErr, ok := batchErr.Legs[i]; ok {
+				failed = append(failed, LegErrorResponse{i, legErr.Error(), limitCode(legErr)})
+			}
+		}
+		respondError(c, http.StatusUnprocessableEntity, "batch is rejected", BatchErrorResponse{"batch is rejected", failed, reqctx.RequestID(c)})
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	resp := BatchTransferResponse{TransferIDs: make([]string, 0, len(ids))}
+	for _, id := range ids {
+		resp.TransferIDs = append(resp.TransferIDs, id.String())
+	}
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
+
+// parseTransferLeg validates the transfer request of a batch, the amount is
+// in the currency of the originating account
+func parseTransferLeg(b *bank.Bank, r TransferRequest) (bank.TransferLeg, error) {
+	from, err := uuid.Parse(r.From)
+	if err != nil {
+		return bank.TransferLeg{}, err
+	}
 	to, err := uuid.Parse(r.To)
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		return bank.TransferLeg{}, err
+	}
+
+	fromAccount, err := b.GetAccount(from)
+	if err == bank.ErrAccountNotFound {
+		return bank.TransferLeg{}, bank.ErrFromNotFound
+	} else if err != nil {
+		return bank.TransferLeg{}, err
+	}
+
+	amount, err := stringToBalanceInt64(r.Amount, currencyExponent(fromAccount.Currency()))
+	if err != nil {
+		return bank.TransferLeg{}, err
+	}
+
+	return bank.TransferLeg{From: from, To: to, Amount: amount, Convert: r.Convert}, nil
+}
+
+// ReverseTransferHandler moves money of the transfer back, fully or
+// partially
+func ReverseTransferHandler(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	// body is optional
+	var r ReverseTransferRequest
+	if err := c.ShouldBindJSON(&r); err != nil && err != io.EOF {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	orig, ok := _bank.Ledger().Transaction(id)
+	if !ok {
+		errorJSON(c, http.StatusNotFound, bank.ErrTransferNotFound.Error())
 		return
 	}
 
-	// attempt to transfer
-	_bank := bank.GetBank()
-	err = _bank.Transfer(from, to, amount)
+	exp := currencyExponent(orig.Currency)
+	var amount int64
+	if r.Amount != "" {
+		amount, err = stringToBalanceInt64(r.Amount, exp)
+		if err != nil {
+			errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	txID, err := _bank.ReverseTransfer(id, amount)
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, &JSONResponse{-1, ErrorResponse{err.Error()}})
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, &JSONResponse{ 0, nil})
+	tx, _ := _bank.Ledger().Transaction(txID)
+	c.JSON(http.StatusOK, &JSONResponse{0, ReverseTransferResponse{txID.String(), id.String(), signedBalanceToString(tx.Amount, exp)}})
+}
+
+func accountResponse(ac bank.Account, available int64, headroom int64) AccountResponse {
+	exp := currencyExponent(ac.Currency())
+	return AccountResponse{
+		Uid:              ac.ID().String(),
+		Owner:            ac.Owner(),
+		Name:             ac.Name(),
+		ExternalRef:      ac.ExternalRef(),
+		Tags:             ac.Tags(),
+		Currency:         ac.Currency(),
+		Balance:          signedBalanceToString(ac.Balance(), exp),
+		AvailableBalance: signedBalanceToString(available, exp),
+		OverdraftLimit:   signedBalanceToString(ac.OverdraftLimit(), exp),
+		Headroom:         signedBalanceToString(headroom, exp),
+		Status:           string(ac.Status()),
+		CreatedAt:        ac.CreatedAt(),
+		UpdatedAt:        ac.UpdatedAt(),
+	}
+}
+
+func limitErrorResponse(c *gin.Context, e *bank.LimitError, cur string) LimitErrorResponse {
+	resp := LimitErrorResponse{
+		Message:   e.Error(),
+		Code:      string(e.Code),
+		Limit:     strconv.FormatInt(e.Limit, 10),
+		Used:      strconv.FormatInt(e.Used, 10),
+		RequestID: reqctx.RequestID(c),
+	}
+	if e.Code != bank.LimitHourlyCount {
+		exp := currencyExponent(cur)
+		resp.Limit = signedBalanceToString(e.Limit, exp)
+		resp.Used = signedBalanceToString(e.Used, exp)
+	}
+	return resp
+}
+
+// limitCode returns the code of breached spending limits, empty for other
+// errors
+func limitCode(err error) string {
+	if limitErr, ok := err.(*bank.LimitError); ok {
+		return string(limitErr.Code)
+	}
+	return ""
+}
+
+// parsePostingFilter reads cursor, limit, from, to and direction query
+// parameters of the transactions history request
+func parsePostingFilter(c *gin.Context) (bank.PostingFilter, error) {
+	f := bank.PostingFilter{Limit: defaultTransactionsLimit}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return f, errors.New("invalid cursor")
+		}
+		f.After = after
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l <= 0 || l > maxTransactionsLimit {
+			return f, errors.New("limit must be between 1 and " + strconv.Itoa(maxTransactionsLimit))
+		}
+		f.Limit = l
+	}
+
+	if from := c.Query("from"); from != "" {
+		since, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return f, errors.New("from must be RFC3339 time")
+		}
+		f.Since = since
+	}
+
+	if to := c.Query("to"); to != "" {
+		until, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return f, errors.New("to must be RFC3339 time")
+		}
+		f.Until = until
+	}
+
+	switch c.Query("direction") {
+	case "":
+	case "incoming":
+		f.Type = bank.Credit
+	case "outgoing":
+		f.Type = bank.Debit
+	default:
+		return f, errors.New("direction must be incoming or outgoing")
+	}
+
+	return f, nil
 }
 
-func stringToBalanceInt64(s string) (int64, error) {
+// parseAccountQuery reads cursor, limit, sort (created_at or balance),
+// order (asc or desc), created_from, created_to, updated_from, updated_to,
+// min_balance, max_balance, currency, status, owner_id, name, external_ref
+// and tag query parameters of the accounts listing. Balance range and
+// sort need the currency.
+func parseAccountQuery(c *gin.Context) (bank.AccountQuery, error) {
+	q := bank.AccountQuery{
+		Limit:       defaultAccountsLimit,
+		Sort:        bank.AccountSort(c.Query("sort")),
+		Status:      bank.AccountStatus(c.Query("status")),
+		Owner:       c.Query("owner_id"),
+		Name:        c.Query("name"),
+		ExternalRef: c.Query("external_ref"),
+		Tag:         c.Query("tag"),
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		part := strings.SplitN(cursor, "_", 2)
+		if len(part) != 2 {
+			return q, errors.New("invalid cursor")
+		}
+		key, err := strconv.ParseInt(part[0], 10, 64)
+		if err != nil {
+			return q, errors.New("invalid cursor")
+		}
+		id, err := uuid.Parse(part[1])
+		if err != nil {
+			return q, errors.New("invalid cursor")
+		}
+		q.After = &bank.AccountCursor{Key: key, ID: id}
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l <= 0 || l > maxAccountsLimit {
+			return q, errors.New("limit must be between 1 and " + strconv.Itoa(maxAccountsLimit))
+		}
+		q.Limit = l
+	}
+
+	switch c.Query("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
 
-	if !validBalanceRegexp.MatchString(s) {
+	times := map[string]*time.Time{
+		"created_from": &q.CreatedSince,
+		"created_to":   &q.CreatedUntil,
+		"updated_from": &q.UpdatedSince,
+		"updated_to":   &q.UpdatedUntil,
+	}
+	for name, t := range times {
+		if v := c.Query(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, errors.New(name + " must be RFC3339 time")
+			}
+			*t = parsed
+		}
+	}
+
+	if code := c.Query("currency"); code != "" {
+		cur, err := currency.Get(code)
+		if err != nil {
+			return q, err
+		}
+		q.Currency = cur.Code
+	}
+
+	balances := map[string]**int64{
+		"min_balance": &q.MinBalance,
+		"max_balance": &q.MaxBalance,
+	}
+	for name, b := range balances {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		if q.Currency == "" {
+			return q, errors.New("currency is required to filter by balance")
+		}
+		parsed, err := stringToBalanceInt64(v, currencyExponent(q.Currency))
+		if err != nil {
+			return q, errors.New(name + ": " + err.Error())
+		}
+		*b = &parsed
+	}
+
+	return q, nil
+}
+
+// currencyExponent returns minor unit exponent of the account currency
+func currencyExponent(code string) int {
+	cur, err := currency.Get(code)
+	if err != nil {
+		return 2
+	}
+	return cur.Exponent
+}
+
+// stringToBalanceInt64 parses the amount into minor units of a currency
+// with the exp exponent, e.g. "1.50" is 150 for exp 2
+func stringToBalanceInt64(s string, exp int) (int64, error) {
+
+	re, ok := validBalanceRegexps[exp]
+	if !ok || !re.MatchString(s) {
 		return -1, errors.New("can not parse balance")
 	}
 
@@ -142,7 +812,7 @@ func stringToBalanceInt64(s string) (int64, error) {
 		if err != nil {
 			return -1, err
 		} else {
-			if mulRes, ok := overflow.Mul64(parsed, 100); !ok {
+			if mulRes, ok := overflow.Mul64(parsed, pow10(exp)); !ok {
 				return -1, errors.New("overflow, balance too high")
 			} else {
 				return mulRes, nil
@@ -159,17 +829,31 @@ func stringToBalanceInt64(s string) (int64, error) {
 	}
 }
 
-func balanceInt64ToString(b string) string {
-	var left, right string
-	switch {
-	case b == "0":
-		return "0"
-	case len(b) == 1:
-		left, right = "0", "0"+b
-	case len(b) == 2:
-		left, right = "0", b
-	default:
-		left, right = b[:len(b)-2], b[len(b)-2:]
+// balanceInt64ToString formats minor units of a currency with the exp
+// exponent, e.g. "150" is "1.50" for exp 2
+func balanceInt64ToString(b string, exp int) string {
+	if b == "0" || exp == 0 {
+		return b
+	}
+
+	for len(b) <= exp {
+		b = "0" + b
+	}
+	return b[:len(b)-exp] + "." + b[len(b)-exp:]
+}
+
+// signedBalanceToString formats signed amounts, e.g. -1050 as "-10.50"
+func signedBalanceToString(v int64, exp int) string {
+	if v < 0 {
+		return "-" + balanceInt64ToString(strconv.FormatInt(v, 10)[1:], exp)
+	}
+	return balanceInt64ToString(strconv.FormatInt(v, 10), exp)
+}
+
+func pow10(exp int) int64 {
+	res := int64(1)
+	for i := 0; i < exp; i++ {
+		res *= 10
 	}
-	return left + "." + right
+	return res
 }
@@ -1,17 +1,29 @@
 package handlers_test
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"simple_bank/handlers"
 	bankModel "simple_bank/models/bank"
+	"simple_bank/models/clock"
+	"simple_bank/models/fees"
+	"simple_bank/models/fx"
 	"simple_bank/server"
 	"strings"
 	"testing"
+	"time"
 )
 
 type TestCaseStatusCode struct {
@@ -39,7 +51,7 @@ func TestCreateAccountHandler(t *testing.T) {
 
 	// Switch to test mode and get the router
 	gin.SetMode(gin.TestMode)
-	r := server.NewRouter()
+	r := server.NewRouter(zap.NewNop())
 
 	for key, item := range cases {
 
@@ -74,7 +86,7 @@ func TestGetBalanceByIdHandler_StatusCodesNegative(t *testing.T) {
 
 	// Switch to test mode and get the router
 	gin.SetMode(gin.TestMode)
-	r := server.NewRouter()
+	r := server.NewRouter(zap.NewNop())
 
 	for key, item := range cases {
 
@@ -100,7 +112,7 @@ func TestGetBalanceByIdHandler(t *testing.T) {
 
 	// Switch to test mode and get the router
 	gin.SetMode(gin.TestMode)
-	r := server.NewRouter()
+	r := server.NewRouter(zap.NewNop())
 
 	url := "/balance/" + uid.String()
 	req := httptest.NewRequest("GET", url, nil)
@@ -141,7 +153,7 @@ func TestTransferHandler_Validation(t *testing.T) {
 
 	// Switch to test mode and get the router
 	gin.SetMode(gin.TestMode)
-	r := server.NewRouter()
+	r := server.NewRouter(zap.NewNop())
 
 	url := "/transfer"
 
@@ -158,7 +170,7 @@ func TestTransferHandler_Validation(t *testing.T) {
 func TestTransferHandler_TransferError(t *testing.T) {
 	// Switch to test mode and get the router
 	gin.SetMode(gin.TestMode)
-	r := server.NewRouter()
+	r := server.NewRouter(zap.NewNop())
 
 	url := "/transfer"
 
@@ -182,6 +194,9 @@ func TestTransferHandler_TransferError(t *testing.T) {
 
 	r.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	errResp := &handlers.ErrorResponse{}
+	json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: errResp})
+	assert.Equal(t, bankModel.ErrFromNotFound.Error(), errResp.Message)
 
 	// to account not found
 	goodJSON = `{"from":"` + uidFrom.String() + `","to":"800227ee-362c-4382-809d-ea39f0807418","amount":"100"}`
@@ -205,7 +220,7 @@ func TestTransferHandler_TransferError(t *testing.T) {
 func TestTransferHandler(t *testing.T) {
 	// Switch to test mode and get the router
 	gin.SetMode(gin.TestMode)
-	r := server.NewRouter()
+	r := server.NewRouter(zap.NewNop())
 
 	url := "/transfer"
 
@@ -252,3 +267,1133 @@ func TestTransferHandler(t *testing.T) {
 	assert.Equal(t, "1230000", updatedFrom)
 	assert.Equal(t, "904590", updatedTo)
 }
+
+func TestGetTransactionsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	uidFrom, err := bank.CreateAccount(int64(100 * 100))
+	if err != nil {
+		assert.Fail(t, "Can't create From account")
+	}
+	uidTo, err := bank.CreateAccount(0)
+	if err != nil {
+		assert.Fail(t, "Can't create To account")
+	}
+	if _, err := bank.Transfer(uidFrom, uidTo, int64(2550)); err != nil {
+		assert.Fail(t, "Can't transfer")
+	}
+
+	cases := map[string]struct {
+		query      string
+		statusCode int
+		count      int
+		amounts    []string
+	}{
+		"all":            {query: "", statusCode: http.StatusOK, count: 2, amounts: []string{"100.00", "-25.50"}},
+		"outgoing":       {query: "?direction=outgoing", statusCode: http.StatusOK, count: 1, amounts: []string{"-25.50"}},
+		"incoming":       {query: "?direction=incoming", statusCode: http.StatusOK, count: 1, amounts: []string{"100.00"}},
+		"limit":          {query: "?limit=1", statusCode: http.StatusOK, count: 1, amounts: []string{"100.00"}},
+		"future":         {query: "?from=2999-01-01T00:00:00Z", statusCode: http.StatusOK, count: 0},
+		"bad direction":  {query: "?direction=sideways", statusCode: http.StatusUnprocessableEntity},
+		"bad limit":      {query: "?limit=0", statusCode: http.StatusUnprocessableEntity},
+		"bad cursor":     {query: "?cursor=abc", statusCode: http.StatusUnprocessableEntity},
+		"bad time range": {query: "?to=yesterday", statusCode: http.StatusUnprocessableEntity},
+	}
+
+	for key, item := range cases {
+		req := httptest.NewRequest("GET", "/accounts/"+uidFrom.String()+"/transactions"+item.query, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, item.statusCode, w.Code, key)
+
+		if item.statusCode != http.StatusOK {
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		resp := &handlers.JSONResponse{Body: &handlers.GetTransactionsResponse{}}
+		if err := json.Unmarshal(body, resp); err != nil {
+			assert.Fail(t, "Can't unmarshal transactions response", key)
+			continue
+		}
+
+		txs := resp.Body.(*handlers.GetTransactionsResponse).Transactions
+		assert.Len(t, txs, item.count, key)
+		for i, amount := range item.amounts {
+			assert.Equal(t, amount, txs[i].Amount, key)
+		}
+	}
+
+	// second page via cursor
+	req := httptest.NewRequest("GET", "/accounts/"+uidFrom.String()+"/transactions?limit=1", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	resp := &handlers.JSONResponse{Body: &handlers.GetTransactionsResponse{}}
+	assert.Nil(t, json.Unmarshal(body, resp))
+	cursor := resp.Body.(*handlers.GetTransactionsResponse).NextCursor
+	assert.NotEmpty(t, cursor)
+
+	req = httptest.NewRequest("GET", "/accounts/"+uidFrom.String()+"/transactions?limit=1&cursor="+cursor, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body, _ = ioutil.ReadAll(w.Result().Body)
+	resp = &handlers.JSONResponse{Body: &handlers.GetTransactionsResponse{}}
+	assert.Nil(t, json.Unmarshal(body, resp))
+	page := resp.Body.(*handlers.GetTransactionsResponse)
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, "-25.50", page.Transactions[0].Amount)
+	assert.Equal(t, uidTo.String(), page.Transactions[0].Counterparty)
+	assert.Equal(t, "", page.NextCursor)
+}
+
+// failingStorage refuses to store any transfer
+type failingStorage struct {
+	*bankModel.MemoryStorage
+}
+
+func (s failingStorage) ApplyTransfer(tx bankModel.Transaction) error {
+	return errors.New("disk is full")
+}
+
+func TestTransferHandler_StorageError(t *testing.T) {
+	b, err := bankModel.New(failingStorage{bankModel.NewMemoryStorage()})
+	if err != nil {
+		assert.Fail(t, "Can't create bank")
+	}
+	defaultBank := bankModel.GetBank()
+	bankModel.SetBank(b)
+	defer bankModel.SetBank(defaultBank)
+
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	uidFrom, _ := b.CreateAccount(int64(100 * 100))
+	uidTo, _ := b.CreateAccount(0)
+
+	goodJSON := `{"from":"` + uidFrom.String() + `","to":"` + uidTo.String() + `","amount":"10"}`
+	req := httptest.NewRequest("POST", "/transfer", strings.NewReader(goodJSON))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "disk is full")
+
+	balance, _ := b.GetAccountBalance(uidFrom)
+	assert.Equal(t, "10000", balance)
+}
+
+func TestTransferHandler_Idempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	uidFrom, _ := bank.CreateAccount(int64(100 * 100))
+	uidTo, _ := bank.CreateAccount(0)
+
+	transfer := func(key, client, amount string) *httptest.ResponseRecorder {
+		body := `{"from":"` + uidFrom.String() + `","to":"` + uidTo.String() + `","amount":"` + amount + `"}`
+		req := httptest.NewRequest("POST", "/transfer", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		req.Header.Set("X-Client-ID", client)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := transfer("key-1", "client-a", "10")
+	assert.Equal(t, http.StatusOK, first.Code)
+
+	// retry does not move money again and gets the same response
+	retry := transfer("key-1", "client-a", "10")
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+
+	balance, _ := bank.GetAccountBalance(uidFrom)
+	assert.Equal(t, "9000", balance)
+
+	// same key with a different body
+	mismatch := transfer("key-1", "client-a", "20")
+	assert.Equal(t, http.StatusUnprocessableEntity, mismatch.Code)
+
+	// keys are scoped per client
+	other := transfer("key-1", "client-b", "10")
+	assert.Equal(t, http.StatusOK, other.Code)
+	assert.Empty(t, other.Header().Get("Idempotent-Replayed"))
+
+	balance, _ = bank.GetAccountBalance(uidFrom)
+	assert.Equal(t, "8000", balance)
+
+	// failed outcome is replayed as well
+	failed := transfer("key-2", "client-a", "1000")
+	assert.Equal(t, http.StatusUnprocessableEntity, failed.Code)
+	failedRetry := transfer("key-2", "client-a", "1000")
+	assert.Equal(t, failed.Body.String(), failedRetry.Body.String())
+}
+
+func TestTransferHandler_IdempotencyUnknownOutcome(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	uidFrom, _ := bank.CreateAccount(int64(100 * 100))
+	uidTo, _ := bank.CreateAccount(0)
+	body := `{"from":"` + uidFrom.String() + `","to":"` + uidTo.String() + `","amount":"10"}`
+
+	// the key was reserved but the process stopped before the outcome was stored
+	first := httptest.NewRequest("POST", "/transfer", strings.NewReader(body))
+	first.Header.Set("Idempotency-Key", "lost-1")
+	first.Header.Set("X-Client-ID", "client-a")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, first)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rec, ok := bank.GetIdempotencyRecord("client-a lost-1")
+	assert.True(t, ok)
+	assert.Nil(t, bank.ReserveIdempotencyKey(rec.Key, rec.RequestHash, rec.ExpiresAt))
+
+	retry := httptest.NewRequest("POST", "/transfer", strings.NewReader(body))
+	retry.Header.Set("Idempotency-Key", "lost-1")
+	retry.Header.Set("X-Client-ID", "client-a")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, retry)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	balance, _ := bank.GetAccountBalance(uidFrom)
+	assert.Equal(t, "9000", balance)
+}
+
+func TestCreateAccountHandler_Idempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	create := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/createAccount", strings.NewReader(`{"balance" : "10"}`))
+		req.Header.Set("Idempotency-Key", "create-1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first, retry := create(), create()
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+}
+
+func TestCreateAccountHandler_Currencies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	cases := map[string]struct {
+		input      string
+		statusCode int
+		balance    string
+		currency   string
+	}{
+		"default":          {input: `{"balance" : "3.80"}`, statusCode: http.StatusOK, balance: "3.80", currency: "RUB"},
+		"yen":              {input: `{"balance" : "1500", "currency" : "JPY"}`, statusCode: http.StatusOK, balance: "1500", currency: "JPY"},
+		"dinar":            {input: `{"balance" : "1.005", "currency" : "KWD"}`, statusCode: http.StatusOK, balance: "1.005", currency: "KWD"},
+		"yen with cents":   {input: `{"balance" : "15.00", "currency" : "JPY"}`, statusCode: http.StatusUnprocessableEntity},
+		"dinar cents":      {input: `{"balance" : "1.05", "currency" : "KWD"}`, statusCode: http.StatusUnprocessableEntity},
+		"unknown currency": {input: `{"balance" : "1", "currency" : "ABC"}`, statusCode: http.StatusUnprocessableEntity},
+	}
+
+	for key, item := range cases {
+		req := httptest.NewRequest("PUT", "/createAccount", strings.NewReader(item.input))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, item.statusCode, w.Code, key)
+
+		if item.statusCode != http.StatusOK {
+			continue
+		}
+
+		created := &handlers.JSONResponse{Body: &handlers.CreateAccountResponse{}}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), created), key)
+		uid := created.Body.(*handlers.CreateAccountResponse).Uid
+
+		req = httptest.NewRequest("GET", "/balance/"+uid, nil)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		resp := &handlers.JSONResponse{Body: &handlers.GetBalanceResponse{}}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), resp), key)
+		assert.Equal(t, item.balance, resp.Body.(*handlers.GetBalanceResponse).Balance, key)
+		assert.Equal(t, item.currency, resp.Body.(*handlers.GetBalanceResponse).Currency, key)
+	}
+}
+
+func TestTransferHandler_Currencies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	yenFrom, _ := bank.CreateAccountWith(bankModel.AccountParams{Balance: 10000, Currency: "JPY"})
+	yenTo, _ := bank.CreateAccountWith(bankModel.AccountParams{Balance: 0, Currency: "JPY"})
+	usd, _ := bank.CreateAccountWith(bankModel.AccountParams{Balance: 0, Currency: "USD"})
+
+	transfer := func(from, to, amount string) int {
+		body := `{"from":"` + from + `","to":"` + to + `","amount":"` + amount + `"}`
+		req := httptest.NewRequest("POST", "/transfer", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// amount is parsed in yen, without decimals
+	assert.Equal(t, http.StatusOK, transfer(yenFrom.String(), yenTo.String(), "500"))
+	assert.Equal(t, http.StatusUnprocessableEntity, transfer(yenFrom.String(), yenTo.String(), "5.00"))
+	balance, _ := bank.GetAccountBalance(yenTo)
+	assert.Equal(t, "500", balance)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, transfer(yenFrom.String(), usd.String(), "500"))
+}
+
+func TestTransferHandler_Convert(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	dir, err := ioutil.TempDir("", "fx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rates.json")
+	ioutil.WriteFile(path, []byte(`{"rates": {"USD/EUR": "0.5"}}`), 0600)
+	rates, err := fx.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bank := bankModel.GetBank()
+	bank.SetRates(rates)
+	defer bank.SetRates(nil)
+
+	usd, _ := bank.CreateAccountWith(bankModel.AccountParams{Balance: 10000, Currency: "USD"})
+	eur, _ := bank.CreateAccountWith(bankModel.AccountParams{Balance: 0, Currency: "EUR"})
+
+	transfer := func(convert string) int {
+		body := `{"from":"` + usd.String() + `","to":"` + eur.String() + `","amount":"10.00"` + convert + `}`
+		req := httptest.NewRequest("POST", "/transfer", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// conversion must be explicit
+	assert.Equal(t, http.StatusUnprocessableEntity, transfer(""))
+	assert.Equal(t, http.StatusOK, transfer(`,"convert":true`))
+
+	balance, _ := bank.GetAccountBalance(eur)
+	assert.Equal(t, "500", balance)
+
+	// rates are reloaded from the file
+	ioutil.WriteFile(path, []byte(`{"rounding": "half-up", "rates": {"USD/EUR": "0.25", "EUR/USD": "4"}}`), 0600)
+	req := httptest.NewRequest("POST", "/admin/fx/reload", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	resp := &handlers.JSONResponse{Body: &handlers.ReloadRatesResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), resp))
+	assert.Equal(t, 2, resp.Body.(*handlers.ReloadRatesResponse).Rates)
+	assert.Equal(t, "half-up", resp.Body.(*handlers.ReloadRatesResponse).Rounding)
+
+	assert.Equal(t, http.StatusOK, transfer(`,"convert":true`))
+	balance, _ = bank.GetAccountBalance(eur)
+	assert.Equal(t, "750", balance)
+
+	// broken file is refused
+	ioutil.WriteFile(path, []byte(`{"rates": `), 0600)
+	req = httptest.NewRequest("POST", "/admin/fx/reload", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestHoldHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	from, _ := bank.CreateAccount(100 * 100)
+	to, _ := bank.CreateAccount(0)
+
+	do := func(method, path, body string) (int, *handlers.HoldResponse) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		resp := &handlers.JSONResponse{Body: &handlers.HoldResponse{}}
+		json.Unmarshal(w.Body.Bytes(), resp)
+		return w.Code, resp.Body.(*handlers.HoldResponse)
+	}
+
+	balance := func(id string) *handlers.GetBalanceResponse {
+		req := httptest.NewRequest("GET", "/balance/"+id, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		resp := &handlers.JSONResponse{Body: &handlers.GetBalanceResponse{}}
+		json.Unmarshal(w.Body.Bytes(), resp)
+		return resp.Body.(*handlers.GetBalanceResponse)
+	}
+
+	code, _ := do("POST", "/holds", `{"account_id":"`+from.String()+`","amount":"100.01"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = do("POST", "/holds", `{"account_id":"`+from.String()+`","amount":"10.00","expires_in":-1}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, hold := do("POST", "/holds", `{"account_id":"`+from.String()+`","amount":"30.00","expires_in":60}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "active", hold.Status)
+	assert.Equal(t, "30.00", hold.Amount)
+	assert.Equal(t, time.Minute, hold.ExpiresAt.Sub(hold.CreatedAt))
+
+	assert.Equal(t, "100.00", balance(from.String()).Balance)
+	assert.Equal(t, "70.00", balance(from.String()).AvailableBalance)
+
+	code, _ = do("GET", "/holds/"+hold.HoldID, "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do("GET", "/holds/bad", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, captured := do("POST", "/holds/"+hold.HoldID+"/capture", `{"to":"`+to.String()+`","amount":"25.50"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "captured", captured.Status)
+	assert.Equal(t, "25.50", captured.Captured)
+	assert.NotEmpty(t, captured.TransferID)
+
+	assert.Equal(t, "74.50", balance(from.String()).Balance)
+	assert.Equal(t, "74.50", balance(from.String()).AvailableBalance)
+	assert.Equal(t, "25.50", balance(to.String()).Balance)
+
+	code, _ = do("POST", "/holds/"+hold.HoldID+"/release", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// release gives the money back, capture without amount takes the whole hold
+	_, hold = do("POST", "/holds", `{"account_id":"`+from.String()+`","amount":"10.00"}`)
+	code, released := do("POST", "/holds/"+hold.HoldID+"/release", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "released", released.Status)
+	assert.Equal(t, "74.50", balance(from.String()).AvailableBalance)
+
+	_, hold = do("POST", "/holds", `{"account_id":"`+from.String()+`","amount":"4.50"}`)
+	code, captured = do("POST", "/holds/"+hold.HoldID+"/capture", `{"to":"`+to.String()+`"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "4.50", captured.Captured)
+	assert.Equal(t, "70.00", balance(from.String()).Balance)
+}
+
+func TestReverseTransferHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	from, _ := bank.CreateAccount(100 * 100)
+	to, _ := bank.CreateAccount(0)
+
+	req := httptest.NewRequest("POST", "/transfer", strings.NewReader(`{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"40.00"}`))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	transfer := &handlers.JSONResponse{Body: &handlers.TransferResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), transfer))
+	txID := transfer.Body.(*handlers.TransferResponse).TransferID
+	assert.NotEmpty(t, txID)
+
+	reverse := func(id, body string) (int, *handlers.ReverseTransferResponse) {
+		req := httptest.NewRequest("POST", "/transfers/"+id+"/reverse", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		resp := &handlers.JSONResponse{Body: &handlers.ReverseTransferResponse{}}
+		json.Unmarshal(w.Body.Bytes(), resp)
+		return w.Code, resp.Body.(*handlers.ReverseTransferResponse)
+	}
+
+	code, rev := reverse(txID, `{"amount":"15.00"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, txID, rev.Reverses)
+	assert.Equal(t, "15.00", rev.Amount)
+
+	code, _ = reverse(txID, `{"amount":"25.01"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = reverse("bad", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = reverse(from.String(), "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// the rest without a body
+	code, rev = reverse(txID, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "25.00", rev.Amount)
+
+	balance, _ := bank.GetAccountBalance(from)
+	assert.Equal(t, "10000", balance)
+}
+
+func TestAccountStatusHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	ac, _ := bank.CreateAccount(100 * 100)
+	sweep, _ := bank.CreateAccount(0)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	transfer := func() int {
+		return do("POST", "/transfer", `{"from":"`+ac.String()+`","to":"`+sweep.String()+`","amount":"1.00"}`).Code
+	}
+
+	w := do("POST", "/admin/accounts/"+ac.String()+"/status", `{"status":"frozen-debits","actor":"support","reason":"card stolen"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, transfer())
+
+	w = do("POST", "/admin/accounts/"+ac.String()+"/status", `{"status":"unknown","actor":"support","reason":"typo"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = do("POST", "/admin/accounts/"+ac.String()+"/status", `{"status":"active","reason":"no actor"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = do("POST", "/admin/accounts/"+ac.String()+"/status", `{"status":"active","actor":"support","reason":"card blocked"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, transfer())
+
+	w = do("POST", "/admin/accounts/"+ac.String()+"/close", `{"actor":"owner","reason":"moving out"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = do("POST", "/admin/accounts/"+ac.String()+"/close", `{"actor":"owner","reason":"moving out","sweep_to":"`+sweep.String()+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	closed := &handlers.JSONResponse{Body: &handlers.StatusChangeResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), closed))
+	assert.Equal(t, "closed", closed.Body.(*handlers.StatusChangeResponse).To)
+	assert.NotEmpty(t, closed.Body.(*handlers.StatusChangeResponse).TransferID)
+
+	balance, _ := bank.GetAccountBalance(sweep)
+	assert.Equal(t, "10000", balance)
+
+	w = do("GET", "/admin/accounts/"+ac.String()+"/status", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	history := &handlers.JSONResponse{Body: &handlers.GetStatusHistoryResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), history))
+	assert.Equal(t, "closed", history.Body.(*handlers.GetStatusHistoryResponse).Status)
+	assert.Len(t, history.Body.(*handlers.GetStatusHistoryResponse).History, 3)
+	assert.Equal(t, "card stolen", history.Body.(*handlers.GetStatusHistoryResponse).History[0].Reason)
+}
+
+func TestGetAccountHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/createAccount", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	ref := uuid.New().String()
+	w := create(`{"balance":"12.50","currency":"USD","owner_id":"crm-42","name":"Travel","external_ref":"` + ref + `","tags":["card","eu"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	created := &handlers.JSONResponse{Body: &handlers.CreateAccountResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), created))
+	uid := created.Body.(*handlers.CreateAccountResponse).Uid
+
+	w = create(`{"balance":"0","owner_id":"crm-42","external_ref":"` + ref + `"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	req := httptest.NewRequest("GET", "/accounts/"+uid, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	resp := &handlers.JSONResponse{Body: &handlers.AccountResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), resp))
+	ac := resp.Body.(*handlers.AccountResponse)
+	assert.Equal(t, uid, ac.Uid)
+	assert.Equal(t, "crm-42", ac.Owner)
+	assert.Equal(t, "Travel", ac.Name)
+	assert.Equal(t, ref, ac.ExternalRef)
+	assert.Equal(t, []string{"card", "eu"}, ac.Tags)
+	assert.Equal(t, "USD", ac.Currency)
+	assert.Equal(t, "12.50", ac.Balance)
+	assert.Equal(t, "12.50", ac.AvailableBalance)
+	assert.Equal(t, "active", ac.Status)
+
+	req = httptest.NewRequest("GET", "/accounts/"+uuid.New().String(), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestListAccountsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	owner := uuid.New().String()
+	for _, balance := range []int64{500, 100, 300} {
+		bank.CreateAccountWith(bankModel.AccountParams{Balance: balance, Owner: owner})
+	}
+
+	list := func(query string) (int, *handlers.ListAccountsResponse) {
+		req := httptest.NewRequest("GET", "/accounts?owner_id="+owner+query, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		resp := &handlers.JSONResponse{Body: &handlers.ListAccountsResponse{}}
+		json.Unmarshal(w.Body.Bytes(), resp)
+		return w.Code, resp.Body.(*handlers.ListAccountsResponse)
+	}
+
+	code, resp := list("&currency=RUB&sort=balance&order=desc&limit=2")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, resp.Accounts, 2) {
+		assert.Equal(t, "5.00", resp.Accounts[0].Balance)
+		assert.Equal(t, "3.00", resp.Accounts[1].Balance)
+	}
+	assert.NotEmpty(t, resp.NextCursor)
+
+	code, resp = list("&currency=RUB&sort=balance&order=desc&limit=2&cursor=" + resp.NextCursor)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, resp.Accounts, 1) {
+		assert.Equal(t, "1.00", resp.Accounts[0].Balance)
+	}
+	assert.Empty(t, resp.NextCursor)
+
+	code, resp = list("&currency=RUB&min_balance=2.00&max_balance=4")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, resp.Accounts, 1) {
+		assert.Equal(t, "3.00", resp.Accounts[0].Balance)
+	}
+
+	for _, query := range []string{"&min_balance=1", "&sort=balance", "&sort=name", "&order=up", "&limit=0", "&cursor=bad", "&created_from=yesterday", "&currency=XXX"} {
+		code, _ = list(query)
+		assert.Equal(t, http.StatusUnprocessableEntity, code, query)
+	}
+}
+
+func TestBatchTransferHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	payer, _ := bank.CreateAccount(100 * 100)
+	emp1, _ := bank.CreateAccount(0)
+	emp2, _ := bank.CreateAccount(0)
+
+	leg := func(to bankModel.Account, amount string) string {
+		return `{"from":"` + payer.String() + `","to":"` + to.ID().String() + `","amount":"` + amount + `"}`
+	}
+	ac1, _ := bank.GetAccount(emp1)
+	ac2, _ := bank.GetAccount(emp2)
+
+	batch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/transfers/batch", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// second leg can not be paid, nothing is applied
+	w := batch(`{"transfers":[` + leg(ac1, "60.00") + `,` + leg(ac2, "60.00") + `,` + leg(ac2, "bad") + `]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	rejected := &handlers.JSONResponse{Body: &handlers.BatchErrorResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), rejected))
+	assert.Equal(t, []handlers.LegErrorResponse{{Index: 2, Message: "can not parse balance"}}, rejected.Body.(*handlers.BatchErrorResponse).Legs)
+
+	w = batch(`{"transfers":[` + leg(ac1, "60.00") + `,` + leg(ac2, "60.00") + `]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	rejected = &handlers.JSONResponse{Body: &handlers.BatchErrorResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), rejected))
+	if assert.Len(t, rejected.Body.(*handlers.BatchErrorResponse).Legs, 1) {
+		assert.Equal(t, 1, rejected.Body.(*handlers.BatchErrorResponse).Legs[0].Index)
+	}
+
+	balance, _ := bank.GetAccountBalance(emp1)
+	assert.Equal(t, "0", balance)
+
+	w = batch(`{"transfers":[` + leg(ac1, "60.00") + `,` + leg(ac2, "40.00") + `]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := &handlers.JSONResponse{Body: &handlers.BatchTransferResponse{}}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), resp))
+	assert.Len(t, resp.Body.(*handlers.BatchTransferResponse).TransferIDs, 2)
+
+	balance, _ = bank.GetAccountBalance(emp2)
+	assert.Equal(t, "4000", balance)
+
+	w = batch(`{"transfers":[]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	req := httptest.NewRequest("POST", "/transfers/other", strings.NewReader(`{}`))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestScheduledTransferHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	from, _ := bank.CreateAccount(10 * 100)
+	to, _ := bank.CreateAccount(0)
+
+	do := func(method, path, body string) (int, *handlers.ScheduledTransferResponse) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		resp := &handlers.JSONResponse{Body: &handlers.ScheduledTransferResponse{}}
+		json.Unmarshal(w.Body.Bytes(), resp)
+		return w.Code, resp.Body.(*handlers.ScheduledTransferResponse)
+	}
+
+	code, _ := do("POST", "/scheduled-transfers", `{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"6.00","every":"yearly"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = do("POST", "/scheduled-transfers", `{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"6.00","retry_backoff":-1}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	start := time.Date(2119, time.May, 1, 12, 0, 0, 0, time.UTC)
+	code, s := do("POST", "/scheduled-transfers", `{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"6.00","start_at":"2119-04-20T12:00:00Z","every":"monthly","day":1,"max_attempts":2,"retry_backoff":60}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "6.00", s.Amount)
+	assert.Equal(t, "active", s.Status)
+	assert.Equal(t, start, s.DueAt)
+	assert.Equal(t, int64(60), s.RetryBackoff)
+
+	code, _ = do("GET", "/scheduled-transfers/"+s.ID, "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do("GET", "/scheduled-transfers/"+uuid.New().String(), "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do("GET", "/scheduled-transfers/bad", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// second month has not enough money
+	sc := bankModel.NewScheduler(bank, clock.NewManual(start.AddDate(0, 1, 0)))
+	n, err := sc.RunDue()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	req := httptest.NewRequest("GET", "/scheduled-transfers/"+s.ID+"/runs", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	runs := &handlers.GetScheduledRunsResponse{}
+	json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: runs})
+	if assert.Len(t, runs.Runs, 2) {
+		assert.Equal(t, "succeeded", runs.Runs[0].Status)
+		assert.NotEmpty(t, runs.Runs[0].TransferID)
+		assert.Equal(t, "failed", runs.Runs[1].Status)
+		assert.Equal(t, "originating balance not enough", runs.Runs[1].Error)
+	}
+
+	code, s = do("DELETE", "/scheduled-transfers/"+s.ID, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "cancelled", s.Status)
+	code, _ = do("DELETE", "/scheduled-transfers/"+s.ID, "")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
+
+func TestOverdraftHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	do := func(method, path, body string, dst interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: dst})
+		return w.Code
+	}
+
+	created := &handlers.CreateAccountResponse{}
+	code := do("PUT", "/createAccount", `{"balance":"10.00","overdraft_limit":"50.x"}`, created)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code = do("PUT", "/createAccount", `{"balance":"10.00","overdraft_limit":"50.00"}`, created)
+	assert.Equal(t, http.StatusOK, code)
+	from := created.Uid
+	to, _ := bankModel.GetBank().CreateAccount(0)
+
+	code = do("POST", "/transfer", `{"from":"`+from+`","to":"`+to.String()+`","amount":"15.05"}`, &handlers.TransferResponse{})
+	assert.Equal(t, http.StatusOK, code)
+
+	balance := &handlers.GetBalanceResponse{}
+	code = do("GET", "/balance/"+from, "", balance)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "-5.05", balance.Balance)
+	assert.Equal(t, "-5.05", balance.AvailableBalance)
+	assert.Equal(t, "50.00", balance.OverdraftLimit)
+	assert.Equal(t, "44.95", balance.Headroom)
+
+	code = do("POST", "/admin/accounts/"+from+"/overdraft", `{"limit":"5.00"}`, &handlers.AccountResponse{})
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code = do("POST", "/admin/accounts/"+uuid.New().String()+"/overdraft", `{"limit":"5.00"}`, &handlers.AccountResponse{})
+	assert.Equal(t, http.StatusNotFound, code)
+
+	ac := &handlers.AccountResponse{}
+	code = do("POST", "/admin/accounts/"+from+"/overdraft", `{"limit":"20.00"}`, ac)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "20.00", ac.OverdraftLimit)
+	assert.Equal(t, "14.95", ac.Headroom)
+}
+
+func TestSpendingLimitsHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	from, _ := bank.CreateAccount(100 * 100)
+	to, _ := bank.CreateAccount(0)
+
+	do := func(method, path, body string, dst interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: dst})
+		return w.Code
+	}
+
+	limits := &handlers.SpendingLimitsResponse{}
+	code := do("PUT", "/admin/accounts/"+from.String()+"/limits", `{"max_amount":"1.x"}`, limits)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code = do("PUT", "/admin/accounts/"+uuid.New().String()+"/limits", `{}`, limits)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code = do("PUT", "/admin/accounts/"+from.String()+"/limits", `{"max_amount":"20.00","max_daily":"30.00","max_hourly_count":5}`, limits)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "20.00", limits.MaxAmount)
+	assert.Equal(t, "", limits.MaxMonthly)
+	assert.Equal(t, 5, limits.MaxHourlyCount)
+
+	code = do("POST", "/transfer", `{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"20.00"}`, &handlers.TransferResponse{})
+	assert.Equal(t, http.StatusOK, code)
+
+	limitErr := &handlers.LimitErrorResponse{}
+	code = do("POST", "/transfer", `{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"10.01"}`, limitErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, "limit_daily_amount", limitErr.Code)
+	assert.Equal(t, "30.00", limitErr.Limit)
+	assert.Equal(t, "20.00", limitErr.Used)
+
+	batchErr := &handlers.BatchErrorResponse{}
+	code = do("POST", "/transfers/batch", `{"transfers":[{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"20.01"}]}`, batchErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	if assert.Len(t, batchErr.Legs, 1) {
+		assert.Equal(t, "limit_single_amount", batchErr.Legs[0].Code)
+	}
+
+	code = do("GET", "/admin/accounts/"+from.String()+"/limits", "", limits)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "20.00", limits.SpentDaily)
+	assert.Equal(t, 1, limits.HourlyCount)
+}
+
+func TestInterestHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	source, _ := bank.CreateAccount(10000 * 100)
+	saver, _ := bank.CreateAccount(365 * 100)
+
+	do := func(method, path, body string, dst interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: dst})
+		return w.Code
+	}
+
+	code := do("PUT", "/admin/interest/products/savings", `{"credit_rate":"2"}`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code = do("PUT", "/admin/interest/products/savings", `{"credit_rate":"0.01"}`, nil)
+	assert.Equal(t, http.StatusOK, code)
+	code = do("POST", "/admin/interest/source", `{"account_id":"`+source.String()+`"}`, nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	interest := &handlers.AccountInterestResponse{}
+	code = do("PUT", "/admin/accounts/"+saver.String()+"/interest", `{"product":"checking"}`, interest)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code = do("PUT", "/admin/accounts/"+uuid.New().String()+"/interest", `{}`, interest)
+	assert.Equal(t, http.StatusNotFound, code)
+	code = do("PUT", "/admin/accounts/"+saver.String()+"/interest", `{"product":"savings"}`, interest)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "savings", interest.Product)
+	assert.Equal(t, "0.01", interest.CreditRate)
+
+	// 365.00 at 1% accrues a cent a day
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	c := clock.NewManual(today)
+	e := bankModel.NewInterestEngine(bank, c)
+	assert.Nil(t, e.Run())
+	c.Add(48 * time.Hour)
+	assert.Nil(t, e.Run())
+
+	code = do("GET", "/admin/accounts/"+saver.String()+"/interest", "", interest)
+	assert.Equal(t, http.StatusOK, code)
+	if today.AddDate(0, 0, 2).Day() > 2 {
+		assert.Equal(t, "0.02000000", interest.Accrued)
+	}
+}
+
+func TestTransferFeeHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	feeAccount, _ := bank.CreateAccountWith(bankModel.AccountParams{Currency: "USD"})
+	from, _ := bank.CreateAccountWith(bankModel.AccountParams{Balance: 100 * 100, Currency: "USD"})
+	to, _ := bank.CreateAccountWith(bankModel.AccountParams{Currency: "USD"})
+
+	dir, err := ioutil.TempDir("", "fees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fees.json")
+	ioutil.WriteFile(path, []byte(`{"accounts": {"USD": "`+feeAccount.String()+`"}, "fees": {"USD": {"type": "percent", "rate": "0.01", "min": 50}}}`), 0600)
+	f, err := fees.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bank.SetFees(f)
+	defer bank.SetFees(nil)
+
+	do := func(method, path, body string, dst interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: dst})
+		return w.Code
+	}
+	body := func(amount string) string {
+		return `{"from":"` + from.String() + `","to":"` + to.String() + `","amount":"` + amount + `"}`
+	}
+
+	quote := &handlers.QuoteResponse{}
+	code := do("POST", "/transfer/quote", body("80.00"), quote)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, handlers.QuoteResponse{"80.00", "0.80", "80.80", "USD", "80.00", "USD"}, *quote)
+	code = do("POST", "/transfer/quote", body("99.99"), quote)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code = do("POST", "/transfer/quote", body("1.x"), quote)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// the quote moves no money, the transfer charges the minimum fee
+	resp := &handlers.TransferResponse{}
+	code = do("POST", "/transfer", body("10.00"), resp)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "0.50", resp.Fee)
+	assert.Equal(t, "USD", resp.Currency)
+	assert.NotEmpty(t, resp.FeeTransferID)
+
+	ac, _ := bank.GetAccount(from)
+	assert.Equal(t, int64(100*100-1000-50), ac.Balance())
+	ac, _ = bank.GetAccount(feeAccount)
+	assert.Equal(t, int64(50), ac.Balance())
+
+	code = do("POST", "/admin/fees/reload", "", nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestStatementHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	from, _ := bank.CreateAccountWith(bankModel.AccountParams{Balance: 100 * 100, Currency: "USD"})
+	to, _ := bank.CreateAccountWith(bankModel.AccountParams{Currency: "USD"})
+	_, err := bank.Transfer(from, to, 25*100)
+	assert.Nil(t, err)
+	_, err = bank.Transfer(to, from, 5*100)
+	assert.Nil(t, err)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/accounts/"+from.String()+"/statement"+query, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	statement := &handlers.StatementResponse{}
+	w := get("")
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: statement})
+	assert.Equal(t, "0", statement.OpeningBalance)
+	assert.Equal(t, "80.00", statement.ClosingBalance)
+	if assert.Len(t, statement.Entries, 3) {
+		assert.Equal(t, "-25.00", statement.Entries[1].Amount)
+		assert.Equal(t, "transfer", statement.Entries[1].Kind)
+	}
+
+	// the period after the transfers has no postings but carries the balance
+	later := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	w = get("?from=" + later + "&to=" + url.QueryEscape(time.Now().Add(2*time.Hour).Format(time.RFC3339)))
+	json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: statement})
+	assert.Equal(t, "80.00", statement.OpeningBalance)
+	assert.Equal(t, "80.00", statement.ClosingBalance)
+	assert.Len(t, statement.Entries, 0)
+
+	w = get("?format=csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	assert.Nil(t, err)
+	if assert.Len(t, rows, 6) {
+		assert.Equal(t, "opening_balance", rows[1][2])
+		assert.Equal(t, "5.00", rows[4][5])
+		assert.Equal(t, []string{"closing_balance", "80.00"}, []string{rows[5][2], rows[5][6]})
+	}
+
+	w = get("?format=ofx")
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.True(t, strings.HasPrefix(body, "<?xml"))
+	assert.Contains(t, body, "<TRNTYPE>DEBIT</TRNTYPE>")
+	assert.Contains(t, body, "<TRNAMT>-25.00</TRNAMT>")
+	assert.Contains(t, body, "<BALAMT>80.00</BALAMT>")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, get("?format=pdf").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, get("?from=yesterday").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, get("?from="+later+"&to="+later).Code)
+
+	req := httptest.NewRequest("GET", "/accounts/"+uuid.New().String()+"/statement", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	bank := bankModel.GetBank()
+	from, _ := bank.CreateAccount(100 * 100)
+	to, _ := bank.CreateAccount(0)
+
+	for _, path := range []string{"/balance/" + from.String(), "/balance/" + to.String(), "/no/such/route", "/accounts/accounts/transactions"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	req := httptest.NewRequest("POST", "/transfer", strings.NewReader(`{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"1000"}`))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/balance/:id",status="200"}`)
+	assert.Contains(t, body, `http_request_duration_seconds_bucket{method="GET",route="/balance/:id",status="200",le="+Inf"}`)
+	assert.Contains(t, body, `http_requests_total{method="other",route="unmatched",status="404"}`)
+	// the parameter value equals a static segment of the route
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/accounts/:id/transactions",status="422"}`)
+	assert.Contains(t, body, `simplebank_transfers_failed_total{reason="insufficient_funds"}`)
+	assert.Contains(t, body, "# TYPE simplebank_accounts_created_total counter")
+	assert.Contains(t, body, `simplebank_bank_lock_wait_seconds_count{mode="read"}`)
+	assert.Contains(t, body, `simplebank_money{currency="RUB"}`)
+	assert.NotContains(t, body, from.String())
+}
+
+func TestHealthHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.NewNop())
+
+	get := func(path string) (*httptest.ResponseRecorder, *handlers.ReadinessResponse) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		resp := &handlers.ReadinessResponse{}
+		json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: resp})
+		return w, resp
+	}
+
+	w, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	health := &handlers.HealthResponse{}
+	json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: health})
+	assert.Equal(t, "ok", health.Status)
+
+	w, ready := get("/readyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ready", ready.Status)
+	assert.Equal(t, handlers.CheckResponse{Name: "shutdown", Status: "ok"}, ready.Checks[0])
+
+	handlers.SetShuttingDown(true)
+	defer handlers.SetShuttingDown(false)
+	w, ready = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "not_ready", ready.Status)
+	assert.Equal(t, handlers.CheckResponse{Name: "shutdown", Status: "failed", Error: "server is shutting down"}, ready.Checks[0])
+	// liveness does not depend on readiness
+	w, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	var logs strings.Builder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&logs), zap.InfoLevel)
+
+	gin.SetMode(gin.TestMode)
+	r := server.NewRouter(zap.New(core))
+
+	bank := bankModel.GetBank()
+	from, _ := bank.CreateAccount(100 * 100)
+	to, _ := bank.CreateAccount(0)
+
+	transfer := func(id string, amount string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/transfer", strings.NewReader(`{"from":"`+from.String()+`","to":"`+to.String()+`","amount":"`+amount+`"}`))
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := transfer("req-42", "10")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-ID"))
+	tr := &handlers.TransferResponse{}
+	json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: tr})
+
+	// the bank event and the access log line carry the request ID
+	var event, access bool
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		entry := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		if entry["request_id"] != "req-42" {
+			continue
+		}
+		if entry["msg"] == "Bank event" && entry["event"] == "transfer" {
+			event = strings.Contains(line, tr.TransferID)
+		}
+		access = access || entry["msg"] == "/transfer"
+	}
+	assert.True(t, event)
+	assert.True(t, access)
+
+	// errors tell the generated ID, a malformed one is replaced
+	w = transfer("bad id\n", "1000")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	id := w.Header().Get("X-Request-ID")
+	_, err := uuid.Parse(id)
+	assert.Nil(t, err)
+	errResp := &handlers.ErrorResponse{}
+	json.Unmarshal(w.Body.Bytes(), &handlers.JSONResponse{Body: errResp})
+	assert.Equal(t, handlers.ErrorResponse{Message: "originating balance not enough", RequestID: id}, *errResp)
+	assert.Contains(t, logs.String(), `"msg":"Request failed","request_id":"`+id+`"`)
+}
@@ -26,7 +26,7 @@ func Test_balanceInt64ToString(t *testing.T) {
 	}
 
 	for key, item := range cases {
-		output := balanceInt64ToString(item.input.(string))
+		output := balanceInt64ToString(item.input.(string), 2)
 		assert.Equal(output, item.output.(string), key)
 	}
 }
@@ -51,10 +51,57 @@ func Test_stringToBalanceInt64(t *testing.T) {
 	}
 
 	for key, item := range cases {
-		output, err := stringToBalanceInt64(item.input.(string))
+		output, err := stringToBalanceInt64(item.input.(string), 2)
 		assert.IsType(int64(0), output, key)
 		assert.IsType(item.err, err, key)
 		assert.Equal(item.output, output, key)
 	}
 
 }
+
+func Test_signedBalanceToString(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := map[string]TestCase{
+		"zero":           {input: int64(0), output: "0", err: nil},
+		"positive":       {input: int64(1050), output: "10.50", err: nil},
+		"negative":       {input: int64(-1050), output: "-10.50", err: nil},
+		"negative cents": {input: int64(-7), output: "-0.07", err: nil},
+	}
+
+	for key, item := range cases {
+		output := signedBalanceToString(item.input.(int64), 2)
+		assert.Equal(item.output.(string), output, key)
+	}
+}
+
+func Test_balanceExponents(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := map[string]struct {
+		input    string
+		exp      int
+		parsed   int64
+		output   string
+		parseErr bool
+	}{
+		"yen":                 {input: "1500", exp: 0, parsed: 1500, output: "1500"},
+		"yen with decimals":   {input: "15.00", exp: 0, parsed: -1, parseErr: true},
+		"dinar":               {input: "1.500", exp: 3, parsed: 1500, output: "1.500"},
+		"dinar fils":          {input: "0.007", exp: 3, parsed: 7, output: "0.007"},
+		"dinar integer":       {input: "12", exp: 3, parsed: 12000, output: "12.000"},
+		"dinar two decimals":  {input: "1.50", exp: 3, parsed: -1, parseErr: true},
+		"unsupported exp":     {input: "1", exp: 5, parsed: -1, parseErr: true},
+		"dinar overflow":      {input: "9223372036854776", exp: 3, parsed: -1, parseErr: true},
+		"rouble for contrast": {input: "1.50", exp: 2, parsed: 150, output: "1.50"},
+	}
+
+	for key, item := range cases {
+		parsed, err := stringToBalanceInt64(item.input, item.exp)
+		assert.Equal(item.parseErr, err != nil, key)
+		assert.Equal(item.parsed, parsed, key)
+		if err == nil {
+			assert.Equal(item.output, balanceInt64ToString(strconv.FormatInt(parsed, 10), item.exp), key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple_bank/models/bank"
+	"sync/atomic"
+	"time"
+)
+
+// startedAt is when the process started, for the liveness probe
+var startedAt = time.Now()
+
+// shuttingDown is set once the server starts to stop, readiness fails from
+// then on so traffic is routed elsewhere before the process exits
+var shuttingDown int32
+
+// SetShuttingDown flips readiness of the server
+func SetShuttingDown(v bool) {
+	var flag int32
+	if v {
+		flag = 1
+	}
+	atomic.StoreInt32(&shuttingDown, flag)
+}
+
+type HealthResponse struct {
+	Status    string    `json:"status"`
+	StartedAt time.Time `json:"started_at"`
+	Uptime    string    `json:"uptime"`
+}
+
+type CheckResponse struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadinessResponse lists the checks, Status is ready if all of them pass
+type ReadinessResponse struct {
+	Status string          `json:"status"`
+	Checks []CheckResponse `json:"checks"`
+}
+
+// HealthHandler tells the process is alive, it does not check dependencies
+func HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, &JSONResponse{0, HealthResponse{
+		Status:    "ok",
+		StartedAt: startedAt.UTC(),
+		Uptime:    time.Since(startedAt).Round(time.Second).String(),
+	}})
+}
+
+// ReadyHandler tells whether the server should get traffic: the bank and
+// its storage take writes and the server is not shutting down. It responds
+// 503 with the failed checks otherwise.
+func ReadyHandler(c *gin.Context) {
+	checks := []bank.Check{{Name: "shutdown"}}
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		checks[0].Err = errors.New("server is shutting down")
+	}
+	checks = append(checks, bank.GetBank().Ready()...)
+
+	resp := ReadinessResponse{Status: "ready", Checks: make([]CheckResponse, 0, len(checks))}
+	for _, ch := range checks {
+		check := CheckResponse{Name: ch.Name, Status: "ok"}
+		if ch.Err != nil {
+			check.Status, check.Error = "failed", ch.Err.Error()
+			resp.Status = "not_ready"
+		}
+		resp.Checks = append(resp.Checks, check)
+	}
+
+	if resp.Status != "ready" {
+		c.JSON(http.StatusServiceUnavailable, &JSONResponse{-1, resp})
+		return
+	}
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"net/http"
+	"simple_bank/models/bank"
+	"simple_bank/reqctx"
+	"time"
+)
+
+type PlaceHoldRequest struct {
+	AccountID string `json:"account_id"`
+	Amount    string `json:"amount"`
+	// ExpiresIn is the hold lifetime in seconds, zero means the default
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type CaptureHoldRequest struct {
+	To string `json:"to"`
+	// Amount is the whole hold if empty
+	Amount string `json:"amount"`
+}
+
+type HoldResponse struct {
+	HoldID     string    `json:"hold_id"`
+	AccountID  string    `json:"account_id"`
+	Amount     string    `json:"amount"`
+	Captured   string    `json:"captured"`
+	Currency   string    `json:"currency"`
+	Status     string    `json:"status"`
+	TransferID string    `json:"transfer_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func PlaceHoldHandler(c *gin.Context) {
+	var r PlaceHoldRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	uid, err := uuid.Parse(r.AccountID)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if r.ExpiresIn < 0 {
+		errorJSON(c, http.StatusUnprocessableEntity, "expires_in can not be negative")
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	ac, err := _bank.GetAccount(uid)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	amount, err := stringToBalanceInt64(r.Amount, currencyExponent(ac.Currency()))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	h, err := _bank.PlaceHold(uid, amount, time.Duration(r.ExpiresIn)*time.Second)
+	if limitErr, ok := err.(*bank.LimitError); ok {
+		respondError(c, http.StatusUnprocessableEntity, limitErr.Error(), limitErrorResponse(c, limitErr, ac.Currency()))
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, holdResponse(h)})
+}
+
+func GetHoldHandler(c *gin.Context) {
+	h, err := getHold(c)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, holdResponse(h)})
+}
+
+func CaptureHoldHandler(c *gin.Context) {
+	var r CaptureHoldRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h, err := getHold(c)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	to, err := uuid.Parse(r.To)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	amount := h.Amount
+	if r.Amount != "" {
+		amount, err = stringToBalanceInt64(r.Amount, currencyExponent(h.Currency))
+		if err != nil {
+			errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	_bank := reqctx.Bank(c)
+	if _, err := _bank.CaptureHold(h.ID, to, amount); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	h, err = _bank.GetHold(h.ID)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, holdResponse(h)})
+}
+
+func ReleaseHoldHandler(c *gin.Context) {
+	h, err := getHold(c)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	if err := _bank.ReleaseHold(h.ID); err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	h, err = _bank.GetHold(h.ID)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, holdResponse(h)})
+}
+
+// getHold finds the hold by the id path parameter
+func getHold(c *gin.Context) (bank.Hold, error) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return bank.Hold{}, errors.New("invalid hold id")
+	}
+	return reqctx.Bank(c).GetHold(id)
+}
+
+func holdResponse(h bank.Hold) HoldResponse {
+	exp := currencyExponent(h.Currency)
+	resp := HoldResponse{
+		HoldID:    h.ID.String(),
+		AccountID: h.AccountID.String(),
+		Amount:    signedBalanceToString(h.Amount, exp),
+		Captured:  signedBalanceToString(h.Captured, exp),
+		Currency:  h.Currency,
+		Status:    string(h.Status),
+		CreatedAt: h.CreatedAt,
+		ExpiresAt: h.ExpiresAt,
+	}
+	if h.Status == bank.HoldCaptured {
+		resp.TransferID = h.TxID.String()
+	}
+	return resp
+}
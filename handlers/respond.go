@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"simple_bank/reqctx"
+)
+
+// errorJSON responds with the error message
+func errorJSON(c *gin.Context, status int, msg string) {
+	respondError(c, status, msg, ErrorResponse{Message: msg, RequestID: reqctx.RequestID(c)})
+}
+
+// respondError logs the rejected request and responds with the error body
+func respondError(c *gin.Context, status int, msg string, body interface{}) {
+	level := reqctx.Logger(c).Info
+	if status >= http.StatusInternalServerError {
+		level = reqctx.Logger(c).Error
+	}
+	level("Request failed", zap.Int("status", status), zap.String("error", msg))
+	c.JSON(status, &JSONResponse{-1, body})
+}
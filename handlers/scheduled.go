@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"net/http"
+	"simple_bank/models/bank"
+	"simple_bank/reqctx"
+	"time"
+)
+
+type ScheduleTransferRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount string `json:"amount"`
+	// StartAt is the first execution time, now if empty, it can not be in
+	// the past
+	StartAt time.Time `json:"start_at"`
+	// Every is daily, weekly or monthly, empty for a single transfer
+	Every string `json:"every"`
+	// Day of month for monthly transfers
+	Day         int `json:"day"`
+	MaxAttempts int `json:"max_attempts"`
+	// RetryBackoff is the wait between attempts in seconds
+	RetryBackoff int64 `json:"retry_backoff"`
+}
+
+type ScheduledTransferResponse struct {
+	ID           string    `json:"id"`
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+	Amount       string    `json:"amount"`
+	Currency     string    `json:"currency"`
+	Every        string    `json:"every,omitempty"`
+	Day          int       `json:"day,omitempty"`
+	MaxAttempts  int       `json:"max_attempts"`
+	RetryBackoff int64     `json:"retry_backoff"`
+	Status       string    `json:"status"`
+	DueAt        time.Time `json:"due_at"`
+	NextRunAt    time.Time `json:"next_run_at"`
+	Attempts     int       `json:"attempts"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type ScheduledRunResponse struct {
+	DueAt      time.Time `json:"due_at"`
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	Status     string    `json:"status"`
+	TransferID string    `json:"transfer_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Missed     int       `json:"missed,omitempty"`
+}
+
+type GetScheduledRunsResponse struct {
+	Runs []ScheduledRunResponse `json:"runs"`
+}
+
+func ScheduleTransferHandler(c *gin.Context) {
+	var r ScheduleTransferRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, err := uuid.Parse(r.From)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	to, err := uuid.Parse(r.To)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if r.RetryBackoff < 0 {
+		errorJSON(c, http.StatusUnprocessableEntity, "retry_backoff can not be negative")
+		return
+	}
+
+	_bank := reqctx.Bank(c)
+	fromAccount, err := _bank.GetAccount(from)
+	if err == bank.ErrAccountNotFound {
+		errorJSON(c, http.StatusUnprocessableEntity, bank.ErrFromNotFound.Error())
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	amount, err := stringToBalanceInt64(r.Amount, currencyExponent(fromAccount.Currency()))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	s, err := _bank.ScheduleTransfer(bank.ScheduleParams{
+		From:       from,
+		To:         to,
+		Amount:     amount,
+		StartAt:    r.StartAt,
+		Recurrence: bank.Recurrence{Every: bank.Frequency(r.Every), Day: r.Day},
+		Retry: bank.RetryPolicy{
+			MaxAttempts: r.MaxAttempts,
+			Backoff:     time.Duration(r.RetryBackoff) * time.Second,
+		},
+	})
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, scheduledTransferResponse(s)})
+}
+
+func GetScheduledTransferHandler(c *gin.Context) {
+	s, status, err := getScheduledTransfer(c)
+	if err != nil {
+		errorJSON(c, status, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, scheduledTransferResponse(s)})
+}
+
+func CancelScheduledTransferHandler(c *gin.Context) {
+	s, status, err := getScheduledTransfer(c)
+	if err != nil {
+		errorJSON(c, status, err.Error())
+		return
+	}
+
+	s, err = reqctx.Bank(c).CancelScheduledTransfer(s.ID)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, scheduledTransferResponse(s)})
+}
+
+func GetScheduledRunsHandler(c *gin.Context) {
+	s, status, err := getScheduledTransfer(c)
+	if err != nil {
+		errorJSON(c, status, err.Error())
+		return
+	}
+
+	runs, err := reqctx.Bank(c).ScheduledRuns(s.ID)
+	if err != nil {
+		errorJSON(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := GetScheduledRunsResponse{Runs: make([]ScheduledRunResponse, 0, len(runs))}
+	for _, run := range runs {
+		r := ScheduledRunResponse{
+			DueAt:   run.DueAt,
+			Attempt: run.Attempt,
+			At:      run.At,
+			Status:  "failed",
+			Error:   run.Error,
+			Missed:  run.Missed,
+		}
+		if run.TxID != uuid.Nil {
+			r.Status = "succeeded"
+			r.TransferID = run.TxID.String()
+		} else if run.Missed > 0 {
+			r.Status = "missed"
+		}
+		resp.Runs = append(resp.Runs, r)
+	}
+
+	c.JSON(http.StatusOK, &JSONResponse{0, resp})
+}
+
+// getScheduledTransfer finds the scheduled transfer by the id path
+// parameter, the status to respond with is returned on errors
+func getScheduledTransfer(c *gin.Context) (bank.ScheduledTransfer, int, error) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return bank.ScheduledTransfer{}, http.StatusUnprocessableEntity, errors.New("invalid scheduled transfer id")
+	}
+
+	s, err := reqctx.Bank(c).GetScheduledTransfer(id)
+	if err != nil {
+		return bank.ScheduledTransfer{}, http.StatusNotFound, err
+	}
+	return s, http.StatusOK, nil
+}
+
+func scheduledTransferResponse(s bank.ScheduledTransfer) ScheduledTransferResponse {
+	return ScheduledTransferResponse{
+		ID:           s.ID.String(),
+		From:         s.From.String(),
+		To:           s.To.String(),
+		Amount:       signedBalanceToString(s.Amount, currencyExponent(s.Currency)),
+		Currency:     s.Currency,
+		Every:        string(s.Recurrence.Every),
+		Day:          s.Recurrence.Day,
+		MaxAttempts:  s.Retry.MaxAttempts,
+		RetryBackoff: int64(s.Retry.Backoff / time.Second),
+		Status:       string(s.Status),
+		DueAt:        s.DueAt,
+		NextRunAt:    s.NextRunAt,
+		Attempts:     s.Attempts,
+		CreatedAt:    s.CreatedAt,
+	}
+}
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"net/http"
+	"simple_bank/models/bank"
+	"simple_bank/reqctx"
+	"strings"
+	"time"
+)
+
+type StatementEntryResponse struct {
+	TransferID   string    `json:"transfer_id"`
+	Kind         string    `json:"kind"`
+	Type         string    `json:"type"`
+	Counterparty string    `json:"counterparty"`
+	Amount       string    `json:"amount"`
+	Balance      string    `json:"balance"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// StatementResponse lists postings of the period, ClosingBalance is
+// OpeningBalance plus their amounts
+type StatementResponse struct {
+	AccountID      string                   `json:"account_id"`
+	Currency       string                   `json:"currency"`
+	From           time.Time                `json:"from"`
+	To             time.Time                `json:"to"`
+	OpeningBalance string                   `json:"opening_balance"`
+	ClosingBalance string                   `json:"closing_balance"`
+	Entries        []StatementEntryResponse `json:"entries"`
+}
+
+// ofxBankID identifies the bank in OFX statements
+const ofxBankID = "SIMPLEBANK"
+
+// GetStatementHandler exports postings of the account in the period given
+// by from and to RFC3339 query parameters, as json, csv or ofx picked by
+// the format parameter
+func GetStatementHandler(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	from, to, err := parseStatementPeriod(c)
+	if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" && format != "ofx" {
+		errorJSON(c, http.StatusUnprocessableEntity, "format must be json, csv or ofx")
+		return
+	}
+
+	s, err := reqctx.Bank(c).Statement(uid, from, to)
+	if err == bank.ErrAccountNotFound {
+		errorJSON(c, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	resp := statementResponse(s)
+	switch format {
+	case "csv":
+		data, err := statementCSV(resp)
+		if err != nil {
+			errorJSON(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="statement-`+resp.AccountID+`.csv"`)
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", data)
+	case "ofx":
+		data, err := statementOFX(resp)
+		if err != nil {
+			errorJSON(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="statement-`+resp.AccountID+`.ofx"`)
+		c.Data(http.StatusOK, "application/x-ofx", data)
+	default:
+		c.JSON(http.StatusOK, &JSONResponse{0, resp})
+	}
+}
+
+// parseStatementPeriod reads from and to query parameters, both optional
+func parseStatementPeriod(c *gin.Context) (time.Time, time.Time, error) {
+	var from, to time.Time
+	var err error
+
+	if s := c.Query("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, errors.New("from must be RFC3339 time")
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, errors.New("to must be RFC3339 time")
+		}
+	}
+	return from, to, nil
+}
+
+func statementResponse(s bank.Statement) StatementResponse {
+	exp := currencyExponent(s.Currency)
+	resp := StatementResponse{
+		AccountID:      s.AccountID.String(),
+		Currency:       s.Currency,
+		From:           s.From,
+		To:             s.To,
+		OpeningBalance: signedBalanceToString(s.Opening, exp),
+		ClosingBalance: signedBalanceToString(s.Closing, exp),
+		Entries:        make([]StatementEntryResponse, 0, len(s.Entries)),
+	}
+	for _, e := range s.Entries {
+		resp.Entries = append(resp.Entries, StatementEntryResponse{
+			TransferID:   e.TxID.String(),
+			Kind:         string(e.Kind),
+			Type:         string(e.Type),
+			Counterparty: e.Counterparty.String(),
+			Amount:       signedBalanceToString(e.Signed(), exp),
+			Balance:      signedBalanceToString(e.Balance, exp),
+			CreatedAt:    e.CreatedAt,
+		})
+	}
+	return resp
+}
+
+// statementCSV writes a row per posting between the opening and the
+// closing balance rows, amounts are signed
+func statementCSV(s StatementResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	rows := [][]string{
+		{"date", "transfer_id", "kind", "type", "counterparty", "amount", "balance", "currency"},
+		{s.From.Format(time.RFC3339), "", "opening_balance", "", "", "", s.OpeningBalance, s.Currency},
+	}
+	for _, e := range s.Entries {
+		rows = append(rows, []string{e.CreatedAt.Format(time.RFC3339Nano), e.TransferID, e.Kind, e.Type, e.Counterparty, e.Amount, e.Balance, s.Currency})
+	}
+	rows = append(rows, []string{s.To.Format(time.RFC3339), "", "closing_balance", "", "", "", s.ClosingBalance, s.Currency})
+
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ofx is an OFX 2.1.1 bank statement response
+type ofx struct {
+	XMLName xml.Name `xml:"OFX"`
+	SignOn  struct {
+		Status   ofxStatus `xml:"SONRS>STATUS"`
+		DTServer string    `xml:"SONRS>DTSERVER"`
+		Language string    `xml:"SONRS>LANGUAGE"`
+	} `xml:"SIGNONMSGSRSV1"`
+	Statement struct {
+		TrnUID string    `xml:"TRNUID"`
+		Status ofxStatus `xml:"STATUS"`
+		Rs     struct {
+			Currency string `xml:"CURDEF"`
+			BankID   string `xml:"BANKACCTFROM>BANKID"`
+			AcctID   string `xml:"BANKACCTFROM>ACCTID"`
+			AcctType string `xml:"BANKACCTFROM>ACCTTYPE"`
+			List     struct {
+				Start        string           `xml:"DTSTART"`
+				End          string           `xml:"DTEND"`
+				Transactions []ofxTransaction `xml:"STMTTRN"`
+			} `xml:"BANKTRANLIST"`
+			LedgerBalance ofxBalance `xml:"LEDGERBAL"`
+		} `xml:"STMTRS"`
+	} `xml:"BANKMSGSRSV1>STMTTRNRS"`
+}
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxTransaction struct {
+	Type   string `xml:"TRNTYPE"`
+	Posted string `xml:"DTPOSTED"`
+	Amount string `xml:"TRNAMT"`
+	FitID  string `xml:"FITID"`
+	Name   string `xml:"NAME"`
+	Memo   string `xml:"MEMO"`
+}
+
+type ofxBalance struct {
+	Amount string `xml:"BALAMT"`
+	AsOf   string `xml:"DTASOF"`
+}
+
+const ofxHeader = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n" +
+	`<?OFX OFXHEADER="200" VERSION="211" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n"
+
+// statementOFX writes the statement as OFX, the closing balance is the
+// ledger balance. OFX has no opening balance, importers derive it.
+func statementOFX(s StatementResponse) ([]byte, error) {
+	var doc ofx
+	doc.SignOn.Status = ofxStatus{0, "INFO"}
+	doc.SignOn.DTServer = ofxTime(time.Now())
+	doc.SignOn.Language = "ENG"
+
+	doc.Statement.TrnUID = "0"
+	doc.Statement.Status = ofxStatus{0, "INFO"}
+	rs := &doc.Statement.Rs
+	rs.Currency = s.Currency
+	rs.BankID = ofxBankID
+	rs.AcctID = s.AccountID
+	rs.AcctType = "CHECKING"
+	rs.List.Start = ofxTime(s.From)
+	rs.List.End = ofxTime(s.To)
+	for _, e := range s.Entries {
+		rs.List.Transactions = append(rs.List.Transactions, ofxTransaction{
+			Type:   strings.ToUpper(e.Type),
+			Posted: ofxTime(e.CreatedAt),
+			Amount: e.Amount,
+			FitID:  e.TransferID,
+			Name:   e.Counterparty,
+			Memo:   e.Kind,
+		})
+	}
+	rs.LedgerBalance = ofxBalance{s.ClosingBalance, ofxTime(s.To)}
+
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(ofxHeader), body...), nil
+}
+
+// ofxTime formats the time as OFX datetime in UTC
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405.000") + "[0:GMT]"
+}
@@ -1,9 +1,31 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"simple_bank/config"
 	"simple_bank/server"
 )
 
 func main() {
-	server.Init()
+	cfg, printOnly, err := config.Load(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(server.ExitOK)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid config:", err)
+		os.Exit(server.ExitBadConfig)
+	}
+
+	if printOnly {
+		data, err := cfg.YAML()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(server.ExitBadConfig)
+		}
+		os.Stdout.Write(data)
+		return
+	}
+
+	os.Exit(server.Init(cfg))
 }
@@ -0,0 +1,335 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// contentType is the Prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are latency buckets in seconds
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry served on /metrics
+var Default = NewRegistry()
+
+// Registry holds metrics and writes them in the Prometheus text format
+type Registry struct {
+	mu      *sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{mu: &sync.Mutex{}, metrics: make(map[string]metric)}
+}
+
+// register panics on a duplicate name, metrics are created once at start
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic("metric " + name + " is already registered")
+	}
+	r.metrics[name] = m
+}
+
+// WriteText writes all metrics sorted by name in the text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the metrics of the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		r.WriteText(w)
+	})
+}
+
+// desc is what all metrics have: the name, help and label names
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP " + d.name + " " + escapeHelp(d.help) + "\n")
+	w.WriteString("# TYPE " + d.name + " " + d.kind + "\n")
+}
+
+// key joins label values into a map key
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic("metric " + d.name + " needs " + strconv.Itoa(len(d.labels)) + " label values")
+	}
+	return strings.Join(values, "\xff")
+}
+
+// Counter is a value which only goes up, one per label values
+type Counter struct {
+	desc
+	mu     *sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter", labels}, mu: &sync.Mutex{}, values: make(map[string]*counterValue)}
+	r.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds v, which can not be negative
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		panic("counter " + c.name + " can not decrease")
+	}
+	key := c.key(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: append([]string(nil), labels...)}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+// Value returns the counter of the label values
+func (c *Counter) Value(labels ...string) float64 {
+	key := c.key(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cv, ok := c.values[key]; ok {
+		return cv.value
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, cv := range c.values {
+		samples = append(samples, Sample{cv.labels, cv.value})
+	}
+	c.mu.Unlock()
+
+	c.writeHeader(w)
+	writeSamples(w, c.name, c.labels, samples)
+}
+
+// Sample is a value with its label values
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// GaugeFunc collects its samples when written, for values kept elsewhere
+type GaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, labels []string, collect func() []Sample) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name, help, "gauge", labels}, collect: collect}
+	r.register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	samples := g.collect()
+	for _, s := range samples {
+		g.key(s.Labels)
+	}
+
+	g.writeHeader(w)
+	writeSamples(w, g.name, g.labels, samples)
+}
+
+// Histogram counts observations in buckets, one per label values
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      *sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with upper bounds of buckets in
+// ascending order, the +Inf bucket is added
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("buckets of " + name + " are not sorted")
+	}
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: append([]float64(nil), buckets...),
+		mu:      &sync.Mutex{},
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	key := h.key(labels)
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: append([]string(nil), labels...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	if i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// Count returns the number of observations of the label values
+func (h *Histogram) Count(labels ...string) uint64 {
+	key := h.key(labels)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hv, ok := h.values[key]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	values := make([]histogramValue, 0, len(h.values))
+	for _, hv := range h.values {
+		v := *hv
+		v.counts = append([]uint64(nil), hv.counts...)
+		values = append(values, v)
+	}
+	h.mu.Unlock()
+	sort.Slice(values, func(i, j int) bool {
+		return lessLabels(values[i].labels, values[j].labels)
+	})
+
+	h.writeHeader(w)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, hv := range values {
+		// buckets are cumulative
+		var cum uint64
+		for i, upper := range h.buckets {
+			cum += hv.counts[i]
+			writeSample(w, h.name+"_bucket", labels, append(append([]string(nil), hv.labels...), formatFloat(upper)), float64(cum))
+		}
+		writeSample(w, h.name+"_bucket", labels, append(append([]string(nil), hv.labels...), "+Inf"), float64(hv.count))
+		writeSample(w, h.name+"_sum", h.labels, hv.labels, hv.sum)
+		writeSample(w, h.name+"_count", h.labels, hv.labels, float64(hv.count))
+	}
+}
+
+// writeSamples writes samples sorted by label values
+func writeSamples(w *bufio.Writer, name string, labels []string, samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return lessLabels(samples[i].Labels, samples[j].Labels)
+	})
+	for _, s := range samples {
+		writeSample(w, name, labels, s.Labels, s.Value)
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels []string, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func lessLabels(a []string, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
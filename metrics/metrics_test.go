@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.\nAll of them.", "path")
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	r.NewGaugeFunc("money", "Money.", []string{"currency"}, func() []Sample {
+		return []Sample{{[]string{"USD"}, 1.5}, {[]string{"EUR"}, math.Inf(1)}}
+	})
+
+	c.Inc(`/a"b`)
+	c.Add(2, "/")
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.WriteText(&buf))
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.15
+latency_seconds_count 3
+# HELP money Money.
+# TYPE money gauge
+money{currency="EUR"} +Inf
+money{currency="USD"} 1.5
+# HELP requests_total Requests.\nAll of them.
+# TYPE requests_total counter
+requests_total{path="/"} 2
+requests_total{path="/a\"b"} 1
+`, buf.String())
+
+	assert.Equal(t, float64(2), c.Value("/"))
+	assert.Equal(t, uint64(3), h.Count())
+}
+
+func TestRegistry_Misuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("c", "C.", "a")
+
+	assert.Panics(t, func() { r.NewCounter("c", "C again.") })
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "x") })
+	assert.Panics(t, func() { r.NewHistogram("h", "H.", []float64{1, 0.5}) })
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("c", "C.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "\nc 1\n")
+}
@@ -0,0 +1,147 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"simple_bank/models/bank"
+	"simple_bank/reqctx"
+	"sync"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// ClientIDHeader scopes idempotency keys, client IP is used without it
+	ClientIDHeader = "X-Client-ID"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// responseRecorder keeps a copy of the response body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency replays the stored response for requests repeated with the
+// same Idempotency-Key header. Reusing a key with a different request is
+// rejected. The key is reserved durably before the request runs, a retry of
+// a request whose outcome was lost, e.g. by a crash, is rejected rather than
+// run again. Requests without the header are passed through.
+func Idempotency(logger *zap.Logger, ttl time.Duration) gin.HandlerFunc {
+	inFlight := &sync.Map{}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			abortJSON(c, http.StatusBadRequest, "idempotency key is too long")
+			return
+		}
+
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			abortJSON(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		client := c.GetHeader(ClientIDHeader)
+		if client == "" {
+			client = c.ClientIP()
+		}
+		scopedKey := client + " " + key
+		hash := requestHash(c.Request, body)
+
+		// concurrent retry while the first request is still running
+		if _, busy := inFlight.LoadOrStore(scopedKey, struct{}{}); busy {
+			abortJSON(c, http.StatusConflict, "request with this idempotency key is in progress")
+			return
+		}
+		defer inFlight.Delete(scopedKey)
+
+		_bank := reqctx.Bank(c)
+		if rec, ok := _bank.GetIdempotencyRecord(scopedKey); ok {
+			if rec.RequestHash != hash {
+				abortJSON(c, http.StatusUnprocessableEntity, "idempotency key was used with a different request")
+				return
+			}
+			if rec.Pending() {
+				abortJSON(c, http.StatusConflict, "outcome of the request with this idempotency key is unknown")
+				return
+			}
+
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(rec.Status, "application/json; charset=utf-8", rec.Body)
+			c.Abort()
+			return
+		}
+
+		if err := _bank.ReserveIdempotencyKey(scopedKey, hash, time.Now().Add(ttl)); err != nil {
+			logger.Error("Can not reserve idempotency key", zap.String("key", key), zap.Error(err))
+			abortJSON(c, http.StatusInternalServerError, "can not store idempotency key")
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = recorder
+
+		c.Next()
+
+		// server errors are not final, let the client retry them
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			if err := _bank.ReleaseIdempotencyKey(scopedKey); err != nil {
+				logger.Error("Can not release idempotency key", zap.String("key", key), zap.Error(err))
+			}
+			return
+		}
+
+		err = _bank.SaveIdempotencyRecord(bank.IdempotencyRecord{
+			Key:         scopedKey,
+			RequestHash: hash,
+			Status:      c.Writer.Status(),
+			Body:        recorder.body.Bytes(),
+			ExpiresAt:   time.Now().Add(ttl),
+		})
+		if err != nil {
+			// the key stays reserved, retries are rejected rather than run
+			logger.Error("Can not save idempotency record", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+// abortJSON stops the request with an error body shaped as handlers
+// respond with
+func abortJSON(c *gin.Context, status int, msg string) {
+	body := gin.H{"error": msg}
+	if id := reqctx.RequestID(c); id != "" {
+		body["request_id"] = id
+	}
+	c.AbortWithStatusJSON(status, gin.H{"status": -1, "body": body})
+}
+
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,86 @@
+package middlewares
+
+import (
+	"github.com/gin-gonic/gin"
+	"simple_bank/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unmatchedRoute is the route label of requests no route serves
+const unmatchedRoute = "unmatched"
+
+var (
+	httpRequests = metrics.Default.NewCounter("http_requests_total",
+		"HTTP requests by route and status.", "method", "route", "status")
+	httpDuration = metrics.Default.NewHistogram("http_request_duration_seconds",
+		"Time of handling HTTP requests by route and status.", metrics.DefaultBuckets, "method", "route", "status")
+)
+
+// Metrics counts requests and measures their work time by route, which is
+// the registered path of the route serving the request. Requests of no
+// route share one label, so clients can not blow up the number of series.
+func Metrics(router *gin.Engine) gin.HandlerFunc {
+	// routes are all registered before the first request
+	var once sync.Once
+	var routes map[string][]string
+
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		once.Do(func() {
+			routes = make(map[string][]string)
+			for _, r := range router.Routes() {
+				routes[r.Method] = append(routes[r.Method], r.Path)
+			}
+		})
+
+		method := c.Request.Method
+		route, ok := routePattern(c, routes[method])
+		if !ok {
+			method, route = "other", unmatchedRoute
+		}
+		status := strconv.Itoa(c.Writer.Status())
+
+		httpRequests.Inc(method, route, status)
+		httpDuration.Observe(time.Since(start).Seconds(), method, route, status)
+	}
+}
+
+// routePattern finds the route of the request path among the routes of
+// its method: static segments must be equal and a parameter segment must
+// hold the value the request got for that parameter
+func routePattern(c *gin.Context, routes []string) (string, bool) {
+	segments := strings.Split(c.Request.URL.Path, "/")
+	for _, route := range routes {
+		if routeMatches(c, strings.Split(route, "/"), segments) {
+			return route, true
+		}
+	}
+	return "", false
+}
+
+func routeMatches(c *gin.Context, route []string, segments []string) bool {
+	if len(route) != len(segments) {
+		return false
+	}
+
+	params := 0
+	for i, s := range route {
+		if !strings.HasPrefix(s, ":") {
+			if s != segments[i] {
+				return false
+			}
+			continue
+		}
+		if v, ok := c.Params.Get(s[1:]); !ok || v != segments[i] {
+			return false
+		}
+		params++
+	}
+	return params == len(c.Params)
+}
@@ -0,0 +1,45 @@
+package middlewares
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"simple_bank/reqctx"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+// RequestID takes the request ID from the X-Request-ID header or generates
+// one, and returns it in the same response header. Handlers get it and
+// the logger tagged with it from the context.
+func RequestID(logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+
+		reqctx.Set(c, id, logger.With(zap.String("request_id", id)))
+		c.Header(RequestIDHeader, id)
+
+		c.Next()
+	}
+}
+
+// validRequestID accepts IDs of printable ASCII without spaces, so they
+// can be logged and echoed safely
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
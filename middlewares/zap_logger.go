@@ -3,6 +3,7 @@ package middlewares
 import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"simple_bank/reqctx"
 	"time"
 )
 
@@ -14,6 +15,7 @@ func ZapLogger(logger *zap.Logger) gin.HandlerFunc{
 
 		// after request
 		logger.Info(c.Request.URL.Path,
+			zap.String("request_id", reqctx.RequestID(c)),
 			zap.String("method", c.Request.Method),
 			zap.String("remote_addr", c.Request.RemoteAddr),
 			zap.String("url", c.Request.URL.Path),
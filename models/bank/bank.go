@@ -4,110 +4,561 @@ import (
 	"errors"
 	"github.com/JohnCGriffin/overflow"
 	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"simple_bank/models/currency"
+	"simple_bank/models/fees"
+	"simple_bank/models/fx"
 	"strconv"
 	"sync"
 	"time"
 )
 
+var ErrTransferNotFound = errors.New("no transfer found")
+
+var (
+	// ErrInsufficientFunds rejects transfers the sender can not afford
+	ErrInsufficientFunds = errors.New("originating balance not enough")
+	// ErrFeeNotCovered rejects transfers the sender can afford without the fee only
+	ErrFeeNotCovered = errors.New("originating balance not enough to pay the fee")
+
+	ErrFromNotFound = errors.New("originating account not found")
+	ErrToNotFound   = errors.New("terminating account not found")
+)
+
 type Account struct {
+	id        uuid.UUID
 	createdAt time.Time
 	updatedAt time.Time
 	balance   int64
+	currency  string
+	status    AccountStatus
+	overdraft int64
+	limits    SpendingLimits
+
+	// metadata of the client, the bank does not interpret it
+	owner       string
+	name        string
+	externalRef string
+	tags        []string
 }
 
+func (ac Account) ID() uuid.UUID        { return ac.id }
+func (ac Account) CreatedAt() time.Time { return ac.createdAt }
+func (ac Account) UpdatedAt() time.Time { return ac.updatedAt }
+func (ac Account) Balance() int64       { return ac.balance }
+func (ac Account) Currency() string     { return ac.currency }
+func (ac Account) Owner() string        { return ac.owner }
+func (ac Account) Name() string         { return ac.name }
+func (ac Account) ExternalRef() string  { return ac.externalRef }
+
+func (ac Account) Tags() []string {
+	res := make([]string, len(ac.tags))
+	copy(res, ac.tags)
+	return res
+}
+
+// Status of accounts stored before statuses were introduced is empty, they
+// are active
+func (ac Account) Status() AccountStatus {
+	if ac.status == "" {
+		return AccountActive
+	}
+	return ac.status
+}
+
+// AccountParams describes a new account, empty currency means the default.
+// ExternalRef is unique per Owner, empty one is not checked. Overdraft is
+// how far below zero the balance may go.
+type AccountParams struct {
+	Balance     int64
+	Overdraft   int64
+	Currency    string
+	Owner       string
+	Name        string
+	ExternalRef string
+	Tags        []string
+}
+
+// Bank validates and applies changes to accounts. Every change holds locks
+// of the accounts it touches, so unrelated transfers are validated in
+// parallel, commitMu orders their events as they are logged. mu is
+// held for reading by every change and for writing by snapshots, which
+// need the whole bank to stand still.
+//
+// Bank is a handle to the state it shares with handles of other loggers,
+// changes made through it are logged with its logger.
 type Bank struct {
-	accounts map[uuid.UUID]*Account
-	mu       *sync.Mutex
+	*bankState
+	logger *zap.Logger
 }
 
-var bank = &Bank{
-	accounts: make(map[uuid.UUID]*Account),
-	mu:       &sync.Mutex{},
+type bankState struct {
+	storage     Storage
+	ledger      *Ledger
+	idempotency *idempotencyIndex
+	holds       *holdIndex
+	statuses    *statusHistory
+	refs        *externalRefs
+	schedules   *scheduleIndex
+	interest    *interestBook
+	holdTTL     time.Duration
+	rates       *fx.Rates
+	fees        *fees.Fees
+	locks       *accountLocks
+	mu          *sync.RWMutex
+	commitMu    *sync.Mutex
+
+	// persistence, nil wal means in-memory only bank
+	dir  string
+	wal  *WAL
+	done chan struct{}
+	jobs *sync.WaitGroup
+}
+
+var bank = NewBank()
+
+// NewBank creates an empty in-memory bank
+func NewBank() *Bank {
+	return newBank(NewMemoryStorage())
+}
+
+// New creates a bank on top of the storage, the ledger, idempotency records,
+// holds, status history, scheduled transfers and the interest state are
+// rebuilt from what the storage keeps
+func New(s Storage) (*Bank, error) {
+	txs, err := s.Transactions()
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.IdempotencyRecords()
+	if err != nil {
+		return nil, err
+	}
+	holds, err := s.Holds()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := s.StatusChanges()
+	if err != nil {
+		return nil, err
+	}
+	schedules, runs, err := s.ScheduledTransfers()
+	if err != nil {
+		return nil, err
+	}
+	interest, err := s.Interest()
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := s.ListAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBank(s)
+	for _, ac := range accounts {
+		b.refs.put(ac)
+	}
+	for _, tx := range txs {
+		b.ledger.record(tx)
+	}
+	for _, rec := range records {
+		b.idempotency.put(rec)
+	}
+	for _, h := range holds {
+		b.holds.put(h)
+	}
+	for _, ch := range changes {
+		b.statuses.add(ch)
+	}
+	for _, st := range schedules {
+		b.schedules.put(st)
+	}
+	for _, run := range runs {
+		b.schedules.addRun(run)
+	}
+	if interest != nil {
+		b.interest.set(*interest)
+	}
+	return b, nil
+}
+
+func newBank(s Storage) *Bank {
+	state := &bankState{
+		storage:     s,
+		ledger:      NewLedger(),
+		idempotency: newIdempotencyIndex(),
+		holds:       newHoldIndex(),
+		statuses:    newStatusHistory(),
+		refs:        newExternalRefs(),
+		schedules:   newScheduleIndex(),
+		interest:    newInterestBook(),
+		holdTTL:     DefaultHoldTTL,
+		locks:       newAccountLocks(),
+		mu:          &sync.RWMutex{},
+		commitMu:    &sync.Mutex{},
+		done:        make(chan struct{}),
+		jobs:        &sync.WaitGroup{},
+	}
+	return &Bank{bankState: state, logger: zap.NewNop()}
 }
 
 func GetBank() *Bank {
 	return bank
 }
 
+// SetBank replaces the bank served by GetBank, e.g. with a persistent one
+func SetBank(b *Bank) {
+	bank = b
+}
+
+// SetLogger sets the logger of events made by background jobs and by
+// callers which do not pass their own
+func (b *Bank) SetLogger(l *zap.Logger) {
+	b.logger = l
+}
+
+// WithLogger returns a handle to the bank logging events with l, e.g.
+// tagged with the request. Only the handle is allocated, the state is b's.
+func (b *Bank) WithLogger(l *zap.Logger) *Bank {
+	return &Bank{bankState: b.bankState, logger: l}
+}
+
+func (b *Bank) Ledger() *Ledger {
+	return b.ledger
+}
+
+// CreateAccount creates an account in the default currency
 func (b *Bank) CreateAccount(balance int64) (uuid.UUID, error) {
-	if balance < 0 {
+	return b.CreateAccountWith(AccountParams{Balance: balance})
+}
+
+func (b *Bank) CreateAccountWith(params AccountParams) (uuid.UUID, error) {
+	if params.Balance < 0 {
 		return uuid.Nil, errors.New("сan not be negative balance")
 	}
+	if params.Overdraft < 0 {
+		return uuid.Nil, errors.New("overdraft limit can not be negative")
+	}
+
+	if params.Currency == "" {
+		params.Currency = currency.Default
+	}
+	cur, err := currency.Get(params.Currency)
+	if err != nil {
+		return uuid.Nil, err
+	}
 
-	b.mu.Lock()
-	defer b.mu.Unlock()
+	if err := validateMetadata(params); err != nil {
+		return uuid.Nil, err
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
 
 	newId := uuid.New()
-	if _, ok := b.accounts[newId]; ok {
+	unlock := b.locks.lock(newId)
+	defer unlock()
+
+	if _, err := b.storage.GetAccount(newId); err != ErrAccountNotFound {
 		return uuid.Nil, errors.New("сan not generate Account ID")
 	}
 
-	b.accounts[newId] = &Account{
-		createdAt: time.Now(),
-		updatedAt: time.Now(),
-		balance:   balance,
+	// concurrent requests with the same reference wait for each other here
+	if !b.refs.reserve(params.Owner, params.ExternalRef, newId) {
+		return uuid.Nil, ErrExternalRefTaken
+	}
+
+	err = b.commit(&accountCreated{
+		ID:          newId,
+		TxID:        uuid.New(),
+		Balance:     params.Balance,
+		Overdraft:   params.Overdraft,
+		Currency:    cur.Code,
+		Owner:       params.Owner,
+		Name:        params.Name,
+		ExternalRef: params.ExternalRef,
+		Tags:        append([]string(nil), params.Tags...),
+		At:          now(),
+	})
+	if err != nil {
+		b.refs.release(params.Owner, params.ExternalRef, newId)
+		return uuid.Nil, err
 	}
 
+	accountsCreated.Inc()
 	return newId, nil
 }
 
+// GetAccount returns a copy of the account, without taking any locks
+func (b *Bank) GetAccount(id uuid.UUID) (Account, error) {
+	return b.storage.GetAccount(id)
+}
+
+// GetAccountBalance does not take any locks: storage returns a consistent
+// copy of the account, so reads never wait for transfers
 func (b *Bank) GetAccountBalance(id uuid.UUID) (string, error) {
 	// checking if account exists
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	ac, ok := b.accounts[id]
-	if !ok {
-		return "", errors.New("no account found")
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return "", err
 	}
 
 	return strconv.FormatInt(ac.balance, 10), nil
 }
 
-func (b *Bank) Transfer(from uuid.UUID, to uuid.UUID, amount int64) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+func (b *Bank) GetAccountPostings(id uuid.UUID, f PostingFilter) ([]Posting, bool, error) {
+	if _, err := b.storage.GetAccount(id); err != nil {
+		return nil, false, err
+	}
+
+	postings, more := b.ledger.Find(id, f)
+	return postings, more, nil
+}
 
-	// Accounts can not be the same
-	if from.String() == to.String() {
-		return errors.New("accounts must be different")
+// Transfer moves amount between accounts in the same currency and returns
+// the transfer ID. The fee of the schedule is charged with it.
+func (b *Bank) Transfer(from uuid.UUID, to uuid.UUID, amount int64) (uuid.UUID, error) {
+	res, err := b.TransferWithFee(from, to, amount, false)
+	if err != nil {
+		return uuid.Nil, err
 	}
+	return res.TxID, nil
+}
+
+// Exchange moves amount in the currency of the originating account to an
+// account in another currency, converted at the current rate. The
+// transfer ID is returned.
+func (b *Bank) Exchange(from uuid.UUID, to uuid.UUID, amount int64) (uuid.UUID, error) {
+	if b.rates == nil {
+		return uuid.Nil, errors.New("exchange rates are not configured")
+	}
+
+	res, err := b.TransferWithFee(from, to, amount, true)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return res.TxID, nil
+}
 
-	// checking 0 or negative amount
-	if amount <= 0 {
-		return errors.New("can not be zero or negative transfer")
+// checkTransfer validates moving amount between the accounts as they are
+// at the time, pending is spent by transfers not recorded yet. Conversion
+// is returned for transfers between currencies, which must be asked for
+// with convert.
+func (b *Bank) checkTransfer(from Account, to Account, amount int64, convert bool, at time.Time, pending Spending) (*fx.Conversion, error) {
+	if err := checkTransferStatuses(from, to); err != nil {
+		return nil, err
 	}
 
-	if _, ok := b.accounts[to]; !ok {
-		return errors.New("terminating account not found")
+	if !convert && from.currency != to.currency {
+		return nil, errors.New("accounts have different currencies, conversion must be requested explicitly")
+	}
+	if convert && from.currency == to.currency {
+		return nil, errors.New("accounts have the same currency, nothing to convert")
 	}
 
-	if _, ok := b.accounts[from]; !ok {
-		return errors.New("originating account not found")
+	if err := b.checkLimits(from, amount, at, pending); err != nil {
+		return nil, err
 	}
 
+	// Check if from has enough balance, held money can not be spent
+	if b.headroom(from, at) < amount {
+		return nil, ErrInsufficientFunds
+	}
 
-	fromBalance := b.accounts[from].balance
-	toBalance := b.accounts[to].balance
+	if _, ok := overflow.Sub64(from.balance, amount); !ok {
+		return nil, errors.New("overflow of from balance")
+	}
 
-	// Check if from has enough balance
-	if fromBalance < amount {
-		return errors.New("originating balance not enough")
+	credit := amount
+	var conv *fx.Conversion
+	if convert {
+		c, err := b.convert(amount, from.currency, to.currency)
+		if err != nil {
+			return nil, err
+		}
+		credit, conv = c.Amount, &c
 	}
 
 	// check for overflow after operation
-	addRes, ok := overflow.Add64(toBalance, amount)
+	if _, ok := overflow.Add64(to.balance, credit); !ok {
+		return nil, errors.New("overflow of to balance")
+	}
+
+	return conv, nil
+}
+
+// convert converts amount at the current rate
+func (b *Bank) convert(amount int64, from string, to string) (fx.Conversion, error) {
+	if b.rates == nil {
+		return fx.Conversion{}, errors.New("exchange rates are not configured")
+	}
+
+	fromCur, err := currency.Get(from)
+	if err != nil {
+		return fx.Conversion{}, err
+	}
+	toCur, err := currency.Get(to)
+	if err != nil {
+		return fx.Conversion{}, err
+	}
+
+	conv, err := b.rates.Table().Convert(amount, fromCur, toCur)
+	if err != nil {
+		return fx.Conversion{}, err
+	}
+	if conv.Amount == 0 {
+		return fx.Conversion{}, errors.New("converted amount is zero")
+	}
+	return conv, nil
+}
+
+// ReverseTransfer moves amount of an earlier transfer back to its sender
+// and returns the reversal ID. Zero amount reverses what is left of the
+// transfer. Exchanges can not be reversed, the rate has changed since.
+func (b *Bank) ReverseTransfer(id uuid.UUID, amount int64) (uuid.UUID, error) {
+	txID, err := b.reverseTransfer(id, amount)
+	observeTransfer(err)
+	return txID, err
+}
+
+func (b *Bank) reverseTransfer(id uuid.UUID, amount int64) (uuid.UUID, error) {
+	if amount < 0 {
+		return uuid.Nil, errors.New("can not be negative reversal")
+	}
+
+	orig, ok := b.ledger.Transaction(id)
 	if !ok {
-		return errors.New("overflow of to balance")
+		return uuid.Nil, ErrTransferNotFound
+	}
+	if orig.Kind != KindTransfer && orig.Kind != KindCapture {
+		return uuid.Nil, errors.New("only transfers can be reversed")
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	// reversals of the same transfer wait for each other here
+	unlock := b.locks.lock(orig.From, orig.To)
+	defer unlock()
+
+	left := orig.Amount - b.ledger.Reversed(id)
+	if amount == 0 {
+		amount = left
+	}
+	if left == 0 {
+		return uuid.Nil, errors.New("transfer is already reversed")
 	}
+	if amount > left {
+		return uuid.Nil, errors.New("reversal exceeds the transfer amount")
+	}
+
+	recipient, sender, err := b.getTransferAccounts(orig.To, orig.From)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := checkTransferStatuses(recipient, sender); err != nil {
+		return uuid.Nil, err
+	}
+
+	// the overdraft of the recipient does not fund reversals
+	if b.available(recipient, now()) < amount {
+		return uuid.Nil, ErrInsufficientFunds
+	}
+
+	if _, ok := overflow.Add64(sender.balance, amount); !ok {
+		return uuid.Nil, errors.New("overflow of to balance")
+	}
+
+	txID := uuid.New()
+	err = b.commit(&reversed{
+		TxID:     txID,
+		Original: id,
+		Amount:   amount,
+		At:       now(),
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return txID, nil
+}
+
+// SetRates sets exchange rates used by Exchange
+func (b *Bank) SetRates(r *fx.Rates) {
+	b.rates = r
+}
+
+func (b *Bank) Rates() *fx.Rates {
+	return b.rates
+}
 
-	//all validated, let's transfer
-	b.accounts[from].balance = fromBalance - amount
-	b.accounts[from].updatedAt = time.Now()
+func (b *Bank) getTransferAccounts(from uuid.UUID, to uuid.UUID) (Account, Account, error) {
+	toAccount, err := b.storage.GetAccount(to)
+	if err == ErrAccountNotFound {
+		return Account{}, Account{}, ErrToNotFound
+	} else if err != nil {
+		return Account{}, Account{}, err
+	}
+
+	fromAccount, err := b.storage.GetAccount(from)
+	if err == ErrAccountNotFound {
+		return Account{}, Account{}, ErrFromNotFound
+	} else if err != nil {
+		return Account{}, Account{}, err
+	}
+
+	return fromAccount, toAccount, nil
+}
+
+// checkTransferStatuses tells whether money can move between the accounts
+func checkTransferStatuses(from Account, to Account) error {
+	if err := from.canDebit(); err != nil {
+		return err
+	}
+	return to.canCredit()
+}
 
-	b.accounts[to].balance = addRes
-	b.accounts[to].updatedAt = time.Now()
+// abort logs that the event logged as seq was not applied, so replay skips
+// it. A failure leaves the log failing readiness.
+func (b *Bank) abort(seq uint64) {
+	if b.wal == nil {
+		return
+	}
+	if _, err := b.wal.append(&eventAborted{Seq: seq}, 0); err != nil {
+		b.logger.Error("Can not log aborted bank event", zap.Uint64("seq", seq), zap.Error(err))
+	}
+}
+
+// commit makes the event durable and applies it. Caller must hold b.mu for
+// reading and locks of all accounts touched by the event.
+func (b *Bank) commit(e event) error {
+	// commits are serialized, so postings are numbered in the order the
+	// events are logged in
+	b.commitMu.Lock()
+	defer b.commitMu.Unlock()
 
+	var seq uint64
+	if b.wal != nil {
+		var err error
+		if seq, err = b.wal.append(e, b.ledger.nextSeq()); err != nil {
+			b.logger.Error("Can not log bank event", zap.String("event", e.kind()), zap.Error(err))
+			return err
+		}
+	}
+
+	if err := e.apply(b); err != nil {
+		b.logger.Error("Can not apply bank event", zap.String("event", e.kind()), zap.Error(err))
+		b.abort(seq)
+		return err
+	}
+	b.logger.Info("Bank event", zap.String("event", e.kind()), zap.Reflect("data", e))
 	return nil
+}
 
+// now is the event timestamp. Monotonic clock reading is stripped, so
+// timestamps restored from disk are equal to the original ones.
+func now() time.Time {
+	return time.Now().UTC().Round(0)
 }
@@ -0,0 +1,104 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const benchAccounts = 1024
+
+var benchGoroutines = []int{1, 8, 64}
+
+func newBenchBank(b *testing.B) (*Bank, []uuid.UUID) {
+	bank := NewBank()
+	ids := make([]uuid.UUID, benchAccounts)
+	for i := range ids {
+		id, err := bank.CreateAccount(1 << 40)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = id
+	}
+	return bank, ids
+}
+
+// runConcurrent splits b.N calls of op between the given number of goroutines
+func runConcurrent(b *testing.B, goroutines int, op func(r *rand.Rand)) {
+	wg := &sync.WaitGroup{}
+	perGoroutine := b.N / goroutines
+
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		n := perGoroutine
+		if g == 0 {
+			n += b.N % goroutines
+		}
+
+		wg.Add(1)
+		go func(seed int64, n int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < n; i++ {
+				op(r)
+			}
+		}(int64(g), n)
+	}
+	wg.Wait()
+}
+
+// serialized emulates the former single bank mutex around every operation
+func serialized(op func(r *rand.Rand)) func(r *rand.Rand) {
+	mu := &sync.Mutex{}
+	return func(r *rand.Rand) {
+		mu.Lock()
+		defer mu.Unlock()
+		op(r)
+	}
+}
+
+func BenchmarkBank_Transfer(b *testing.B) {
+	for _, mode := range []string{"global-lock", "per-account"} {
+		for _, goroutines := range benchGoroutines {
+			b.Run(mode+"/goroutines-"+strconv.Itoa(goroutines), func(b *testing.B) {
+				bank, ids := newBenchBank(b)
+
+				op := func(r *rand.Rand) {
+					bank.Transfer(ids[r.Intn(len(ids))], ids[r.Intn(len(ids))], 1)
+				}
+				if mode == "global-lock" {
+					op = serialized(op)
+				}
+
+				runConcurrent(b, goroutines, op)
+			})
+		}
+	}
+}
+
+// BenchmarkBank_BalanceUnderTransfers has every 10th operation transfer
+// money while the rest read balances
+func BenchmarkBank_BalanceUnderTransfers(b *testing.B) {
+	for _, mode := range []string{"global-lock", "per-account"} {
+		for _, goroutines := range benchGoroutines {
+			b.Run(mode+"/goroutines-"+strconv.Itoa(goroutines), func(b *testing.B) {
+				bank, ids := newBenchBank(b)
+
+				op := func(r *rand.Rand) {
+					if r.Intn(10) == 0 {
+						bank.Transfer(ids[r.Intn(len(ids))], ids[r.Intn(len(ids))], 1)
+					} else {
+						bank.GetAccountBalance(ids[r.Intn(len(ids))])
+					}
+				}
+				if mode == "global-lock" {
+					op = serialized(op)
+				}
+
+				runConcurrent(b, goroutines, op)
+			})
+		}
+	}
+}
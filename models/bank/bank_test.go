@@ -3,8 +3,14 @@ package bank
 import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"simple_bank/models/fx"
 	"strconv"
-	"sync"
+	"strings"
 	"testing"
 	"time"
 )
@@ -37,22 +43,20 @@ var balances = []string{
 	"9223372036854775807",
 }
 
-var testBank = &Bank{
-	accounts: make(map[uuid.UUID]*Account),
-	mu:       &sync.Mutex{},
-}
+var testBank = NewBank()
 
 func init() {
 	for i := 0; i <= 9; i++ {
 		b, _ := strconv.ParseInt(balances[i], 10, 64)
 
+		str, _ := uuid.Parse(ids[i])
 		acc := Account{
+			id:        str,
 			createdAt: time.Now(),
 			updatedAt: time.Now(),
 			balance:   b,
 		}
-		str, _ := uuid.Parse(ids[i])
-		testBank.accounts[str] = &acc
+		testBank.storage.CreateAccount(acc, nil)
 	}
 }
 
@@ -62,7 +66,8 @@ func TestBank_CreateAccount(t *testing.T) {
 
 	assert.Nil(t, err)
 
-	createdBalance := testBank.accounts[uid].balance
+	created, _ := testBank.storage.GetAccount(uid)
+	createdBalance := created.balance
 	assert.Equal(t, b, createdBalance)
 }
 
@@ -73,7 +78,8 @@ func TestBank_CreateAccountBalances(t *testing.T) {
 	uid, err := testBank.CreateAccount(b)
 	assert.Nil(t, err)
 
-	createdBalance := testBank.accounts[uid].balance
+	created, _ := testBank.storage.GetAccount(uid)
+	createdBalance := created.balance
 	assert.Equal(t, b, createdBalance)
 
 	// tests very big balance
@@ -81,7 +87,8 @@ func TestBank_CreateAccountBalances(t *testing.T) {
 	uid, err = testBank.CreateAccount(b)
 	assert.Nil(t, err)
 
-	createdBalance = testBank.accounts[uid].balance
+	created, _ = testBank.storage.GetAccount(uid)
+	createdBalance = created.balance
 	assert.Equal(t, b, createdBalance)
 
 	// tests  negative balance
@@ -108,7 +115,7 @@ func TestBank_TransferFromNotExists(t *testing.T) {
 	uidFrom, _ := uuid.Parse("11111111-1111-1111-1111-1111111111")
 	uidTo, _ := uuid.Parse(ids[0])
 
-	err := testBank.Transfer(uidFrom, uidTo, int64(100))
+	_, err := testBank.Transfer(uidFrom, uidTo, int64(100))
 	assert.NotNil(t, err)
 
 }
@@ -117,7 +124,7 @@ func TestBank_TransferToNotExists(t *testing.T) {
 	uidFrom, _ := uuid.Parse(ids[0])
 	uidTo, _ := uuid.Parse("11111111-1111-1111-1111-1111111111")
 
-	err := testBank.Transfer(uidFrom, uidTo, int64(100))
+	_, err := testBank.Transfer(uidFrom, uidTo, int64(100))
 	assert.NotNil(t, err)
 }
 
@@ -125,10 +132,10 @@ func TestBank_TransferZeroOrNegative(t *testing.T) {
 	uidFrom, _ := uuid.Parse(ids[0])
 	uidTo, _ := uuid.Parse(ids[1])
 
-	err := testBank.Transfer(uidFrom, uidTo, int64(0))
+	_, err := testBank.Transfer(uidFrom, uidTo, int64(0))
 	assert.NotNil(t, err)
 
-	err = testBank.Transfer(uidFrom, uidTo, int64(-100))
+	_, err = testBank.Transfer(uidFrom, uidTo, int64(-100))
 	assert.NotNil(t, err)
 }
 
@@ -138,7 +145,7 @@ func TestBank_Transfer(t *testing.T) {
 
 	var amount int64 = 5000
 
-	err := testBank.Transfer(uidFrom, uidTo, amount)
+	_, err := testBank.Transfer(uidFrom, uidTo, amount)
 	assert.Nil(t, err)
 
 	fromVal, err := testBank.GetAccountBalance(uidFrom)
@@ -154,7 +161,7 @@ func TestBank_TransferNotEnoughBalance(t *testing.T) {
 	uidFrom, _ := uuid.Parse(ids[3]) // balance = 50000
 	uidTo, _ := uuid.Parse(ids[2])   // balace = 1000
 
-	err := testBank.Transfer(uidFrom, uidTo, int64(50001))
+	_, err := testBank.Transfer(uidFrom, uidTo, int64(50001))
 	assert.NotNil(t, err)
 }
 
@@ -162,7 +169,7 @@ func TestBank_TransferOverflow(t *testing.T) {
 	uidFrom, _ := uuid.Parse(ids[2]) // balance = 1000
 	uidTo, _ := uuid.Parse(ids[9])   // balace = 9223372036854775807
 
-	err := testBank.Transfer(uidFrom, uidTo, int64(1000))
+	_, err := testBank.Transfer(uidFrom, uidTo, int64(1000))
 	assert.NotNil(t, err)
 }
 
@@ -170,6 +177,190 @@ func TestBank_TransferSameAccount(t *testing.T) {
 	uidFrom, _ := uuid.Parse(ids[2]) // balance = 1000
 	uidTo, _ := uuid.Parse(ids[2])   // balace = 1000
 
-	err := testBank.Transfer(uidFrom, uidTo, int64(500))
+	_, err := testBank.Transfer(uidFrom, uidTo, int64(500))
+	assert.NotNil(t, err)
+}
+
+func TestBank_CreateAccountCurrency(t *testing.T) {
+	uid, err := testBank.CreateAccount(100)
+	assert.Nil(t, err)
+	ac, _ := testBank.GetAccount(uid)
+	assert.Equal(t, "RUB", ac.Currency())
+
+	uid, err = testBank.CreateAccountWith(AccountParams{Balance: 100, Currency: "jpy"})
+	assert.Nil(t, err)
+	ac, _ = testBank.GetAccount(uid)
+	assert.Equal(t, "JPY", ac.Currency())
+
+	_, err = testBank.CreateAccountWith(AccountParams{Balance: 100, Currency: "XXX"})
+	assert.NotNil(t, err)
+}
+
+func TestBank_TransferDifferentCurrencies(t *testing.T) {
+	uidFrom, _ := testBank.CreateAccountWith(AccountParams{Balance: 1000, Currency: "USD"})
+	uidTo, _ := testBank.CreateAccountWith(AccountParams{Balance: 1000, Currency: "EUR"})
+
+	_, err := testBank.Transfer(uidFrom, uidTo, 100)
+	assert.NotNil(t, err)
+
+	balance, _ := testBank.GetAccountBalance(uidFrom)
+	assert.Equal(t, "1000", balance)
+}
+
+func testRates(t *testing.T, table string) *fx.Rates {
+	dir, err := ioutil.TempDir("", "fx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rates.json")
+	if err := ioutil.WriteFile(path, []byte(table), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rates, err := fx.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rates
+}
+
+func TestBank_Exchange(t *testing.T) {
+	b := NewBank()
+
+	usd, _ := b.CreateAccountWith(AccountParams{Balance: 10000, Currency: "USD"})
+	jpy, _ := b.CreateAccountWith(AccountParams{Balance: 0, Currency: "JPY"})
+	eur, _ := b.CreateAccountWith(AccountParams{Balance: 0, Currency: "EUR"})
+
+	// no rates configured
+	_, err := b.Exchange(usd, jpy, 100)
 	assert.NotNil(t, err)
+
+	b.SetRates(testRates(t, `{"rounding": "half-up", "rates": {"USD/JPY": "149.5"}}`))
+
+	_, err = b.Exchange(usd, jpy, 101)
+	assert.Nil(t, err)
+	balance, _ := b.GetAccountBalance(usd)
+	assert.Equal(t, "9899", balance)
+	balance, _ = b.GetAccountBalance(jpy)
+	assert.Equal(t, "151", balance)
+
+	txs := b.Ledger().Transactions()
+	tx := txs[len(txs)-1]
+	assert.Equal(t, KindExchange, tx.Kind)
+	assert.Equal(t, int64(101), tx.Amount)
+	assert.Equal(t, "USD", tx.Currency)
+	assert.Equal(t, int64(151), tx.ToAmount)
+	assert.Equal(t, "149.5", tx.Rate)
+	assert.Equal(t, "-0.005", tx.Remainder)
+
+	// balanced in each currency
+	for _, cur := range []string{"USD", "JPY"} {
+		var sum int64
+		for _, p := range tx.Postings {
+			if p.Currency == cur {
+				sum += p.Signed()
+			}
+		}
+		assert.Equal(t, int64(0), sum, cur)
+	}
+	assert.Equal(t, int64(-151), b.Ledger().BalanceIn(SystemAccountID, "JPY"))
+
+	// no rate for the pair
+	_, err = b.Exchange(usd, eur, 100)
+	assert.NotNil(t, err)
+	// not enough money
+	_, err = b.Exchange(usd, jpy, 10000)
+	assert.NotNil(t, err)
+	// same currency
+	usd2, _ := b.CreateAccountWith(AccountParams{Balance: 0, Currency: "USD"})
+	_, err = b.Exchange(usd, usd2, 100)
+	assert.NotNil(t, err)
+	// converted to nothing
+	b.SetRates(testRates(t, `{"rates": {"USD/JPY": "0.001"}}`))
+	_, err = b.Exchange(usd, jpy, 1)
+	assert.NotNil(t, err)
+}
+
+func TestBank_ReverseTransfer(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	a3, _ := b.CreateAccount(0)
+
+	txID, err := b.Transfer(a1, a2, 600)
+	assert.Nil(t, err)
+	tx, ok := b.Ledger().Transaction(txID)
+	assert.True(t, ok)
+	assert.Equal(t, int64(600), tx.Amount)
+
+	// partial reversals up to the transfer amount
+	revID, err := b.ReverseTransfer(txID, 100)
+	assert.Nil(t, err)
+	rev, _ := b.Ledger().Transaction(revID)
+	assert.Equal(t, KindReversal, rev.Kind)
+	assert.Equal(t, txID, rev.Reverses)
+	assert.Equal(t, a2, rev.From)
+	assert.Equal(t, a1, rev.To)
+	assert.Equal(t, int64(100), b.Ledger().Reversed(txID))
+
+	_, err = b.ReverseTransfer(txID, 501)
+	assert.NotNil(t, err)
+
+	// recipient has spent the money
+	_, err = b.Transfer(a2, a3, 450)
+	assert.Nil(t, err)
+	_, err = b.ReverseTransfer(txID, 0)
+	assert.NotNil(t, err)
+	_, err = b.Transfer(a3, a2, 450)
+	assert.Nil(t, err)
+
+	// zero amount reverses the rest
+	revID, err = b.ReverseTransfer(txID, 0)
+	assert.Nil(t, err)
+	rev, _ = b.Ledger().Transaction(revID)
+	assert.Equal(t, int64(500), rev.Amount)
+
+	balance, _ := b.GetAccountBalance(a1)
+	assert.Equal(t, "1000", balance)
+	balance, _ = b.GetAccountBalance(a2)
+	assert.Equal(t, "0", balance)
+
+	_, err = b.ReverseTransfer(txID, 0)
+	assert.NotNil(t, err)
+	_, err = b.ReverseTransfer(revID, 0)
+	assert.NotNil(t, err)
+	_, err = b.ReverseTransfer(uuid.New(), 0)
+	assert.Equal(t, ErrTransferNotFound, err)
+	_, err = b.ReverseTransfer(txID, -1)
+	assert.NotNil(t, err)
+}
+
+func TestBank_WithLogger(t *testing.T) {
+	var logs strings.Builder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&logs), zap.InfoLevel)
+
+	b := NewBank()
+	a1, _ := b.CreateAccount(100)
+	a2, _ := b.CreateAccount(0)
+	assert.Empty(t, logs.String())
+
+	rb := b.WithLogger(zap.New(core).With(zap.String("request_id", "r1")))
+	id, err := rb.Transfer(a1, a2, 40)
+	assert.Nil(t, err)
+
+	// the state is shared, only the logger differs
+	balance, _ := b.GetAccountBalance(a2)
+	assert.Equal(t, "40", balance)
+	_, ok := b.Ledger().Transaction(id)
+	assert.True(t, ok)
+
+	assert.Contains(t, logs.String(), `"msg":"Bank event","request_id":"r1","event":"transfer"`)
+	assert.Contains(t, logs.String(), id.String())
+
+	// settings made through a handle are seen by all of them
+	rb.SetHoldTTL(time.Minute)
+	h, err := b.PlaceHold(a2, 10, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, h.CreatedAt.Add(time.Minute), h.ExpiresAt)
 }
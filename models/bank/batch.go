@@ -0,0 +1,180 @@
+package bank
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"simple_bank/models/fees"
+	"simple_bank/models/fx"
+	"strconv"
+	"time"
+)
+
+const maxBatchLegs = 1000
+
+// TransferLeg is a single transfer of a batch, Convert allows it between
+// accounts in different currencies
+type TransferLeg struct {
+	From    uuid.UUID
+	To      uuid.UUID
+	Amount  int64
+	Convert bool
+}
+
+// BatchError rejects the whole batch, Legs has errors of the failed legs
+// by their index
+type BatchError struct {
+	Legs map[int]error
+}
+
+func (e *BatchError) Error() string {
+	return strconv.Itoa(len(e.Legs)) + " of the batch transfers failed"
+}
+
+// TransferBatch applies all the legs in order or none of them. Every leg
+// is validated against the balances left by the legs before it and pays
+// the fee of the schedule as a single transfer would. Transfer IDs of the
+// legs are returned, *BatchError tells which legs failed.
+func (b *Bank) TransferBatch(legs []TransferLeg) ([]uuid.UUID, error) {
+	ids, err := b.transferBatch(legs)
+	observeBatch(len(legs), err)
+	return ids, err
+}
+
+func (b *Bank) transferBatch(legs []TransferLeg) ([]uuid.UUID, error) {
+	if len(legs) == 0 {
+		return nil, errors.New("batch is empty")
+	}
+	if len(legs) > maxBatchLegs {
+		return nil, errors.New("batch can not have more than " + strconv.Itoa(maxBatchLegs) + " transfers")
+	}
+
+	ids := make([]uuid.UUID, 0, 2*len(legs))
+	for _, leg := range legs {
+		ids = append(ids, leg.From, leg.To)
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	s := b.feeSchedule()
+	unlock := b.locks.lock(ids...)
+	defer unlock()
+
+	// accounts as they are after the legs checked so far, and what they
+	// have sent in the batch
+	accounts := make(map[uuid.UUID]*Account)
+	pending := make(map[uuid.UUID]Spending)
+	e := &batchTransferred{At: now()}
+	failed := make(map[int]error)
+
+	for i, leg := range legs {
+		l, err := b.checkBatchLeg(s, accounts, pending, leg, e.At)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+
+		e.Legs = append(e.Legs, l)
+		applyBatchLeg(accounts, l)
+	}
+
+	if len(failed) > 0 {
+		return nil, &BatchError{Legs: failed}
+	}
+
+	if err := b.commit(e); err != nil {
+		return nil, err
+	}
+
+	res := make([]uuid.UUID, 0, len(e.Legs))
+	for _, l := range e.Legs {
+		res = append(res, l.TxID)
+	}
+	return res, nil
+}
+
+func (b *Bank) checkBatchLeg(s *fees.Schedule, accounts map[uuid.UUID]*Account, pending map[uuid.UUID]Spending, leg TransferLeg, at time.Time) (batchLeg, error) {
+	if leg.From == leg.To {
+		return batchLeg{}, errors.New("accounts must be different")
+	}
+	if leg.Amount <= 0 {
+		return batchLeg{}, errors.New("can not be zero or negative transfer")
+	}
+
+	from, to, err := b.getTransferAccounts(leg.From, leg.To)
+	if err != nil {
+		return batchLeg{}, err
+	}
+	if ac, ok := accounts[leg.From]; ok {
+		from = *ac
+	}
+	if ac, ok := accounts[leg.To]; ok {
+		to = *ac
+	}
+
+	conv, fee, err := b.checkTransferWithFee(s, from, to, leg.Amount, leg.Convert, at, pending[leg.From], accounts)
+	if err != nil {
+		return batchLeg{}, err
+	}
+	pending[leg.From] = pending[leg.From].add(leg.Amount)
+
+	if accounts[leg.From] == nil {
+		accounts[leg.From] = &from
+	}
+	if accounts[leg.To] == nil {
+		accounts[leg.To] = &to
+	}
+	if fee != nil && accounts[fee.Account] == nil {
+		ac, err := b.storage.GetAccount(fee.Account)
+		if err != nil {
+			return batchLeg{}, err
+		}
+		accounts[fee.Account] = &ac
+	}
+
+	return batchLeg{
+		TxID:       uuid.New(),
+		From:       leg.From,
+		To:         leg.To,
+		Amount:     leg.Amount,
+		Conversion: conv,
+		Fee:        fee,
+	}, nil
+}
+
+// applyBatchLeg moves money of the leg and its fee between the accounts,
+// the accounts must be there already
+func applyBatchLeg(accounts map[uuid.UUID]*Account, l batchLeg) {
+	credit := l.Amount
+	if l.Conversion != nil {
+		credit = l.Conversion.Amount
+	}
+	accounts[l.From].balance -= l.Amount
+	accounts[l.To].balance += credit
+
+	if l.Fee != nil {
+		accounts[l.From].balance -= l.Fee.Amount
+		accounts[l.Fee.Account].balance += l.Fee.Amount
+	}
+}
+
+// newBatchTransaction builds the transaction of the leg from the accounts
+// as they are before it
+func newBatchTransaction(l batchLeg, from Account, to Account, at time.Time) Transaction {
+	if l.Conversion != nil {
+		return newExchangeTransaction(l.TxID, from, to, l.Amount, *l.Conversion, at)
+	}
+	return newTransaction(l.TxID, KindTransfer, from.currency, from.id, to.id, l.Amount, from.balance-l.Amount, to.balance+l.Amount, at)
+}
+
+// batchLeg is a validated leg, conversion and the fee are worked out when
+// the batch is built so replay does not depend on the rates and the fee
+// schedule at that time
+type batchLeg struct {
+	TxID       uuid.UUID      `json:"tx_id"`
+	From       uuid.UUID      `json:"from"`
+	To         uuid.UUID      `json:"to"`
+	Amount     int64          `json:"amount"`
+	Conversion *fx.Conversion `json:"conversion,omitempty"`
+	Fee        *feeCharge     `json:"fee,omitempty"`
+}
@@ -0,0 +1,144 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBank_TransferBatch(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	a3, _ := b.CreateAccount(0)
+
+	// the second leg spends money of the first one
+	ids, err := b.TransferBatch([]TransferLeg{
+		{From: a1, To: a2, Amount: 600},
+		{From: a2, To: a3, Amount: 500},
+		{From: a1, To: a3, Amount: 400},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, ids, 3)
+
+	for id, expected := range map[uuid.UUID]int64{a1: 0, a2: 100, a3: 900} {
+		ac, _ := b.GetAccount(id)
+		assert.Equal(t, expected, ac.Balance())
+		assert.Equal(t, expected, b.Ledger().Balance(id))
+	}
+
+	postings := b.Ledger().Postings(a2)
+	assert.Equal(t, int64(600), postings[0].Balance)
+	assert.Equal(t, int64(100), postings[1].Balance)
+	tx, ok := b.Ledger().Transaction(ids[1])
+	assert.True(t, ok)
+	assert.Equal(t, a3, tx.To)
+}
+
+func TestBank_TransferBatchFails(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	usd, _ := b.CreateAccountWith(AccountParams{Currency: "USD"})
+	txs := len(b.Ledger().Transactions())
+
+	_, err := b.TransferBatch([]TransferLeg{
+		{From: a1, To: a2, Amount: 600},
+		{From: a1, To: a2, Amount: 600},
+		{From: a1, To: usd, Amount: 100},
+		{From: a1, To: uuid.New(), Amount: 100},
+		{From: a2, To: a2, Amount: 100},
+		{From: a2, To: a1, Amount: 0},
+		{From: a1, To: a2, Amount: 400},
+	})
+	if assert.IsType(t, &BatchError{}, err) {
+		legs := err.(*BatchError).Legs
+		assert.Len(t, legs, 5)
+		for _, i := range []int{1, 2, 3, 4, 5} {
+			assert.NotNil(t, legs[i], i)
+		}
+	}
+
+	// nothing is applied
+	ac, _ := b.GetAccount(a1)
+	assert.Equal(t, int64(1000), ac.Balance())
+	assert.Len(t, b.Ledger().Transactions(), txs)
+
+	_, err = b.TransferBatch(nil)
+	assert.NotNil(t, err)
+	_, err = b.TransferBatch(make([]TransferLeg, maxBatchLegs+1))
+	assert.NotNil(t, err)
+}
+
+func TestBank_TransferBatchExchange(t *testing.T) {
+	b := NewBank()
+	b.SetRates(testRates(t, `{"rates": {"USD/EUR": "0.5"}}`))
+	usd, _ := b.CreateAccountWith(AccountParams{Balance: 1000, Currency: "USD"})
+	eur, _ := b.CreateAccountWith(AccountParams{Currency: "EUR"})
+	eur2, _ := b.CreateAccountWith(AccountParams{Currency: "EUR"})
+
+	_, err := b.TransferBatch([]TransferLeg{
+		{From: usd, To: eur, Amount: 1000, Convert: true},
+		{From: eur, To: eur2, Amount: 500},
+	})
+	assert.Nil(t, err)
+
+	ac, _ := b.GetAccount(eur2)
+	assert.Equal(t, int64(500), ac.Balance())
+	assert.Equal(t, int64(0), b.Ledger().BalanceIn(SystemAccountID, "USD"))
+	assert.Equal(t, int64(-500), b.Ledger().BalanceIn(SystemAccountID, "EUR"))
+}
+
+func TestBank_TransferBatchPersisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	fill := func(b *Bank) (uuid.UUID, uuid.UUID) {
+		a1, _ := b.CreateAccount(1000)
+		a2, _ := b.CreateAccount(0)
+		_, err := b.TransferBatch([]TransferLeg{
+			{From: a1, To: a2, Amount: 600},
+			{From: a2, To: a1, Amount: 100},
+			{From: a1, To: a2, Amount: 300},
+		})
+		assert.Nil(t, err)
+		return a1, a2
+	}
+
+	check := func(b *Bank, a1 uuid.UUID, a2 uuid.UUID) {
+		ac, _ := b.GetAccount(a1)
+		assert.Equal(t, int64(200), ac.Balance())
+		ac, _ = b.GetAccount(a2)
+		assert.Equal(t, int64(800), ac.Balance())
+		assert.Len(t, b.Ledger().Postings(a2), 3)
+	}
+
+	// write-ahead log
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	a1, a2 := fill(b)
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1, a2)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	a1, a2 = fill(b)
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	check(b, a1, a2)
+	assert.Nil(t, b.Close())
+}
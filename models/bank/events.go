@@ -0,0 +1,640 @@
+package bank
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"math/big"
+	"simple_bank/models/currency"
+	"simple_bank/models/fx"
+	"time"
+)
+
+// event is a validated state change of the bank. Events are written to the
+// WAL before being applied, so apply must be deterministic: every check
+// belongs to the caller building the event. apply fails only if the
+// storage can not keep the change.
+type event interface {
+	kind() string
+	apply(b *Bank) error
+}
+
+// events maps WAL record types to constructors used during replay
+var events = map[string]func() event{
+	"account_created":    func() event { return &accountCreated{} },
+	"transfer":           func() event { return &transferred{} },
+	"idempotency":        func() event { return &idempotencySaved{} },
+	"exchange":           func() event { return &exchanged{} },
+	"hold_placed":        func() event { return &holdPlaced{} },
+	"hold_captured":      func() event { return &holdCaptured{} },
+	"hold_released":      func() event { return &holdReleased{} },
+	"reversal":           func() event { return &reversed{} },
+	"status_changed":     func() event { return &statusChanged{} },
+	"batch":              func() event { return &batchTransferred{} },
+	"schedule_created":   func() event { return &scheduleCreated{} },
+	"schedule_ran":       func() event { return &scheduleRan{} },
+	"schedule_cancelled": func() event { return &scheduleCancelled{} },
+	"overdraft_changed":  func() event { return &overdraftChanged{} },
+	"limits_changed":     func() event { return &limitsChanged{} },
+	"interest_product":   func() event { return &interestProductSet{} },
+	"interest_source":    func() event { return &interestSourceSet{} },
+	"account_interest":   func() event { return &accountInterestSet{} },
+	"interest_accrued":   func() event { return &interestAccrued{} },
+	"interest_posted":    func() event { return &interestPosted{} },
+	"aborted":            func() event { return &eventAborted{} },
+}
+
+func decodeEvent(kind string, data []byte) (event, error) {
+	newEvent, ok := events[kind]
+	if !ok {
+		return nil, errors.New("unknown event type " + kind)
+	}
+
+	e := newEvent()
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+type accountCreated struct {
+	ID          uuid.UUID `json:"id"`
+	TxID        uuid.UUID `json:"tx_id"`
+	Balance     int64     `json:"balance"`
+	Overdraft   int64     `json:"overdraft,omitempty"`
+	Currency    string    `json:"currency"`
+	Owner       string    `json:"owner,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	ExternalRef string    `json:"external_ref,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+func (e *accountCreated) kind() string { return "account_created" }
+
+func (e *accountCreated) apply(b *Bank) error {
+	ac := Account{
+		id:        e.ID,
+		createdAt: e.At,
+		updatedAt: e.At,
+		balance:   e.Balance,
+		currency:  e.Currency,
+		status:    AccountActive,
+		overdraft: e.Overdraft,
+
+		owner:       e.Owner,
+		name:        e.Name,
+		externalRef: e.ExternalRef,
+		tags:        e.Tags,
+	}
+	if ac.currency == "" {
+		ac.currency = currency.Default
+	}
+
+	// opening balance is funded by the system account
+	var opening *Transaction
+	if e.Balance > 0 {
+		tx := newTransaction(e.TxID, KindOpening, ac.currency, SystemAccountID, e.ID, e.Balance, 0, e.Balance, e.At)
+		opening = &tx
+	}
+
+	if err := b.storage.CreateAccount(ac, opening); err != nil {
+		return err
+	}
+
+	if opening != nil {
+		b.ledger.record(*opening)
+	}
+	b.refs.put(ac)
+	return nil
+}
+
+// transferred moves money between accounts in the same currency, with the
+// fee charged for it if there is one
+type transferred struct {
+	TxID   uuid.UUID  `json:"tx_id"`
+	From   uuid.UUID  `json:"from"`
+	To     uuid.UUID  `json:"to"`
+	Amount int64      `json:"amount"`
+	Fee    *feeCharge `json:"fee,omitempty"`
+	At     time.Time  `json:"at"`
+}
+
+func (e *transferred) kind() string { return "transfer" }
+
+func (e *transferred) apply(b *Bank) error {
+	from, err := b.storage.GetAccount(e.From)
+	if err != nil {
+		return err
+	}
+	to, err := b.storage.GetAccount(e.To)
+	if err != nil {
+		return err
+	}
+
+	tx := newTransaction(e.TxID, KindTransfer, from.currency, e.From, e.To, e.Amount, from.balance-e.Amount, to.balance+e.Amount, e.At)
+	return b.applyWithFee(tx, e.Fee, from, to, e.At)
+}
+
+type idempotencySaved struct {
+	Record IdempotencyRecord `json:"record"`
+}
+
+func (e *idempotencySaved) kind() string { return "idempotency" }
+
+func (e *idempotencySaved) apply(b *Bank) error {
+	if err := b.storage.SaveIdempotencyRecord(e.Record); err != nil {
+		return err
+	}
+
+	b.idempotency.put(e.Record)
+	return nil
+}
+
+// exchanged is a transfer between accounts in different currencies, the
+// conversion is done when the event is built so replay does not depend on
+// the rates at that time. So is the fee.
+type exchanged struct {
+	TxID       uuid.UUID     `json:"tx_id"`
+	From       uuid.UUID     `json:"from"`
+	To         uuid.UUID     `json:"to"`
+	Amount     int64         `json:"amount"`
+	Conversion fx.Conversion `json:"conversion"`
+	Fee        *feeCharge    `json:"fee,omitempty"`
+	At         time.Time     `json:"at"`
+}
+
+func (e *exchanged) kind() string { return "exchange" }
+
+func (e *exchanged) apply(b *Bank) error {
+	from, err := b.storage.GetAccount(e.From)
+	if err != nil {
+		return err
+	}
+	to, err := b.storage.GetAccount(e.To)
+	if err != nil {
+		return err
+	}
+
+	tx := newExchangeTransaction(e.TxID, from, to, e.Amount, e.Conversion, e.At)
+	return b.applyWithFee(tx, e.Fee, from, to, e.At)
+}
+
+type holdPlaced struct {
+	Hold Hold `json:"hold"`
+}
+
+func (e *holdPlaced) kind() string { return "hold_placed" }
+
+func (e *holdPlaced) apply(b *Bank) error {
+	if err := b.storage.SaveHold(e.Hold, nil); err != nil {
+		return err
+	}
+
+	b.holds.put(e.Hold)
+	return nil
+}
+
+type holdCaptured struct {
+	HoldID uuid.UUID  `json:"hold_id"`
+	TxID   uuid.UUID  `json:"tx_id"`
+	To     uuid.UUID  `json:"to"`
+	Amount int64      `json:"amount"`
+	Fee    *feeCharge `json:"fee,omitempty"`
+	At     time.Time  `json:"at"`
+}
+
+func (e *holdCaptured) kind() string { return "hold_captured" }
+
+func (e *holdCaptured) apply(b *Bank) error {
+	h, ok := b.holds.get(e.HoldID)
+	if !ok {
+		return ErrHoldNotFound
+	}
+	from, err := b.storage.GetAccount(h.AccountID)
+	if err != nil {
+		return err
+	}
+	to, err := b.storage.GetAccount(e.To)
+	if err != nil {
+		return err
+	}
+
+	tx := newTransaction(e.TxID, KindCapture, from.currency, from.id, to.id, e.Amount, from.balance-e.Amount, to.balance+e.Amount, e.At)
+	h.Status = HoldCaptured
+	h.Captured = e.Amount
+	h.TxID = e.TxID
+	h.UpdatedAt = e.At
+
+	txs, err := b.withFee(tx, e.Fee, from, to, e.At)
+	if err != nil {
+		return err
+	}
+
+	// the hold, the transfer and its fee are stored together
+	if err := b.storage.SaveHold(h, txs); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		b.ledger.record(tx)
+	}
+	b.holds.put(h)
+	return nil
+}
+
+type holdReleased struct {
+	HoldID uuid.UUID `json:"hold_id"`
+	At     time.Time `json:"at"`
+}
+
+func (e *holdReleased) kind() string { return "hold_released" }
+
+func (e *holdReleased) apply(b *Bank) error {
+	h, ok := b.holds.get(e.HoldID)
+	if !ok {
+		return ErrHoldNotFound
+	}
+
+	h.Status = HoldReleased
+	h.UpdatedAt = e.At
+	if err := b.storage.SaveHold(h, nil); err != nil {
+		return err
+	}
+
+	b.holds.put(h)
+	return nil
+}
+
+type reversed struct {
+	TxID     uuid.UUID `json:"tx_id"`
+	Original uuid.UUID `json:"original"`
+	Amount   int64     `json:"amount"`
+	At       time.Time `json:"at"`
+}
+
+func (e *reversed) kind() string { return "reversal" }
+
+func (e *reversed) apply(b *Bank) error {
+	orig, ok := b.ledger.Transaction(e.Original)
+	if !ok {
+		return ErrTransferNotFound
+	}
+	from, err := b.storage.GetAccount(orig.To)
+	if err != nil {
+		return err
+	}
+	to, err := b.storage.GetAccount(orig.From)
+	if err != nil {
+		return err
+	}
+
+	tx := newTransaction(e.TxID, KindReversal, orig.Currency, from.id, to.id, e.Amount, from.balance-e.Amount, to.balance+e.Amount, e.At)
+	tx.Reverses = e.Original
+	if err := b.storage.ApplyTransfer(tx); err != nil {
+		return err
+	}
+
+	b.ledger.record(tx)
+	return nil
+}
+
+// statusChanged closes the account with a sweep of its balance if the
+// change has a sweep account, and cancels scheduled transfers of it
+type statusChanged struct {
+	Change StatusChange `json:"change"`
+}
+
+func (e *statusChanged) kind() string { return "status_changed" }
+
+func (e *statusChanged) apply(b *Bank) error {
+	ch := e.Change
+
+	var sweep *Transaction
+	if ch.SweepTo != uuid.Nil {
+		from, err := b.storage.GetAccount(ch.AccountID)
+		if err != nil {
+			return err
+		}
+		to, err := b.storage.GetAccount(ch.SweepTo)
+		if err != nil {
+			return err
+		}
+
+		tx := newTransaction(ch.TxID, KindClosing, from.currency, from.id, to.id, from.balance, 0, to.balance+from.balance, ch.At)
+		sweep = &tx
+	}
+
+	if err := b.storage.ChangeStatus(ch, sweep); err != nil {
+		return err
+	}
+
+	if sweep != nil {
+		b.ledger.record(*sweep)
+	}
+	b.statuses.add(ch)
+	for _, id := range ch.Cancelled {
+		if s, ok := b.schedules.get(id); ok {
+			b.schedules.put(s.cancelled(ch.At))
+		}
+	}
+	return nil
+}
+
+// batchTransferred applies all legs of the batch at once
+type batchTransferred struct {
+	Legs []batchLeg `json:"legs"`
+	At   time.Time  `json:"at"`
+}
+
+func (e *batchTransferred) kind() string { return "batch" }
+
+func (e *batchTransferred) apply(b *Bank) error {
+	accounts := make(map[uuid.UUID]*Account)
+	account := func(id uuid.UUID) (*Account, error) {
+		if ac, ok := accounts[id]; ok {
+			return ac, nil
+		}
+		ac, err := b.storage.GetAccount(id)
+		if err != nil {
+			return nil, err
+		}
+		accounts[id] = &ac
+		return &ac, nil
+	}
+
+	txs := make([]Transaction, 0, len(e.Legs))
+	for _, l := range e.Legs {
+		from, err := account(l.From)
+		if err != nil {
+			return err
+		}
+		to, err := account(l.To)
+		if err != nil {
+			return err
+		}
+
+		tx := newBatchTransaction(l, *from, *to, e.At)
+		txs = append(txs, tx)
+		if l.Fee != nil {
+			feeAccount, err := account(l.Fee.Account)
+			if err != nil {
+				return err
+			}
+			// the fee account is in the sender currency, it can only be
+			// the recipient of a plain leg
+			balance := feeAccount.balance
+			if feeAccount == to {
+				balance += l.Amount
+			}
+			txs = append(txs, newFeeTransaction(*l.Fee, tx.ID, from.currency, from.id, from.balance-l.Amount, balance, e.At))
+		}
+		applyBatchLeg(accounts, l)
+	}
+
+	if err := b.storage.ApplyBatch(txs); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		b.ledger.record(tx)
+	}
+	return nil
+}
+
+type scheduleCreated struct {
+	Schedule ScheduledTransfer `json:"schedule"`
+}
+
+func (e *scheduleCreated) kind() string { return "schedule_created" }
+
+func (e *scheduleCreated) apply(b *Bank) error {
+	if err := b.storage.SaveScheduledTransfer(e.Schedule, nil, nil); err != nil {
+		return err
+	}
+
+	b.schedules.put(e.Schedule)
+	return nil
+}
+
+// scheduleRan stores the run together with its transfer and the fee of
+// it, if it was successful, and the schedule as it is after the run
+type scheduleRan struct {
+	Schedule ScheduledTransfer `json:"schedule"`
+	Run      ScheduledRun      `json:"run"`
+	Fee      *feeCharge        `json:"fee,omitempty"`
+}
+
+func (e *scheduleRan) kind() string { return "schedule_ran" }
+
+func (e *scheduleRan) apply(b *Bank) error {
+	var txs []Transaction
+	if e.Run.TxID != uuid.Nil {
+		from, err := b.storage.GetAccount(e.Schedule.From)
+		if err != nil {
+			return err
+		}
+		to, err := b.storage.GetAccount(e.Schedule.To)
+		if err != nil {
+			return err
+		}
+
+		amount := e.Schedule.Amount
+		tx := newTransaction(e.Run.TxID, KindTransfer, from.currency, from.id, to.id, amount, from.balance-amount, to.balance+amount, e.Run.At)
+		if txs, err = b.withFee(tx, e.Fee, from, to, e.Run.At); err != nil {
+			return err
+		}
+	}
+
+	if err := b.storage.SaveScheduledTransfer(e.Schedule, &e.Run, txs); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		b.ledger.record(tx)
+	}
+	b.schedules.put(e.Schedule)
+	b.schedules.addRun(e.Run)
+	return nil
+}
+
+type scheduleCancelled struct {
+	ID uuid.UUID `json:"id"`
+	At time.Time `json:"at"`
+}
+
+func (e *scheduleCancelled) kind() string { return "schedule_cancelled" }
+
+func (e *scheduleCancelled) apply(b *Bank) error {
+	s, ok := b.schedules.get(e.ID)
+	if !ok {
+		return ErrScheduleNotFound
+	}
+
+	s = s.cancelled(e.At)
+	if err := b.storage.SaveScheduledTransfer(s, nil, nil); err != nil {
+		return err
+	}
+
+	b.schedules.put(s)
+	return nil
+}
+
+type overdraftChanged struct {
+	AccountID uuid.UUID `json:"account_id"`
+	Limit     int64     `json:"limit"`
+	At        time.Time `json:"at"`
+}
+
+func (e *overdraftChanged) kind() string { return "overdraft_changed" }
+
+func (e *overdraftChanged) apply(b *Bank) error {
+	return b.storage.SetOverdraftLimit(e.AccountID, e.Limit, e.At)
+}
+
+type limitsChanged struct {
+	AccountID uuid.UUID      `json:"account_id"`
+	Limits    SpendingLimits `json:"limits"`
+	At        time.Time      `json:"at"`
+}
+
+func (e *limitsChanged) kind() string { return "limits_changed" }
+
+func (e *limitsChanged) apply(b *Bank) error {
+	return b.storage.SetSpendingLimits(e.AccountID, e.Limits, e.At)
+}
+
+type interestProductSet struct {
+	Name  string        `json:"name"`
+	Rates InterestRates `json:"rates"`
+}
+
+func (e *interestProductSet) kind() string { return "interest_product" }
+
+func (e *interestProductSet) apply(b *Bank) error {
+	return b.updateInterest(func(st *InterestState) {
+		st.Products[e.Name] = e.Rates
+	}, nil)
+}
+
+type interestSourceSet struct {
+	Currency  string    `json:"currency"`
+	AccountID uuid.UUID `json:"account_id"`
+}
+
+func (e *interestSourceSet) kind() string { return "interest_source" }
+
+func (e *interestSourceSet) apply(b *Bank) error {
+	return b.updateInterest(func(st *InterestState) {
+		st.Sources[e.Currency] = e.AccountID
+	}, nil)
+}
+
+type accountInterestSet struct {
+	AccountID uuid.UUID       `json:"account_id"`
+	Interest  AccountInterest `json:"interest"`
+}
+
+func (e *accountInterestSet) kind() string { return "account_interest" }
+
+func (e *accountInterestSet) apply(b *Bank) error {
+	return b.updateInterest(func(st *InterestState) {
+		if e.Interest == (AccountInterest{}) {
+			delete(st.Accounts, e.AccountID)
+			return
+		}
+		st.Accounts[e.AccountID] = e.Interest
+	}, nil)
+}
+
+// interestAccrued adds interest of the days up to Through, computed when
+// the event is built from the balances of those days
+type interestAccrued struct {
+	Through time.Time            `json:"through"`
+	Accrued map[uuid.UUID]string `json:"accrued,omitempty"`
+}
+
+func (e *interestAccrued) kind() string { return "interest_accrued" }
+
+func (e *interestAccrued) apply(b *Bank) error {
+	accrued := make(map[uuid.UUID]*big.Rat, len(e.Accrued))
+	for id, s := range e.Accrued {
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return errors.New("invalid accrued interest " + s)
+		}
+		accrued[id] = r
+	}
+
+	return b.updateInterest(func(st *InterestState) {
+		for id, r := range accrued {
+			st.addAccrued(id, r)
+		}
+		st.Through = e.Through
+	}, nil)
+}
+
+// interestPosted moves accrued interest to the accounts, postings are
+// applied in order like legs of a batch. At is the month boundary settled,
+// postings made before At was stored are made at it.
+type interestPosted struct {
+	Postings []interestPosting `json:"postings"`
+	At       time.Time         `json:"at"`
+}
+
+func (e *interestPosted) kind() string { return "interest_posted" }
+
+func (e *interestPosted) apply(b *Bank) error {
+	accounts := make(map[uuid.UUID]*Account)
+	account := func(id uuid.UUID) (*Account, error) {
+		if ac, ok := accounts[id]; ok {
+			return ac, nil
+		}
+		ac, err := b.storage.GetAccount(id)
+		if err != nil {
+			return nil, err
+		}
+		accounts[id] = &ac
+		return &ac, nil
+	}
+
+	txs := make([]Transaction, 0, len(e.Postings))
+	for _, p := range e.Postings {
+		from, err := account(p.From)
+		if err != nil {
+			return err
+		}
+		to, err := account(p.To)
+		if err != nil {
+			return err
+		}
+
+		at := p.At
+		if at.IsZero() {
+			at = e.At
+		}
+		txs = append(txs, newTransaction(p.TxID, KindInterest, from.currency, from.id, to.id, p.Amount, from.balance-p.Amount, to.balance+p.Amount, at))
+		from.balance -= p.Amount
+		to.balance += p.Amount
+	}
+
+	return b.updateInterest(func(st *InterestState) {
+		for _, p := range e.Postings {
+			amount := p.Amount
+			if p.From == p.AccountID {
+				amount = -amount
+			}
+			st.addAccrued(p.AccountID, new(big.Rat).SetInt64(-amount))
+		}
+	}, txs)
+}
+
+// eventAborted marks the logged event Seq which failed to apply, replay
+// skips it
+type eventAborted struct {
+	Seq uint64 `json:"seq"`
+}
+
+func (e *eventAborted) kind() string { return "aborted" }
+
+func (e *eventAborted) apply(b *Bank) error { return nil }
@@ -0,0 +1,281 @@
+package bank
+
+import (
+	"errors"
+	"github.com/JohnCGriffin/overflow"
+	"github.com/google/uuid"
+	"simple_bank/models/fees"
+	"simple_bank/models/fx"
+	"time"
+)
+
+// TransferResult is a transfer made together with its fee, FeeTxID is nil
+// for free transfers. Fee is in Currency, the sender currency.
+type TransferResult struct {
+	TxID     uuid.UUID
+	FeeTxID  uuid.UUID
+	Fee      int64
+	Currency string
+}
+
+// Quote tells what a transfer would cost the sender: Amount and Fee in
+// Currency, Total of both. Credit is what the recipient gets in
+// CreditCurrency, converted for exchanges.
+type Quote struct {
+	Amount         int64
+	Fee            int64
+	Total          int64
+	Currency       string
+	Credit         int64
+	CreditCurrency string
+}
+
+// feeCharge is the fee paid with a transfer to the fee account
+type feeCharge struct {
+	TxID    uuid.UUID `json:"tx_id"`
+	Account uuid.UUID `json:"account"`
+	Amount  int64     `json:"amount"`
+}
+
+// SetFees sets the fee schedule charged on transfers and exchanges
+func (b *Bank) SetFees(f *fees.Fees) {
+	b.fees = f
+}
+
+func (b *Bank) Fees() *fees.Fees {
+	return b.fees
+}
+
+func (b *Bank) feeSchedule() *fees.Schedule {
+	if b.fees == nil {
+		return nil
+	}
+	return b.fees.Schedule()
+}
+
+// TransferWithFee moves amount between the accounts and charges the fee of
+// the schedule to the sender at once. Accounts in different currencies
+// must ask for conversion.
+func (b *Bank) TransferWithFee(from uuid.UUID, to uuid.UUID, amount int64, convert bool) (TransferResult, error) {
+	res, err := b.transferWithFee(from, to, amount, convert)
+	observeTransfer(err)
+	return res, err
+}
+
+func (b *Bank) transferWithFee(from uuid.UUID, to uuid.UUID, amount int64, convert bool) (TransferResult, error) {
+	if err := checkTransferArgs(from, to, amount); err != nil {
+		return TransferResult{}, err
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	s := b.feeSchedule()
+	unlock := b.locks.lock(from, to)
+	defer unlock()
+
+	fromAccount, toAccount, err := b.getTransferAccounts(from, to)
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	at := now()
+	conv, fee, err := b.checkTransferWithFee(s, fromAccount, toAccount, amount, convert, at, Spending{}, nil)
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	txID := uuid.New()
+	if conv != nil {
+		err = b.commit(&exchanged{TxID: txID, From: from, To: to, Amount: amount, Conversion: *conv, Fee: fee, At: at})
+	} else {
+		err = b.commit(&transferred{TxID: txID, From: from, To: to, Amount: amount, Fee: fee, At: at})
+	}
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	res := TransferResult{TxID: txID, Currency: fromAccount.currency}
+	if fee != nil {
+		res.FeeTxID, res.Fee = fee.TxID, fee.Amount
+	}
+	return res, nil
+}
+
+// QuoteTransfer validates the transfer as TransferWithFee would make it
+// now, without moving money
+func (b *Bank) QuoteTransfer(from uuid.UUID, to uuid.UUID, amount int64, convert bool) (Quote, error) {
+	if err := checkTransferArgs(from, to, amount); err != nil {
+		return Quote{}, err
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	s := b.feeSchedule()
+	unlock := b.locks.lock(from, to)
+	defer unlock()
+
+	fromAccount, toAccount, err := b.getTransferAccounts(from, to)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	conv, fee, err := b.checkTransferWithFee(s, fromAccount, toAccount, amount, convert, now(), Spending{}, nil)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	q := Quote{
+		Amount:         amount,
+		Total:          amount,
+		Currency:       fromAccount.currency,
+		Credit:         amount,
+		CreditCurrency: toAccount.currency,
+	}
+	if fee != nil {
+		q.Fee = fee.Amount
+		q.Total += fee.Amount
+	}
+	if conv != nil {
+		q.Credit = conv.Amount
+	}
+	return q, nil
+}
+
+func checkTransferArgs(from uuid.UUID, to uuid.UUID, amount int64) error {
+	if from == to {
+		return errors.New("accounts must be different")
+	}
+	if amount <= 0 {
+		return errors.New("can not be zero or negative transfer")
+	}
+	return nil
+}
+
+// checkTransferWithFee validates the transfer and its fee, no fee is
+// returned for free transfers. The sender must afford both. pending is
+// spent by transfers not recorded yet and changed has accounts as earlier
+// legs of a batch leave them, both are empty outside of batches.
+func (b *Bank) checkTransferWithFee(s *fees.Schedule, from Account, to Account, amount int64, convert bool, at time.Time, pending Spending, changed map[uuid.UUID]*Account) (*fx.Conversion, *feeCharge, error) {
+	conv, err := b.checkTransfer(from, to, amount, convert, at, pending)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fee, err := b.checkFee(s, from, to, amount, b.headroom(from, at), changed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conv, fee, nil
+}
+
+// checkFee works out the fee of sending amount, nil for free transfers.
+// headroom is what the sender can spend, it must cover the fee too. The
+// fee account is not locked: it is a sink which fees only add to, and
+// commit applies them one at a time, so transfers paying fees do not queue
+// on its lock.
+func (b *Bank) checkFee(s *fees.Schedule, from Account, to Account, amount int64, headroom int64, changed map[uuid.UUID]*Account) (*feeCharge, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	fee, id, err := s.Fee(amount, from.currency)
+	if err != nil {
+		return nil, err
+	}
+	// the fee account pays no fees to itself
+	if fee == 0 || id == from.id {
+		return nil, nil
+	}
+
+	feeAccount, err := b.storage.GetAccount(id)
+	if err == ErrAccountNotFound {
+		return nil, errors.New("fee account not found")
+	} else if err != nil {
+		return nil, err
+	}
+	if ac, ok := changed[id]; ok {
+		feeAccount = *ac
+	}
+	if feeAccount.currency != from.currency {
+		return nil, errors.New("fee account is in another currency")
+	}
+	if err := feeAccount.canCredit(); err != nil {
+		return nil, err
+	}
+
+	total, ok := overflow.Add64(amount, fee)
+	if !ok || headroom < total {
+		return nil, ErrFeeNotCovered
+	}
+	if _, ok := overflow.Sub64(from.balance, total); !ok {
+		return nil, errors.New("overflow of from balance")
+	}
+
+	balance := feeAccount.balance
+	if id == to.id {
+		balance += amount
+	}
+	if _, ok := overflow.Add64(balance, fee); !ok {
+		return nil, errors.New("overflow of fee account balance")
+	}
+
+	return &feeCharge{TxID: uuid.New(), Account: id, Amount: fee}, nil
+}
+
+// newFeeTransaction builds the transaction of the fee charged for the
+// transfer forTx, balances are those of the sender and the fee account
+// before the fee
+func newFeeTransaction(f feeCharge, forTx uuid.UUID, cur string, from uuid.UUID, fromBalance int64, feeBalance int64, at time.Time) Transaction {
+	fee := newTransaction(f.TxID, KindFee, cur, from, f.Account, f.Amount, fromBalance-f.Amount, feeBalance+f.Amount, at)
+	fee.FeeFor = forTx
+	return fee
+}
+
+// withFee returns tx followed by the transaction of its fee, if there is
+// one. from and to are the accounts as they are before tx. The fee account
+// is in the sender currency, so it can be the recipient of plain transfers
+// only.
+func (b *Bank) withFee(tx Transaction, f *feeCharge, from Account, to Account, at time.Time) ([]Transaction, error) {
+	if f == nil {
+		return []Transaction{tx}, nil
+	}
+
+	balance := to.balance + tx.Amount
+	if f.Account != to.id {
+		ac, err := b.storage.GetAccount(f.Account)
+		if err != nil {
+			return nil, err
+		}
+		balance = ac.balance
+	}
+
+	fee := newFeeTransaction(*f, tx.ID, from.currency, from.id, from.balance-tx.Amount, balance, at)
+	return []Transaction{tx, fee}, nil
+}
+
+// applyWithFee stores the transfer together with its fee, if there is one
+func (b *Bank) applyWithFee(tx Transaction, f *feeCharge, from Account, to Account, at time.Time) error {
+	if f == nil {
+		if err := b.storage.ApplyTransfer(tx); err != nil {
+			return err
+		}
+
+		b.ledger.record(tx)
+		return nil
+	}
+
+	txs, err := b.withFee(tx, f, from, to, at)
+	if err != nil {
+		return err
+	}
+	if err := b.storage.ApplyBatch(txs); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		b.ledger.record(tx)
+	}
+	return nil
+}
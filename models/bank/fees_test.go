@@ -0,0 +1,179 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"simple_bank/models/clock"
+	"simple_bank/models/fees"
+	"testing"
+	"time"
+)
+
+func testFees(t *testing.T, schedule string) *fees.Fees {
+	dir, err := ioutil.TempDir("", "fees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fees.json")
+	if err := ioutil.WriteFile(path, []byte(schedule), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fees.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func flatFee(account uuid.UUID, amount string) string {
+	return `{"accounts": {"RUB": "` + account.String() + `"}, "fees": {"RUB": {"type": "flat", "amount": ` + amount + `}}}`
+}
+
+func TestBank_TransferWithFee(t *testing.T) {
+	b := NewBank()
+	feeAccount, _ := b.CreateAccount(0)
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+
+	// free without a schedule
+	res, err := b.TransferWithFee(a1, a2, 100, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), res.Fee)
+	assert.Equal(t, uuid.Nil, res.FeeTxID)
+
+	b.SetFees(testFees(t, flatFee(feeAccount, "25")))
+
+	q, err := b.QuoteTransfer(a1, a2, 100, false)
+	assert.Nil(t, err)
+	assert.Equal(t, Quote{Amount: 100, Fee: 25, Total: 125, Currency: "RUB", Credit: 100, CreditCurrency: "RUB"}, q)
+	balance, _ := b.GetAccountBalance(a1)
+	assert.Equal(t, "900", balance)
+
+	res, err = b.TransferWithFee(a1, a2, 100, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(25), res.Fee)
+
+	fee, ok := b.Ledger().Transaction(res.FeeTxID)
+	assert.True(t, ok)
+	assert.Equal(t, KindFee, fee.Kind)
+	assert.Equal(t, res.TxID, fee.FeeFor)
+	assert.Equal(t, feeAccount, fee.To)
+
+	ac, _ := b.GetAccount(a1)
+	assert.Equal(t, int64(775), ac.Balance())
+	ac, _ = b.GetAccount(feeAccount)
+	assert.Equal(t, int64(25), ac.Balance())
+	assert.Equal(t, int64(25), b.Ledger().Balance(feeAccount))
+
+	// the sender must afford the fee too, nothing is moved otherwise
+	_, err = b.Transfer(a1, a2, 760)
+	assert.NotNil(t, err)
+	_, err = b.QuoteTransfer(a1, a2, 760, false)
+	assert.NotNil(t, err)
+	_, err = b.Transfer(a1, a2, 750)
+	assert.Nil(t, err)
+	ac, _ = b.GetAccount(a1)
+	assert.Equal(t, int64(0), ac.Balance())
+
+	// paying to the fee account charges the fee once more
+	_, err = b.Transfer(a2, feeAccount, 100)
+	assert.Nil(t, err)
+	ac, _ = b.GetAccount(feeAccount)
+	assert.Equal(t, int64(175), ac.Balance())
+
+	// the fee account pays no fees
+	_, err = b.Transfer(feeAccount, a1, 175)
+	assert.Nil(t, err)
+	ac, _ = b.GetAccount(a1)
+	assert.Equal(t, int64(175), ac.Balance())
+
+	// fee account must be there
+	b.SetFees(testFees(t, flatFee(uuid.New(), "1")))
+	_, err = b.Transfer(a1, a2, 10)
+	assert.NotNil(t, err)
+}
+
+func TestBank_TransferWithFeePersisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	feeAccount, _ := b.CreateAccount(0)
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	b.SetFees(testFees(t, flatFee(feeAccount, "10")))
+	res, err := b.TransferWithFee(a1, a2, 100, false)
+	assert.Nil(t, err)
+	// the fee account is the recipient of a leg
+	_, err = b.TransferBatch([]TransferLeg{{From: a1, To: a2, Amount: 100}, {From: a2, To: feeAccount, Amount: 50}})
+	assert.Nil(t, err)
+	txs := b.Ledger().Transactions()
+	assert.Nil(t, b.wal.close())
+
+	// the fee is replayed from the WAL without the schedule
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	ac, _ := b.GetAccount(a1)
+	assert.Equal(t, int64(780), ac.Balance())
+	ac, _ = b.GetAccount(feeAccount)
+	assert.Equal(t, int64(80), ac.Balance())
+	assert.Equal(t, int64(80), b.Ledger().Balance(feeAccount))
+	_, ok := b.Ledger().Transaction(res.FeeTxID)
+	assert.True(t, ok)
+	assert.Equal(t, txs, b.Ledger().Transactions())
+	assert.Nil(t, b.Close())
+}
+
+func TestBank_FeesOnEveryTransfer(t *testing.T) {
+	b := NewBank()
+	feeAccount, _ := b.CreateAccount(0)
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	b.SetFees(testFees(t, flatFee(feeAccount, "25")))
+
+	feeOf := func(txID uuid.UUID) int64 {
+		for _, tx := range b.Ledger().Transactions() {
+			if tx.Kind == KindFee && tx.FeeFor == txID {
+				return tx.Amount
+			}
+		}
+		return 0
+	}
+
+	// a batch leg pays what the quote tells
+	q, err := b.QuoteTransfer(a1, a2, 100, false)
+	assert.Nil(t, err)
+	ids, err := b.TransferBatch([]TransferLeg{{From: a1, To: a2, Amount: 100}})
+	assert.Nil(t, err)
+	assert.Equal(t, q.Fee, feeOf(ids[0]))
+	_, err = b.TransferBatch([]TransferLeg{{From: a1, To: a2, Amount: 860}})
+	assert.Equal(t, ErrFeeNotCovered, err.(*BatchError).Legs[0])
+
+	h, _ := b.PlaceHold(a1, 100, 0)
+	txID, err := b.CaptureHold(h.ID, a2, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(25), feeOf(txID))
+
+	start := time.Date(2119, time.March, 1, 8, 0, 0, 0, time.UTC)
+	c := clock.NewManual(start)
+	s, err := b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 100, StartAt: start})
+	assert.Nil(t, err)
+	_, err = NewScheduler(b, c).RunDue()
+	assert.Nil(t, err)
+	runs, _ := b.ScheduledRuns(s.ID)
+	if assert.Len(t, runs, 1) {
+		assert.Equal(t, int64(25), feeOf(runs[0].TxID))
+	}
+
+	ac, _ := b.GetAccount(a1)
+	assert.Equal(t, int64(1000-3*125), ac.Balance())
+	ac, _ = b.GetAccount(feeAccount)
+	assert.Equal(t, int64(75), ac.Balance())
+	assert.Equal(t, int64(75), b.Ledger().Balance(feeAccount))
+}
@@ -0,0 +1,611 @@
+package bank
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// FileStorage keeps accounts and transactions in a single append-only
+// file. Every change is written as one checksummed record, so a transfer
+// is stored atomically or not at all. Outdated account records are
+// compacted away when the file is opened. Transactions are not kept in
+// memory, the ledger has them, they are read from the file when the bank
+// is rebuilt. The file keeps all of them, it is the only history the
+// ledger can be rebuilt from.
+type FileStorage struct {
+	log         *logFile
+	path        string
+	accounts    map[uuid.UUID]*Account
+	idempotency map[string]IdempotencyRecord
+	holds       map[uuid.UUID]Hold
+	statuses    []StatusChange
+	schedules   map[uuid.UUID]ScheduledTransfer
+	runs        []ScheduledRun
+	interest    *InterestState
+	mu          *sync.RWMutex
+
+	// idempotencySwept is the number of records kept by the last sweep
+	idempotencySwept int
+}
+
+// fileRecord holds states of the accounts after the change and the
+// transaction that caused it, if any, or an idempotency record. A hold is
+// stored alone or with its capture transaction and fee, a status change
+// with the sweep transaction of a closed account, a scheduled transfer with
+// its run and the transfer made by it and its fee, the interest state with
+// the interest posted.
+type fileRecord struct {
+	Accounts    []accountState     `json:"accounts,omitempty"`
+	Transaction *Transaction       `json:"transaction,omitempty"`
+	Idempotency *IdempotencyRecord `json:"idempotency,omitempty"`
+	Hold        *Hold              `json:"hold,omitempty"`
+	Status      *StatusChange      `json:"status,omitempty"`
+	Schedule    *ScheduledTransfer `json:"schedule,omitempty"`
+	Run         *ScheduledRun      `json:"run,omitempty"`
+	Interest    *InterestState     `json:"interest,omitempty"`
+	// Batch is a list of transactions stored at once
+	Batch []Transaction `json:"batch,omitempty"`
+}
+
+func OpenFileStorage(path string) (*FileStorage, error) {
+	s := &FileStorage{
+		path:        path,
+		accounts:    make(map[uuid.UUID]*Account),
+		idempotency: make(map[string]IdempotencyRecord),
+		holds:       make(map[uuid.UUID]Hold),
+		schedules:   make(map[uuid.UUID]ScheduledTransfer),
+		mu:          &sync.RWMutex{},
+	}
+
+	log, bodies, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// transactions are only needed if the file is compacted
+	var txs []Transaction
+	writes, at := 0, now()
+	for _, body := range bodies {
+		var rec fileRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			log.close()
+			return nil, err
+		}
+
+		for _, st := range rec.Accounts {
+			ac := st.account()
+			s.accounts[st.ID] = &ac
+			writes++
+		}
+		if rec.Transaction != nil {
+			txs = append(txs, *rec.Transaction)
+		}
+		txs = append(txs, rec.Batch...)
+		if rec.Idempotency != nil {
+			writes++
+			if !rec.Idempotency.expired(at) {
+				s.idempotency[rec.Idempotency.Key] = *rec.Idempotency
+			}
+		}
+		if rec.Hold != nil {
+			s.holds[rec.Hold.ID] = *rec.Hold
+			writes++
+		}
+		if rec.Status != nil {
+			s.statuses = append(s.statuses, *rec.Status)
+			s.cancelSchedules(*rec.Status)
+		}
+		if rec.Schedule != nil {
+			s.schedules[rec.Schedule.ID] = *rec.Schedule
+			writes++
+		}
+		if rec.Run != nil {
+			s.runs = append(s.runs, *rec.Run)
+		}
+		if rec.Interest != nil {
+			s.interest = rec.Interest
+			writes++
+		}
+	}
+	s.log = log
+
+	kept := len(s.accounts) + len(s.idempotency) + len(s.holds) + len(s.schedules)
+	if s.interest != nil {
+		kept++
+	}
+	if writes > 2*kept {
+		if err := s.compact(txs); err != nil {
+			log.close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// compact rewrites the file with the latest state of every account and
+// the transactions, expired idempotency records are dropped
+func (s *FileStorage) compact(txs []Transaction) error {
+	var data []byte
+
+	for _, ac := range s.accounts {
+		body, err := json.Marshal(fileRecord{Accounts: []accountState{ac.state()}})
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeLine(body)...)
+	}
+	for i := range txs {
+		body, err := json.Marshal(fileRecord{Transaction: &txs[i]})
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeLine(body)...)
+	}
+	for _, rec := range s.idempotency {
+		rec := rec
+		body, err := json.Marshal(fileRecord{Idempotency: &rec})
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeLine(body)...)
+	}
+	for _, h := range s.holds {
+		h := h
+		body, err := json.Marshal(fileRecord{Hold: &h})
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeLine(body)...)
+	}
+	for i := range s.statuses {
+		body, err := json.Marshal(fileRecord{Status: &s.statuses[i]})
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeLine(body)...)
+	}
+	for _, st := range s.schedules {
+		st := st
+		body, err := json.Marshal(fileRecord{Schedule: &st})
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeLine(body)...)
+	}
+	for i := range s.runs {
+		body, err := json.Marshal(fileRecord{Run: &s.runs[i]})
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeLine(body)...)
+	}
+	if s.interest != nil {
+		body, err := json.Marshal(fileRecord{Interest: s.interest})
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeLine(body)...)
+	}
+
+	if err := s.log.close(); err != nil {
+		return err
+	}
+	if err := writeFileSync(s.path, data); err != nil {
+		return err
+	}
+
+	log, _, err := openLogFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.log = log
+	return nil
+}
+
+func (s *FileStorage) write(rec fileRecord) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.log.append(body)
+}
+
+func (s *FileStorage) CreateAccount(ac Account, opening *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[ac.id]; ok {
+		return errors.New("account already exists")
+	}
+
+	if err := s.write(fileRecord{Accounts: []accountState{ac.state()}, Transaction: opening}); err != nil {
+		return err
+	}
+
+	s.accounts[ac.id] = &ac
+	return nil
+}
+
+func (s *FileStorage) GetAccount(id uuid.UUID) (Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ac, ok := s.accounts[id]
+	if !ok {
+		return Account{}, ErrAccountNotFound
+	}
+	return *ac, nil
+}
+
+func (s *FileStorage) ApplyTransfer(tx Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, err := s.transferRecord(tx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.write(rec); err != nil {
+		return err
+	}
+
+	applyPostings(s.accounts, tx)
+	return nil
+}
+
+func (s *FileStorage) ApplyBatch(txs []Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, err := s.batchRecord(txs)
+	if err != nil {
+		return err
+	}
+
+	if err := s.write(rec); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		applyPostings(s.accounts, tx)
+	}
+	return nil
+}
+
+// batchRecord holds the transactions and the accounts they touch as they
+// are after all of them
+func (s *FileStorage) batchRecord(txs []Transaction) (fileRecord, error) {
+	// later states of an account replace earlier ones on reopen, so every
+	// account is stored as it is after the whole batch
+	rec := fileRecord{Batch: txs}
+	last := make(map[uuid.UUID]int)
+	for _, tx := range txs {
+		txRec, err := s.transferRecord(tx)
+		if err != nil {
+			return fileRecord{}, err
+		}
+		for _, st := range txRec.Accounts {
+			if i, ok := last[st.ID]; ok {
+				rec.Accounts[i] = st
+				continue
+			}
+			last[st.ID] = len(rec.Accounts)
+			rec.Accounts = append(rec.Accounts, st)
+		}
+	}
+	return rec, nil
+}
+
+// transferRecord holds the transaction and the accounts it touches as they
+// are after it
+func (s *FileStorage) transferRecord(tx Transaction) (fileRecord, error) {
+	rec := fileRecord{Transaction: &tx}
+	for _, p := range tx.Postings {
+		if p.AccountID == SystemAccountID {
+			continue
+		}
+
+		ac, ok := s.accounts[p.AccountID]
+		if !ok {
+			return fileRecord{}, ErrAccountNotFound
+		}
+
+		updated := *ac
+		updated.balance = p.Balance
+		updated.updatedAt = tx.CreatedAt
+		rec.Accounts = append(rec.Accounts, updated.state())
+	}
+	return rec, nil
+}
+
+func (s *FileStorage) ListAccounts() ([]Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Account, 0, len(s.accounts))
+	for _, ac := range s.accounts {
+		res = append(res, *ac)
+	}
+	return res, nil
+}
+
+func (s *FileStorage) Transactions() ([]Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bodies, err := readLogFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Transaction
+	for _, body := range bodies {
+		var rec fileRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			return nil, err
+		}
+		if rec.Transaction != nil {
+			res = append(res, *rec.Transaction)
+		}
+		res = append(res, rec.Batch...)
+	}
+	return res, nil
+}
+
+func (s *FileStorage) SaveIdempotencyRecord(rec IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write(fileRecord{Idempotency: &rec}); err != nil {
+		return err
+	}
+
+	// expired records are dropped as the bank index drops them, compaction
+	// leaves them out of the file
+	at := now()
+	if rec.expired(at) {
+		delete(s.idempotency, rec.Key)
+		return nil
+	}
+	s.idempotency[rec.Key] = rec
+	if len(s.idempotency) > 2*s.idempotencySwept {
+		for key, rec := range s.idempotency {
+			if rec.expired(at) {
+				delete(s.idempotency, key)
+			}
+		}
+		s.idempotencySwept = len(s.idempotency)
+	}
+	return nil
+}
+
+func (s *FileStorage) IdempotencyRecords() ([]IdempotencyRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]IdempotencyRecord, 0, len(s.idempotency))
+	at := now()
+	for _, rec := range s.idempotency {
+		if !rec.expired(at) {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+func (s *FileStorage) SaveHold(h Hold, txs []Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, err := s.batchRecord(txs)
+	if err != nil {
+		return err
+	}
+	rec.Hold = &h
+
+	if err := s.write(rec); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		applyPostings(s.accounts, tx)
+	}
+	s.holds[h.ID] = h
+	return nil
+}
+
+func (s *FileStorage) Holds() ([]Hold, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Hold, 0, len(s.holds))
+	for _, h := range s.holds {
+		res = append(res, h)
+	}
+	return res, nil
+}
+
+func (s *FileStorage) ChangeStatus(ch StatusChange, sweep *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rec fileRecord
+	if sweep != nil {
+		var err error
+		if rec, err = s.transferRecord(*sweep); err != nil {
+			return err
+		}
+	}
+
+	ac, ok := s.accounts[ch.AccountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	// the sweep has already set the balance of the closed account
+	updated := *ac
+	for _, st := range rec.Accounts {
+		if st.ID == ch.AccountID {
+			updated = st.account()
+		}
+	}
+	updated.status = ch.To
+	updated.updatedAt = ch.At
+
+	rec.Accounts = append(rec.Accounts, updated.state())
+	rec.Status = &ch
+
+	if err := s.write(rec); err != nil {
+		return err
+	}
+
+	if sweep != nil {
+		applyPostings(s.accounts, *sweep)
+	}
+	s.accounts[ch.AccountID].status = ch.To
+	s.accounts[ch.AccountID].updatedAt = ch.At
+	s.statuses = append(s.statuses, ch)
+	s.cancelSchedules(ch)
+	return nil
+}
+
+// cancelSchedules marks scheduled transfers cancelled by the change
+func (s *FileStorage) cancelSchedules(ch StatusChange) {
+	for _, id := range ch.Cancelled {
+		if st, ok := s.schedules[id]; ok {
+			s.schedules[id] = st.cancelled(ch.At)
+		}
+	}
+}
+
+func (s *FileStorage) StatusChanges() ([]StatusChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]StatusChange, len(s.statuses))
+	copy(res, s.statuses)
+	return res, nil
+}
+
+func (s *FileStorage) SetOverdraftLimit(id uuid.UUID, limit int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ac, ok := s.accounts[id]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	updated := *ac
+	updated.overdraft = limit
+	updated.updatedAt = at
+	if err := s.write(fileRecord{Accounts: []accountState{updated.state()}}); err != nil {
+		return err
+	}
+
+	*ac = updated
+	return nil
+}
+
+func (s *FileStorage) SetSpendingLimits(id uuid.UUID, limits SpendingLimits, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ac, ok := s.accounts[id]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	updated := *ac
+	updated.limits = limits
+	updated.updatedAt = at
+	if err := s.write(fileRecord{Accounts: []accountState{updated.state()}}); err != nil {
+		return err
+	}
+
+	*ac = updated
+	return nil
+}
+
+func (s *FileStorage) SaveScheduledTransfer(st ScheduledTransfer, run *ScheduledRun, txs []Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, err := s.batchRecord(txs)
+	if err != nil {
+		return err
+	}
+	rec.Schedule = &st
+	rec.Run = run
+
+	if err := s.write(rec); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		applyPostings(s.accounts, tx)
+	}
+	s.schedules[st.ID] = st
+	if run != nil {
+		s.runs = append(s.runs, *run)
+	}
+	return nil
+}
+
+func (s *FileStorage) ScheduledTransfers() ([]ScheduledTransfer, []ScheduledRun, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schedules := make([]ScheduledTransfer, 0, len(s.schedules))
+	for _, st := range s.schedules {
+		schedules = append(schedules, st)
+	}
+	runs := make([]ScheduledRun, len(s.runs))
+	copy(runs, s.runs)
+	return schedules, runs, nil
+}
+
+func (s *FileStorage) SaveInterest(st InterestState, txs []Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, err := s.batchRecord(txs)
+	if err != nil {
+		return err
+	}
+	rec.Interest = &st
+
+	if err := s.write(rec); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		applyPostings(s.accounts, tx)
+	}
+	s.interest = &st
+	return nil
+}
+
+func (s *FileStorage) Interest() (*InterestState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.interest == nil {
+		return nil, nil
+	}
+	st := s.interest.copy()
+	return &st, nil
+}
+
+func (s *FileStorage) Check() error {
+	return s.log.check()
+}
+
+func (s *FileStorage) Close() error {
+	return s.log.close()
+}
@@ -0,0 +1,27 @@
+package bank
+
+import "errors"
+
+// Check is the result of a readiness check, nil Err means it passed
+type Check struct {
+	Name string
+	Err  error
+}
+
+// Ready checks the bank can take changes: it is not closed, the last
+// writes of the storage and of the WAL succeeded and so did the last
+// snapshot. The WAL check is left out for banks without one.
+func (b *Bank) Ready() []Check {
+	checks := []Check{{Name: "bank"}}
+	select {
+	case <-b.done:
+		checks[0].Err = errors.New("bank is closed")
+	default:
+	}
+
+	checks = append(checks, Check{Name: "storage", Err: b.storage.Check()})
+	if b.wal != nil {
+		checks = append(checks, Check{Name: "wal", Err: b.wal.check()})
+	}
+	return checks
+}
@@ -0,0 +1,71 @@
+package bank
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func failedChecks(checks []Check) map[string]string {
+	failed := make(map[string]string)
+	for _, ch := range checks {
+		if ch.Err != nil {
+			failed[ch.Name] = ch.Err.Error()
+		}
+	}
+	return failed
+}
+
+func TestBank_Ready(t *testing.T) {
+	b := NewBank()
+	checks := b.Ready()
+	assert.Equal(t, []Check{{Name: "bank"}, {Name: "storage"}}, checks)
+
+	assert.Nil(t, b.Close())
+	assert.Equal(t, map[string]string{"bank": "bank is closed"}, failedChecks(b.Ready()))
+}
+
+func TestBank_ReadyWAL(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, failedChecks(b.Ready()))
+	assert.Len(t, b.Ready(), 3)
+
+	// snapshots can not be written anymore
+	assert.Nil(t, os.RemoveAll(dir))
+	assert.NotNil(t, b.Snapshot())
+	failed := failedChecks(b.Ready())
+	assert.Contains(t, failed["wal"], "last snapshot failed")
+
+	assert.NotNil(t, b.Close())
+	failed = failedChecks(b.Ready())
+	assert.Equal(t, "bank is closed", failed["bank"])
+	assert.NotEmpty(t, failed["wal"])
+}
+
+func TestLogFile_CheckDoesNotWaitForWrites(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _, err := openLogFile(filepath.Join(dir, "test.log"))
+	assert.Nil(t, err)
+	defer l.close()
+
+	// an append stuck in fsync holds the lock
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	done := make(chan error)
+	go func() { done <- l.check() }()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("check waits for the write")
+	}
+}
@@ -0,0 +1,372 @@
+package bank
+
+import (
+	"errors"
+	"github.com/JohnCGriffin/overflow"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// DefaultHoldTTL is how long a hold lives unless another expiry is asked for
+const DefaultHoldTTL = 7 * 24 * time.Hour
+
+var ErrHoldNotFound = errors.New("no hold found")
+
+type HoldStatus string
+
+const (
+	HoldActive   HoldStatus = "active"
+	HoldCaptured HoldStatus = "captured"
+	HoldReleased HoldStatus = "released"
+	// HoldExpired is never stored, active holds become expired once
+	// ExpiresAt has passed
+	HoldExpired HoldStatus = "expired"
+)
+
+// Hold reserves Amount on the account: available balance is reduced, the
+// ledger balance is not. Captured is the amount moved by the capture
+// transaction TxID, the rest of the hold is released with it.
+type Hold struct {
+	ID        uuid.UUID  `json:"id"`
+	AccountID uuid.UUID  `json:"account_id"`
+	Amount    int64      `json:"amount"`
+	Currency  string     `json:"currency"`
+	Status    HoldStatus `json:"status"`
+	Captured  int64      `json:"captured"`
+	TxID      uuid.UUID  `json:"tx_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+func (h Hold) active(at time.Time) bool {
+	return h.Status == HoldActive && at.Before(h.ExpiresAt)
+}
+
+// statusAt resolves expiry of active holds
+func (h Hold) statusAt(at time.Time) HoldStatus {
+	if h.Status == HoldActive && !h.active(at) {
+		return HoldExpired
+	}
+	return h.Status
+}
+
+// holdIndex keeps all holds and the active ones of every account, storage
+// only persists them. Holds leave byAccount once captured, released or
+// seen expired.
+type holdIndex struct {
+	holds     map[uuid.UUID]Hold
+	byAccount map[uuid.UUID]map[uuid.UUID]struct{}
+	mu        *sync.RWMutex
+}
+
+func newHoldIndex() *holdIndex {
+	return &holdIndex{
+		holds:     make(map[uuid.UUID]Hold),
+		byAccount: make(map[uuid.UUID]map[uuid.UUID]struct{}),
+		mu:        &sync.RWMutex{},
+	}
+}
+
+func (idx *holdIndex) put(h Hold) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.holds[h.ID] = h
+
+	if h.Status != HoldActive {
+		idx.remove(h.AccountID, h.ID)
+		return
+	}
+	if idx.byAccount[h.AccountID] == nil {
+		idx.byAccount[h.AccountID] = make(map[uuid.UUID]struct{})
+	}
+	idx.byAccount[h.AccountID][h.ID] = struct{}{}
+}
+
+func (idx *holdIndex) get(id uuid.UUID) (Hold, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	h, ok := idx.holds[id]
+	return h, ok
+}
+
+// held sums holds of the account which are not expired at the time
+func (idx *holdIndex) held(id uuid.UUID, at time.Time) int64 {
+	idx.mu.RLock()
+	var res int64
+	var expired []uuid.UUID
+	for holdID := range idx.byAccount[id] {
+		if h := idx.holds[holdID]; h.active(at) {
+			res += h.Amount
+		} else {
+			expired = append(expired, holdID)
+		}
+	}
+	idx.mu.RUnlock()
+
+	idx.prune(id, expired)
+	return res
+}
+
+// pending counts holds of the account which are not expired at the time as
+// spending, they are not in the ledger until captured
+func (idx *holdIndex) pending(id uuid.UUID, at time.Time) Spending {
+	idx.mu.RLock()
+	var s Spending
+	var expired []uuid.UUID
+	for holdID := range idx.byAccount[id] {
+		h := idx.holds[holdID]
+		if !h.active(at) {
+			expired = append(expired, holdID)
+			continue
+		}
+		s.Daily = saturatingAdd(s.Daily, h.Amount)
+		s.Monthly = saturatingAdd(s.Monthly, h.Amount)
+		if h.CreatedAt.After(at.Add(-time.Hour)) {
+			s.HourlyCount++
+		}
+	}
+	idx.mu.RUnlock()
+
+	idx.prune(id, expired)
+	return s
+}
+
+// prune drops expired holds of the account from byAccount, expiry can not
+// be undone so they need not be checked again
+func (idx *holdIndex) prune(id uuid.UUID, expired []uuid.UUID) {
+	if len(expired) == 0 {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, holdID := range expired {
+		idx.remove(id, holdID)
+	}
+}
+
+// remove drops the hold from byAccount and the account once it has none
+func (idx *holdIndex) remove(id uuid.UUID, holdID uuid.UUID) {
+	delete(idx.byAccount[id], holdID)
+	if len(idx.byAccount[id]) == 0 {
+		delete(idx.byAccount, id)
+	}
+}
+
+func (idx *holdIndex) all() []Hold {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	res := make([]Hold, 0, len(idx.holds))
+	for _, h := range idx.holds {
+		res = append(res, h)
+	}
+	return res
+}
+
+// SetHoldTTL sets expiry of holds placed without one
+func (b *Bank) SetHoldTTL(ttl time.Duration) {
+	b.holdTTL = ttl
+}
+
+// AvailableBalance is the balance less active holds
+func (b *Bank) AvailableBalance(id uuid.UUID) (int64, error) {
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return 0, err
+	}
+	return b.available(ac, now()), nil
+}
+
+func (b *Bank) available(ac Account, at time.Time) int64 {
+	return ac.balance - b.holds.held(ac.id, at)
+}
+
+// PlaceHold reserves amount of the available balance until the hold is
+// captured, released or expires after ttl. Zero ttl means the bank default.
+// The hold counts against spending limits of the account.
+func (b *Bank) PlaceHold(id uuid.UUID, amount int64, ttl time.Duration) (Hold, error) {
+	if amount <= 0 {
+		return Hold{}, errors.New("can not be zero or negative hold")
+	}
+	if ttl < 0 {
+		return Hold{}, errors.New("hold expiry can not be negative")
+	}
+	if ttl == 0 {
+		ttl = b.holdTTL
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(id)
+	defer unlock()
+
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	if err := ac.canDebit(); err != nil {
+		return Hold{}, err
+	}
+
+	at := now()
+	if b.headroom(ac, at) < amount {
+		return Hold{}, errors.New("available balance not enough")
+	}
+	// the capture is not checked, the hold is spending already
+	if err := b.checkLimits(ac, amount, at, Spending{}); err != nil {
+		return Hold{}, err
+	}
+
+	h := Hold{
+		ID:        uuid.New(),
+		AccountID: id,
+		Amount:    amount,
+		Currency:  ac.currency,
+		Status:    HoldActive,
+		CreatedAt: at,
+		UpdatedAt: at,
+		ExpiresAt: at.Add(ttl),
+	}
+	if err := b.commit(&holdPlaced{Hold: h}); err != nil {
+		return Hold{}, err
+	}
+	return h, nil
+}
+
+// GetHold returns the hold, expired holds have HoldExpired status
+func (b *Bank) GetHold(id uuid.UUID) (Hold, error) {
+	h, ok := b.holds.get(id)
+	if !ok {
+		return Hold{}, ErrHoldNotFound
+	}
+	h.Status = h.statusAt(now())
+	return h, nil
+}
+
+// CaptureHold moves amount of the hold to another account in the same
+// currency and releases the rest of it. The fee of the schedule is charged
+// with it. The capture transaction ID is returned.
+func (b *Bank) CaptureHold(id uuid.UUID, to uuid.UUID, amount int64) (uuid.UUID, error) {
+	txID, err := b.captureHold(id, to, amount)
+	observeTransfer(err)
+	return txID, err
+}
+
+func (b *Bank) captureHold(id uuid.UUID, to uuid.UUID, amount int64) (uuid.UUID, error) {
+	if amount <= 0 {
+		return uuid.Nil, errors.New("can not be zero or negative capture")
+	}
+
+	h, ok := b.holds.get(id)
+	if !ok {
+		return uuid.Nil, ErrHoldNotFound
+	}
+	if h.AccountID == to {
+		return uuid.Nil, errors.New("accounts must be different")
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	s := b.feeSchedule()
+	unlock := b.locks.lock(h.AccountID, to)
+	defer unlock()
+
+	at := now()
+	h, err := b.activeHold(id, at)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	fromAccount, toAccount, err := b.getTransferAccounts(h.AccountID, to)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := checkTransferStatuses(fromAccount, toAccount); err != nil {
+		return uuid.Nil, err
+	}
+
+	if fromAccount.currency != toAccount.currency {
+		return uuid.Nil, errors.New("accounts have different currencies")
+	}
+
+	if amount > h.Amount {
+		return uuid.Nil, errors.New("capture exceeds the hold")
+	}
+
+	headroom := withOverdraft(fromAccount.balance, fromAccount)
+	if headroom < amount {
+		return uuid.Nil, ErrInsufficientFunds
+	}
+
+	if _, ok := overflow.Add64(toAccount.balance, amount); !ok {
+		return uuid.Nil, errors.New("overflow of to balance")
+	}
+
+	fee, err := b.checkFee(s, fromAccount, toAccount, amount, headroom, nil)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	txID := uuid.New()
+	err = b.commit(&holdCaptured{
+		HoldID: id,
+		TxID:   txID,
+		To:     to,
+		Amount: amount,
+		Fee:    fee,
+		At:     at,
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return txID, nil
+}
+
+// ReleaseHold cancels the hold, its amount becomes available again
+func (b *Bank) ReleaseHold(id uuid.UUID) error {
+	h, ok := b.holds.get(id)
+	if !ok {
+		return ErrHoldNotFound
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(h.AccountID)
+	defer unlock()
+
+	at := now()
+	if _, err := b.activeHold(id, at); err != nil {
+		return err
+	}
+
+	return b.commit(&holdReleased{HoldID: id, At: at})
+}
+
+// activeHold returns the hold if it can still be captured or released.
+// Caller must hold the lock of the hold account.
+func (b *Bank) activeHold(id uuid.UUID, at time.Time) (Hold, error) {
+	h, ok := b.holds.get(id)
+	if !ok {
+		return Hold{}, ErrHoldNotFound
+	}
+
+	switch h.statusAt(at) {
+	case HoldActive:
+		return h, nil
+	case HoldExpired:
+		return Hold{}, errors.New("hold is expired")
+	default:
+		return Hold{}, errors.New("hold is already " + string(h.Status))
+	}
+}
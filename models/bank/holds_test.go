@@ -0,0 +1,200 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBank_PlaceHold(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+
+	h, err := b.PlaceHold(a1, 700, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, HoldActive, h.Status)
+	assert.Equal(t, h.CreatedAt.Add(DefaultHoldTTL), h.ExpiresAt)
+
+	// ledger balance stays, available one is reduced
+	balance, _ := b.GetAccountBalance(a1)
+	assert.Equal(t, "1000", balance)
+	available, err := b.AvailableBalance(a1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), available)
+	assert.Empty(t, b.Ledger().Postings(a1)[1:])
+
+	// held money can not be held or transferred again
+	_, err = b.PlaceHold(a1, 301, 0)
+	assert.NotNil(t, err)
+	_, err = b.Transfer(a1, a2, 301)
+	assert.NotNil(t, err)
+	_, err = b.Transfer(a1, a2, 300)
+	assert.Nil(t, err)
+
+	_, err = b.PlaceHold(a1, 0, 0)
+	assert.NotNil(t, err)
+	_, err = b.PlaceHold(a1, 1, -time.Second)
+	assert.NotNil(t, err)
+	_, err = b.PlaceHold(uuid.New(), 1, 0)
+	assert.Equal(t, ErrAccountNotFound, err)
+}
+
+func TestBank_CaptureHold(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	usd, _ := b.CreateAccountWith(AccountParams{Currency: "USD"})
+
+	h, _ := b.PlaceHold(a1, 700, 0)
+
+	_, err := b.CaptureHold(h.ID, a2, 701)
+	assert.NotNil(t, err)
+	_, err = b.CaptureHold(h.ID, a1, 100)
+	assert.NotNil(t, err)
+	_, err = b.CaptureHold(h.ID, usd, 100)
+	assert.NotNil(t, err)
+	_, err = b.CaptureHold(uuid.New(), a2, 100)
+	assert.Equal(t, ErrHoldNotFound, err)
+
+	// partial capture releases the rest
+	txID, err := b.CaptureHold(h.ID, a2, 500)
+	assert.Nil(t, err)
+
+	balance, _ := b.GetAccountBalance(a1)
+	assert.Equal(t, "500", balance)
+	available, _ := b.AvailableBalance(a1)
+	assert.Equal(t, int64(500), available)
+	balance, _ = b.GetAccountBalance(a2)
+	assert.Equal(t, "500", balance)
+
+	got, err := b.GetHold(h.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, HoldCaptured, got.Status)
+	assert.Equal(t, int64(500), got.Captured)
+	assert.Equal(t, txID, got.TxID)
+
+	postings := b.Ledger().Postings(a2)
+	assert.Equal(t, txID, postings[len(postings)-1].TxID)
+	assert.Equal(t, KindCapture, b.Ledger().Transactions()[len(b.Ledger().Transactions())-1].Kind)
+
+	_, err = b.CaptureHold(h.ID, a2, 100)
+	assert.NotNil(t, err)
+	assert.NotNil(t, b.ReleaseHold(h.ID))
+}
+
+func TestBank_ReleaseHold(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+
+	h, _ := b.PlaceHold(a1, 700, 0)
+	assert.Nil(t, b.ReleaseHold(h.ID))
+
+	available, _ := b.AvailableBalance(a1)
+	assert.Equal(t, int64(1000), available)
+	got, _ := b.GetHold(h.ID)
+	assert.Equal(t, HoldReleased, got.Status)
+
+	assert.NotNil(t, b.ReleaseHold(h.ID))
+	_, err := b.CaptureHold(h.ID, a2, 100)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrHoldNotFound, b.ReleaseHold(uuid.New()))
+}
+
+func TestBank_HoldExpiry(t *testing.T) {
+	b := NewBank()
+	b.SetHoldTTL(10 * time.Millisecond)
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+
+	h, _ := b.PlaceHold(a1, 700, 0)
+	long, _ := b.PlaceHold(a1, 100, time.Hour)
+	available, _ := b.AvailableBalance(a1)
+	assert.Equal(t, int64(200), available)
+
+	time.Sleep(20 * time.Millisecond)
+
+	available, _ = b.AvailableBalance(a1)
+	assert.Equal(t, int64(900), available)
+	got, _ := b.GetHold(h.ID)
+	assert.Equal(t, HoldExpired, got.Status)
+	got, _ = b.GetHold(long.ID)
+	assert.Equal(t, HoldActive, got.Status)
+
+	_, err := b.CaptureHold(h.ID, a2, 100)
+	assert.NotNil(t, err)
+	assert.NotNil(t, b.ReleaseHold(h.ID))
+
+	// expired and finished holds leave the account index
+	assert.Len(t, b.holds.byAccount[a1], 1)
+	assert.Nil(t, b.ReleaseHold(long.ID))
+	captured, _ := b.PlaceHold(a1, 100, time.Hour)
+	_, err = b.CaptureHold(captured.ID, a2, 100)
+	assert.Nil(t, err)
+	assert.Empty(t, b.holds.byAccount)
+}
+
+func TestBank_HoldsPersisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	check := func(b *Bank, a1 uuid.UUID, captured, active Hold) {
+		available, _ := b.AvailableBalance(a1)
+		assert.Equal(t, int64(600), available)
+
+		got, err := b.GetHold(captured.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, HoldCaptured, got.Status)
+		assert.Equal(t, int64(200), got.Captured)
+
+		got, err = b.GetHold(active.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, active, got)
+	}
+
+	fill := func(b *Bank) (uuid.UUID, Hold, Hold) {
+		a1, _ := b.CreateAccount(1000)
+		a2, _ := b.CreateAccount(0)
+		captured, _ := b.PlaceHold(a1, 300, 0)
+		active, _ := b.PlaceHold(a1, 200, 0)
+		_, err := b.CaptureHold(captured.ID, a2, 200)
+		assert.Nil(t, err)
+		return a1, captured, active
+	}
+
+	// write-ahead log, before and after snapshot
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	a1, captured, active := fill(b)
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1, captured, active)
+	assert.Nil(t, b.Close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1, captured, active)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	a1, captured, active = fill(b)
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	check(b, a1, captured, active)
+	assert.Nil(t, b.Close())
+}
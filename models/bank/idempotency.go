@@ -0,0 +1,128 @@
+package bank
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// idempotency key. Key is already scoped to the client. Zero Status marks
+// a key reserved by a request which has not finished yet.
+type IdempotencyRecord struct {
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_hash"`
+	Status      int       `json:"status"`
+	Body        []byte    `json:"body"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Pending tells the request has reserved the key but its outcome was not
+// stored
+func (r IdempotencyRecord) Pending() bool {
+	return r.Status == 0
+}
+
+func (r IdempotencyRecord) expired(at time.Time) bool {
+	return !at.Before(r.ExpiresAt)
+}
+
+// idempotencyIndex keeps records until they expire, storage only persists
+// them. Expired records are dropped when looked up and swept once the
+// index doubles since the last sweep.
+type idempotencyIndex struct {
+	records map[string]IdempotencyRecord
+	swept   int
+	mu      *sync.RWMutex
+}
+
+func newIdempotencyIndex() *idempotencyIndex {
+	return &idempotencyIndex{
+		records: make(map[string]IdempotencyRecord),
+		mu:      &sync.RWMutex{},
+	}
+}
+
+func (idx *idempotencyIndex) put(rec IdempotencyRecord) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	at := now()
+	if rec.expired(at) {
+		delete(idx.records, rec.Key)
+		return
+	}
+	idx.records[rec.Key] = rec
+
+	if len(idx.records) > 2*idx.swept {
+		idx.sweep(at)
+	}
+}
+
+func (idx *idempotencyIndex) get(key string, at time.Time) (IdempotencyRecord, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	rec, ok := idx.records[key]
+	if !ok {
+		return IdempotencyRecord{}, false
+	}
+	if rec.expired(at) {
+		delete(idx.records, key)
+		return IdempotencyRecord{}, false
+	}
+	return rec, true
+}
+
+// sweep drops expired records, the lock must be held
+func (idx *idempotencyIndex) sweep(at time.Time) {
+	for key, rec := range idx.records {
+		if rec.expired(at) {
+			delete(idx.records, key)
+		}
+	}
+	idx.swept = len(idx.records)
+}
+
+// live drops expired records and returns the rest
+func (idx *idempotencyIndex) live(at time.Time) []IdempotencyRecord {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.sweep(at)
+	res := make([]IdempotencyRecord, 0, len(idx.records))
+	for _, rec := range idx.records {
+		res = append(res, rec)
+	}
+	return res
+}
+
+func (b *Bank) GetIdempotencyRecord(key string) (IdempotencyRecord, bool) {
+	return b.idempotency.get(key, now())
+}
+
+// ReserveIdempotencyKey stores a pending record for the key before the
+// request runs, so a retry after a crash in the middle of the request finds
+// it and is not run again
+func (b *Bank) ReserveIdempotencyKey(key, requestHash string, expiresAt time.Time) error {
+	return b.SaveIdempotencyRecord(IdempotencyRecord{Key: key, RequestHash: requestHash, ExpiresAt: expiresAt})
+}
+
+// ReleaseIdempotencyKey drops the record of the key, so the request can be
+// retried. It is stored as a record expired already.
+func (b *Bank) ReleaseIdempotencyKey(key string) error {
+	return b.SaveIdempotencyRecord(IdempotencyRecord{Key: key, ExpiresAt: now()})
+}
+
+// SaveIdempotencyRecord stores the outcome of a request, it is kept by the
+// same persistence as accounts
+func (b *Bank) SaveIdempotencyRecord(rec IdempotencyRecord) error {
+	if rec.Key == "" {
+		return errors.New("idempotency key can not be empty")
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	return b.commit(&idempotencySaved{Record: rec})
+}
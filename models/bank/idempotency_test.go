@@ -0,0 +1,107 @@
+package bank
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBank_IdempotencyRecord(t *testing.T) {
+	b := NewBank()
+
+	rec := IdempotencyRecord{Key: "client key", RequestHash: "abc", Status: 200, Body: []byte(`{}`), ExpiresAt: now().Add(time.Hour)}
+	assert.Nil(t, b.SaveIdempotencyRecord(rec))
+
+	got, ok := b.GetIdempotencyRecord("client key")
+	assert.True(t, ok)
+	assert.Equal(t, rec, got)
+
+	_, ok = b.GetIdempotencyRecord("other key")
+	assert.False(t, ok)
+
+	// expired records are gone
+	rec.Key, rec.ExpiresAt = "expired", now().Add(-time.Second)
+	assert.Nil(t, b.SaveIdempotencyRecord(rec))
+	_, ok = b.GetIdempotencyRecord("expired")
+	assert.False(t, ok)
+
+	assert.NotNil(t, b.SaveIdempotencyRecord(IdempotencyRecord{}))
+}
+
+func TestBank_IdempotencyRecordPersisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	rec := IdempotencyRecord{Key: "client key", RequestHash: "abc", Status: 422, Body: []byte(`{"status":-1}`), ExpiresAt: now().Add(time.Hour)}
+
+	// write-ahead log, before and after snapshot
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, b.SaveIdempotencyRecord(rec))
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	got, ok := b.GetIdempotencyRecord(rec.Key)
+	assert.True(t, ok)
+	assert.Equal(t, rec, got)
+	assert.Nil(t, b.Close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	_, ok = b.GetIdempotencyRecord(rec.Key)
+	assert.True(t, ok)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	assert.Nil(t, b.SaveIdempotencyRecord(rec))
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	defer b.Close()
+	got, ok = b.GetIdempotencyRecord(rec.Key)
+	assert.True(t, ok)
+	assert.Equal(t, rec, got)
+}
+
+func TestBank_ReserveIdempotencyKey(t *testing.T) {
+	b := NewBank()
+
+	assert.Nil(t, b.ReserveIdempotencyKey("client key", "abc", now().Add(time.Hour)))
+	got, ok := b.GetIdempotencyRecord("client key")
+	assert.True(t, ok)
+	assert.True(t, got.Pending())
+	assert.Equal(t, "abc", got.RequestHash)
+
+	assert.Nil(t, b.ReleaseIdempotencyKey("client key"))
+	_, ok = b.GetIdempotencyRecord("client key")
+	assert.False(t, ok)
+	assert.Empty(t, b.idempotency.records)
+}
+
+func TestIdempotencyIndex_Evicts(t *testing.T) {
+	idx := newIdempotencyIndex()
+	idx.records["stale"] = IdempotencyRecord{Key: "stale", ExpiresAt: now().Add(-time.Second)}
+
+	// on lookup
+	_, ok := idx.get("stale", now())
+	assert.False(t, ok)
+	assert.Empty(t, idx.records)
+
+	// and once the index grows
+	for _, key := range []string{"a", "b", "c"} {
+		idx.records[key] = IdempotencyRecord{Key: key, ExpiresAt: now().Add(-time.Second)}
+	}
+	idx.put(IdempotencyRecord{Key: "live", Status: 200, ExpiresAt: now().Add(time.Hour)})
+	assert.Len(t, idx.records, 1)
+}
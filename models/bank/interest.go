@@ -0,0 +1,464 @@
+package bank
+
+import (
+	"errors"
+	"github.com/JohnCGriffin/overflow"
+	"github.com/google/uuid"
+	"math/big"
+	"simple_bank/models/clock"
+	"sync"
+	"time"
+)
+
+// daysInYear is the day count of annual rates, interest of a day is
+// balance * rate / 365
+const daysInYear = 365
+
+var ErrProductNotFound = errors.New("no interest product found")
+
+// InterestRates are annual rates as decimal fractions, e.g. "0.025" for
+// 2.5%. Credit is paid on positive balances, Debit is charged on
+// overdrawn ones. Empty rate means none.
+type InterestRates struct {
+	Credit string `json:"credit,omitempty"`
+	Debit  string `json:"debit,omitempty"`
+}
+
+func (r InterestRates) validate() error {
+	if _, err := parseRate(r.Credit); err != nil {
+		return err
+	}
+	_, err := parseRate(r.Debit)
+	return err
+}
+
+// parseRate returns nil for empty rates
+func parseRate(s string) (*big.Rat, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || r.Sign() < 0 || r.Cmp(big.NewRat(1, 1)) > 0 {
+		return nil, errors.New("interest rate must be a decimal fraction between 0 and 1")
+	}
+	return r, nil
+}
+
+// AccountInterest tells which rates apply to the account: its own Rates if
+// set, the rates of Product otherwise
+type AccountInterest struct {
+	Product string         `json:"product,omitempty"`
+	Rates   *InterestRates `json:"rates,omitempty"`
+}
+
+// InterestState is the interest configuration and how far it is accrued.
+// Sources are the bank accounts interest is paid from and charged to, by
+// currency. Accrued is interest not posted yet in minor units, exact
+// fractions written as "a/b", negative for charges. Days before Through
+// are accrued.
+type InterestState struct {
+	Products map[string]InterestRates      `json:"products,omitempty"`
+	Accounts map[uuid.UUID]AccountInterest `json:"accounts,omitempty"`
+	Sources  map[string]uuid.UUID          `json:"sources,omitempty"`
+	Accrued  map[uuid.UUID]string          `json:"accrued,omitempty"`
+	Through  time.Time                     `json:"through"`
+}
+
+func (st InterestState) copy() InterestState {
+	res := InterestState{
+		Products: make(map[string]InterestRates, len(st.Products)),
+		Accounts: make(map[uuid.UUID]AccountInterest, len(st.Accounts)),
+		Sources:  make(map[string]uuid.UUID, len(st.Sources)),
+		Accrued:  make(map[uuid.UUID]string, len(st.Accrued)),
+		Through:  st.Through,
+	}
+	for k, v := range st.Products {
+		res.Products[k] = v
+	}
+	for k, v := range st.Accounts {
+		res.Accounts[k] = v
+	}
+	for k, v := range st.Sources {
+		res.Sources[k] = v
+	}
+	for k, v := range st.Accrued {
+		res.Accrued[k] = v
+	}
+	return res
+}
+
+// rates returns the rates applying to the account, if any
+func (st InterestState) rates(id uuid.UUID) (InterestRates, bool) {
+	ai, ok := st.Accounts[id]
+	if !ok {
+		return InterestRates{}, false
+	}
+	if ai.Rates != nil {
+		return *ai.Rates, true
+	}
+	r, ok := st.Products[ai.Product]
+	return r, ok
+}
+
+func (st InterestState) accrued(id uuid.UUID) *big.Rat {
+	res := new(big.Rat)
+	if s, ok := st.Accrued[id]; ok {
+		res.SetString(s)
+	}
+	return res
+}
+
+// addAccrued adds amount to the interest accrued on the account
+func (st InterestState) addAccrued(id uuid.UUID, amount *big.Rat) {
+	total := st.accrued(id).Add(st.accrued(id), amount)
+	if total.Sign() == 0 {
+		delete(st.Accrued, id)
+		return
+	}
+	st.Accrued[id] = total.String()
+}
+
+// interestBook keeps the interest state, storage only persists it. Every
+// change holds mu from reading the state to storing the new one.
+type interestBook struct {
+	st InterestState
+	mu *sync.Mutex
+}
+
+func newInterestBook() *interestBook {
+	return &interestBook{st: InterestState{}.copy(), mu: &sync.Mutex{}}
+}
+
+func (ib *interestBook) get() InterestState {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	return ib.st.copy()
+}
+
+func (ib *interestBook) set(st InterestState) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	ib.st = st.copy()
+}
+
+// updateInterest changes a copy of the interest state and stores it
+// together with the transactions, it is kept only if that succeeds
+func (b *Bank) updateInterest(change func(st *InterestState), txs []Transaction) error {
+	b.interest.mu.Lock()
+	defer b.interest.mu.Unlock()
+
+	st := b.interest.st.copy()
+	change(&st)
+	if err := b.storage.SaveInterest(st, txs); err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		b.ledger.record(tx)
+	}
+	b.interest.st = st
+	return nil
+}
+
+// SetInterestProduct creates or changes rates of the product, accounts on
+// it accrue at the new rates from the next day
+func (b *Bank) SetInterestProduct(name string, rates InterestRates) error {
+	if name == "" {
+		return errors.New("product name is required")
+	}
+	if err := rates.validate(); err != nil {
+		return err
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	return b.commit(&interestProductSet{Name: name, Rates: rates})
+}
+
+// SetInterestAccount makes the account the source of interest in its
+// currency: interest is paid from it and charges are paid to it
+func (b *Bank) SetInterestAccount(id uuid.UUID) error {
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(id)
+	defer unlock()
+
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return err
+	}
+	if ac.status == AccountClosed {
+		return ErrAccountClosed
+	}
+
+	return b.commit(&interestSourceSet{Currency: ac.currency, AccountID: id})
+}
+
+// SetAccountInterest sets which rates the account accrues at, zero value
+// stops accrual. Interest accrued so far is still posted.
+func (b *Bank) SetAccountInterest(id uuid.UUID, ai AccountInterest) error {
+	if ai.Rates != nil {
+		if err := ai.Rates.validate(); err != nil {
+			return err
+		}
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(id)
+	defer unlock()
+
+	if _, err := b.storage.GetAccount(id); err != nil {
+		return err
+	}
+
+	// products are only added, so the check holds until commit
+	if ai.Rates == nil && ai.Product != "" {
+		if _, ok := b.interest.get().Products[ai.Product]; !ok {
+			return ErrProductNotFound
+		}
+	}
+
+	return b.commit(&accountInterestSet{AccountID: id, Interest: ai})
+}
+
+// InterestOf returns which rates the account accrues at and the interest
+// accrued but not posted yet, in minor units
+func (b *Bank) InterestOf(id uuid.UUID) (AccountInterest, InterestRates, *big.Rat, error) {
+	if _, err := b.storage.GetAccount(id); err != nil {
+		return AccountInterest{}, InterestRates{}, nil, err
+	}
+
+	st := b.interest.get()
+	rates, _ := st.rates(id)
+	return st.Accounts[id], rates, st.accrued(id), nil
+}
+
+// InterestEngine accrues interest every day and posts it on the first day
+// of every month, days are told by its clock
+type InterestEngine struct {
+	bank  *Bank
+	clock clock.Clock
+}
+
+func NewInterestEngine(b *Bank, c clock.Clock) *InterestEngine {
+	return &InterestEngine{bank: b, clock: c}
+}
+
+// Run accrues every whole day up to today, in UTC, on the balance at the
+// end of the day. Missed days are caught up. The first run only marks
+// today as the start of accrual.
+func (e *InterestEngine) Run() error {
+	today := e.clock.Now().UTC().Truncate(24 * time.Hour)
+
+	through := e.bank.interest.get().Through
+	if through.IsZero() {
+		return e.bank.accrueInterest(today, nil)
+	}
+
+	for day := through; day.Before(today); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		if err := e.bank.accrueInterest(next, e.bank.dailyInterest(next)); err != nil {
+			return err
+		}
+		if next.Day() == 1 {
+			if err := e.bank.postInterest(next); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Start runs the engine every interval until the bank is closed
+func (e *InterestEngine) Start(interval time.Duration, onError func(error)) {
+	e.bank.startJob(interval, e.Run, onError)
+}
+
+// dailyInterest returns interest of the day ending at end for every
+// account accruing it
+func (b *Bank) dailyInterest(end time.Time) map[uuid.UUID]string {
+	st := b.interest.get()
+
+	sources := make(map[uuid.UUID]bool)
+	for _, id := range st.Sources {
+		sources[id] = true
+	}
+
+	res := make(map[uuid.UUID]string)
+	for id := range st.Accounts {
+		rates, ok := st.rates(id)
+		if !ok || sources[id] {
+			continue
+		}
+
+		balance := b.ledger.balanceAt(id, end)
+		rate, _ := parseRate(rates.Credit)
+		if balance < 0 {
+			rate, _ = parseRate(rates.Debit)
+		}
+		if rate == nil || balance == 0 {
+			continue
+		}
+
+		amount := new(big.Rat).SetInt64(balance)
+		amount.Mul(amount, rate)
+		amount.Quo(amount, big.NewRat(daysInYear, 1))
+		if amount.Sign() != 0 {
+			res[id] = amount.String()
+		}
+	}
+	return res
+}
+
+func (b *Bank) accrueInterest(through time.Time, accrued map[uuid.UUID]string) error {
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	return b.commit(&interestAccrued{Through: through, Accrued: accrued})
+}
+
+// postInterest moves whole minor units of accrued interest between the
+// accounts and the interest accounts of their currencies, fractions are
+// carried to the next month. Accounts without an interest account, or
+// closed ones, keep accruing until they can be posted. Postings are made
+// at the month boundary they settle.
+func (b *Bank) postInterest(at time.Time) error {
+	st := b.interest.get()
+
+	ids := make([]uuid.UUID, 0, 2*len(st.Accrued))
+	for id := range st.Accrued {
+		ids = append(ids, id)
+	}
+	for _, id := range st.Sources {
+		ids = append(ids, id)
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(ids...)
+	defer unlock()
+
+	// the state could have changed while waiting for the locks
+	st = b.interest.get()
+	accounts := make(map[uuid.UUID]*Account)
+	e := &interestPosted{At: at}
+
+	for id := range st.Accrued {
+		accrued := st.accrued(id)
+		amount := new(big.Int).Quo(accrued.Num(), accrued.Denom())
+		if amount.Sign() == 0 || !amount.IsInt64() {
+			continue
+		}
+
+		p, ok := b.interestPosting(st, accounts, id, amount.Int64(), at)
+		if !ok {
+			continue
+		}
+		e.Postings = append(e.Postings, p)
+		applyBatchLeg(accounts, batchLeg{From: p.From, To: p.To, Amount: p.Amount})
+	}
+
+	if len(e.Postings) == 0 {
+		return nil
+	}
+	return b.commit(e)
+}
+
+// interestPosting builds the posting of amount accrued on the account, it
+// is not possible if the accounts can not take it. The interest account
+// pays interest as any account pays a transfer: out of its available
+// balance and overdraft, unless debits are frozen.
+func (b *Bank) interestPosting(st InterestState, accounts map[uuid.UUID]*Account, id uuid.UUID, amount int64, at time.Time) (interestPosting, bool) {
+	account := func(id uuid.UUID) (*Account, bool) {
+		if ac, ok := accounts[id]; ok {
+			return ac, true
+		}
+		ac, err := b.storage.GetAccount(id)
+		if err != nil {
+			return nil, false
+		}
+		accounts[id] = &ac
+		return &ac, true
+	}
+
+	ac, ok := account(id)
+	if !ok || ac.status == AccountClosed {
+		return interestPosting{}, false
+	}
+	source, ok := account(st.Sources[ac.currency])
+	if !ok || source.id == id || source.status == AccountClosed {
+		return interestPosting{}, false
+	}
+
+	p := interestPosting{TxID: uuid.New(), AccountID: id, From: source.id, To: id, Amount: amount}
+	if amount < 0 {
+		p.From, p.To, p.Amount = id, source.id, -amount
+	}
+
+	from, to := accounts[p.From], accounts[p.To]
+	if p.From == source.id && (source.canDebit() != nil || b.headroom(*source, at) < p.Amount) {
+		return interestPosting{}, false
+	}
+	if _, ok := overflow.Sub64(from.balance, p.Amount); !ok {
+		return interestPosting{}, false
+	}
+	if _, ok := overflow.Add64(to.balance, p.Amount); !ok {
+		return interestPosting{}, false
+	}
+
+	// postings of an account are kept in time order, a posting caught up
+	// late follows those made since the boundary
+	p.At = at
+	for _, last := range []time.Time{b.ledger.lastPostingAt(p.From), b.ledger.lastPostingAt(p.To)} {
+		if last.After(p.At) {
+			p.At = last
+		}
+	}
+	return p, true
+}
+
+// interestPosting moves Amount of interest accrued on AccountID, from the
+// interest account for paid interest and to it for charges
+type interestPosting struct {
+	TxID      uuid.UUID `json:"tx_id"`
+	AccountID uuid.UUID `json:"account_id"`
+	From      uuid.UUID `json:"from"`
+	To        uuid.UUID `json:"to"`
+	Amount    int64     `json:"amount"`
+	At        time.Time `json:"at"`
+}
+
+// lastPostingAt returns when the latest posting of the account was made,
+// zero if it has none
+func (l *Ledger) lastPostingAt(id uuid.UUID) time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	postings := l.postings[id]
+	if len(postings) == 0 {
+		return time.Time{}
+	}
+	return postings[len(postings)-1].CreatedAt
+}
+
+// balanceAt returns the balance of the account before the time, from the
+// running balance of its postings. Postings are recorded in time order.
+func (l *Ledger) balanceAt(id uuid.UUID, at time.Time) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	postings := l.postings[id]
+	for i := len(postings) - 1; i >= 0; i-- {
+		if postings[i].CreatedAt.Before(at) {
+			return postings[i].Balance
+		}
+	}
+	return 0
+}
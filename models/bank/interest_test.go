@@ -0,0 +1,227 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"os"
+	"path/filepath"
+	"simple_bank/models/clock"
+	"testing"
+	"time"
+)
+
+// nextMonth returns the first day of the month after the day
+func nextMonth(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func TestInterestEngine(t *testing.T) {
+	b := NewBank()
+	source, _ := b.CreateAccount(1000000)
+	saver, _ := b.CreateAccount(100000)
+	debtor, _ := b.CreateAccountWith(AccountParams{Overdraft: 50000})
+	idle, _ := b.CreateAccount(100000)
+
+	assert.NotNil(t, b.SetInterestProduct("savings", InterestRates{Credit: "1.5"}))
+	assert.NotNil(t, b.SetInterestProduct("", InterestRates{Credit: "0.05"}))
+	assert.Nil(t, b.SetInterestProduct("savings", InterestRates{Credit: "0.05"}))
+	assert.Equal(t, ErrProductNotFound, b.SetAccountInterest(saver, AccountInterest{Product: "checking"}))
+	assert.Nil(t, b.SetAccountInterest(saver, AccountInterest{Product: "savings"}))
+	assert.Nil(t, b.SetAccountInterest(debtor, AccountInterest{Rates: &InterestRates{Debit: "0.1825"}}))
+	assert.Nil(t, b.SetInterestAccount(source))
+
+	_, err := b.Transfer(debtor, idle, 20000)
+	assert.Nil(t, err)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	c := clock.NewManual(today.Add(time.Hour))
+	e := NewInterestEngine(b, c)
+
+	// the first run starts accrual
+	assert.Nil(t, e.Run())
+	_, _, accrued, _ := b.InterestOf(saver)
+	assert.Equal(t, 0, accrued.Sign())
+
+	// a day before the end of the month nothing is posted yet
+	end := nextMonth(today)
+	days := int64(end.Sub(today) / (24 * time.Hour))
+	c.Set(end.Add(-time.Hour))
+	assert.Nil(t, e.Run())
+	_, rates, accrued, _ := b.InterestOf(saver)
+	assert.Equal(t, "0.05", rates.Credit)
+	assert.Equal(t, big.NewRat((days-1)*5000, daysInYear), accrued)
+	ac, _ := b.GetAccount(saver)
+	assert.Equal(t, int64(100000), ac.Balance())
+
+	// the last day is accrued and whole cents are posted
+	c.Set(end.Add(time.Hour))
+	assert.Nil(t, e.Run())
+	assert.Nil(t, e.Run())
+
+	total := big.NewRat(days*5000, daysInYear)
+	posted := new(big.Int).Quo(total.Num(), total.Denom()).Int64()
+	ac, _ = b.GetAccount(saver)
+	assert.Equal(t, 100000+posted, ac.Balance())
+	_, _, accrued, _ = b.InterestOf(saver)
+	assert.Equal(t, total.Sub(total, big.NewRat(posted, 1)), accrued)
+
+	// 20000 * 0.1825 / 365 is 10 a day
+	ac, _ = b.GetAccount(debtor)
+	assert.Equal(t, -20000-10*days, ac.Balance())
+	_, _, accrued, _ = b.InterestOf(debtor)
+	assert.Equal(t, 0, accrued.Sign())
+
+	// no money is created or lost
+	ac, _ = b.GetAccount(source)
+	assert.Equal(t, int64(1000000)-posted+10*days, ac.Balance())
+	ac, _ = b.GetAccount(idle)
+	assert.Equal(t, int64(120000), ac.Balance())
+
+	postings := b.Ledger().Postings(saver)
+	tx, _ := b.Ledger().Transaction(postings[len(postings)-1].TxID)
+	assert.Equal(t, KindInterest, tx.Kind)
+
+	assert.Equal(t, ErrAccountNotFound, b.SetAccountInterest(uuid.New(), AccountInterest{}))
+	assert.Nil(t, b.SetAccountInterest(saver, AccountInterest{}))
+	_, rates, _, _ = b.InterestOf(saver)
+	assert.Equal(t, InterestRates{}, rates)
+}
+
+func TestInterestEngine_NoSource(t *testing.T) {
+	b := NewBank()
+	saver, _ := b.CreateAccount(365)
+	assert.Nil(t, b.SetAccountInterest(saver, AccountInterest{Rates: &InterestRates{Credit: "1"}}))
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	c := clock.NewManual(today)
+	e := NewInterestEngine(b, c)
+	assert.Nil(t, e.Run())
+
+	// interest keeps accruing until there is an account to pay it from
+	end := nextMonth(today)
+	c.Set(end)
+	assert.Nil(t, e.Run())
+
+	days := int64(end.Sub(today) / (24 * time.Hour))
+	ac, _ := b.GetAccount(saver)
+	assert.Equal(t, int64(365), ac.Balance())
+	_, _, accrued, _ := b.InterestOf(saver)
+	assert.Equal(t, big.NewRat(days, 1), accrued)
+}
+
+func TestInterestEngine_SourceFunds(t *testing.T) {
+	b := NewBank()
+	source, _ := b.CreateAccount(0)
+	saver, _ := b.CreateAccount(36500)
+	assert.Nil(t, b.SetAccountInterest(saver, AccountInterest{Rates: &InterestRates{Credit: "1"}}))
+	assert.Nil(t, b.SetInterestAccount(source))
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	c := clock.NewManual(today)
+	e := NewInterestEngine(b, c)
+	assert.Nil(t, e.Run())
+
+	// the interest account can not pay more than it has
+	end := nextMonth(today)
+	c.Set(end.Add(time.Hour))
+	assert.Nil(t, e.Run())
+	days := int64(end.Sub(today) / (24 * time.Hour))
+	ac, _ := b.GetAccount(saver)
+	assert.Equal(t, int64(36500), ac.Balance())
+	_, _, accrued, _ := b.InterestOf(saver)
+	assert.Equal(t, big.NewRat(100*days, 1), accrued)
+
+	// nor while its debits are frozen
+	funder, _ := b.CreateAccount(1000000)
+	_, err := b.Transfer(funder, source, 1000000)
+	assert.Nil(t, err)
+	_, err = b.SetAccountStatus(source, AccountFrozenDebits, "support", "audit")
+	assert.Nil(t, err)
+	assert.Nil(t, b.postInterest(end))
+	ac, _ = b.GetAccount(saver)
+	assert.Equal(t, int64(36500), ac.Balance())
+
+	_, err = b.SetAccountStatus(source, AccountActive, "support", "audit done")
+	assert.Nil(t, err)
+	next := nextMonth(end)
+	assert.Nil(t, b.postInterest(next))
+	ac, _ = b.GetAccount(saver)
+	assert.Equal(t, 36500+100*days, ac.Balance())
+
+	// the posting is made at the boundary it settles
+	postings := b.Ledger().Postings(saver)
+	assert.Equal(t, next, postings[len(postings)-1].CreatedAt)
+}
+
+func TestInterestEngine_Persisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	end := nextMonth(today)
+	days := int64(end.Sub(today) / (24 * time.Hour))
+
+	fill := func(b *Bank) (uuid.UUID, uuid.UUID) {
+		source, _ := b.CreateAccount(1000000)
+		saver, _ := b.CreateAccount(100)
+		assert.Nil(t, b.SetInterestProduct("savings", InterestRates{Credit: "0.5"}))
+		assert.Nil(t, b.SetAccountInterest(saver, AccountInterest{Product: "savings"}))
+		assert.Nil(t, b.SetInterestAccount(source))
+
+		c := clock.NewManual(today)
+		e := NewInterestEngine(b, c)
+		assert.Nil(t, e.Run())
+		c.Set(end)
+		assert.Nil(t, e.Run())
+		return source, saver
+	}
+
+	// 100 * 0.5 / 365 a day
+	total := big.NewRat(days*50, daysInYear)
+	posted := new(big.Int).Quo(total.Num(), total.Denom()).Int64()
+
+	check := func(b *Bank, source uuid.UUID, saver uuid.UUID) {
+		ac, _ := b.GetAccount(saver)
+		assert.Equal(t, 100+posted, ac.Balance())
+		ac, _ = b.GetAccount(source)
+		assert.Equal(t, 1000000-posted, ac.Balance())
+
+		ai, _, accrued, _ := b.InterestOf(saver)
+		assert.Equal(t, "savings", ai.Product)
+		assert.Equal(t, new(big.Rat).Sub(total, big.NewRat(posted, 1)), accrued)
+		assert.Equal(t, end, b.interest.get().Through)
+	}
+
+	// write-ahead log, before and after snapshot
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	source, saver := fill(b)
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, source, saver)
+	assert.Nil(t, b.Close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, source, saver)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	source, saver = fill(b)
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	check(b, source, saver)
+	assert.Nil(t, b.Close())
+}
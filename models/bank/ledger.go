@@ -0,0 +1,285 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"simple_bank/models/fx"
+	"sync"
+	"time"
+)
+
+// SystemAccountID is the counter account for money entering the bank,
+// e.g. opening balances, and for currency exchange. Its derived balance in
+// every currency is the negated sum of customer balances in it, so the
+// whole ledger sums up to zero. Postings on it do not carry a running
+// balance.
+var SystemAccountID = uuid.Nil
+
+type PostingType string
+
+const (
+	Debit  PostingType = "debit"
+	Credit PostingType = "credit"
+)
+
+type TransactionKind string
+
+const (
+	KindOpening  TransactionKind = "opening"
+	KindTransfer TransactionKind = "transfer"
+	KindExchange TransactionKind = "exchange"
+	KindCapture  TransactionKind = "capture"
+	KindReversal TransactionKind = "reversal"
+	KindClosing  TransactionKind = "closing"
+	KindInterest TransactionKind = "interest"
+	KindFee      TransactionKind = "fee"
+)
+
+// Posting is one side of a transaction applied to a single account.
+// Amount is always positive, Type tells the direction.
+type Posting struct {
+	Seq          uint64
+	TxID         uuid.UUID
+	AccountID    uuid.UUID
+	Counterparty uuid.UUID
+	Type         PostingType
+	Amount       int64
+	Currency     string
+	Balance      int64
+	CreatedAt    time.Time
+}
+
+// Signed returns the amount with the sign of the posting direction.
+func (p Posting) Signed() int64 {
+	if p.Type == Debit {
+		return -p.Amount
+	}
+	return p.Amount
+}
+
+// Transaction moves Amount from one account to another. Exchange moves
+// Amount in the currency of From and credits ToAmount in the currency of
+// To, with the Rate used and the Remainder lost by rounding, in minor
+// units of the To currency. Reversal moves money back for the transaction
+// Reverses, fee is charged for the transaction FeeFor.
+type Transaction struct {
+	ID        uuid.UUID
+	Kind      TransactionKind
+	From      uuid.UUID
+	To        uuid.UUID
+	Amount    int64
+	Currency  string
+	ToAmount  int64  `json:",omitempty"`
+	Rate      string `json:",omitempty"`
+	Remainder string `json:",omitempty"`
+	Reverses  uuid.UUID
+	FeeFor    uuid.UUID
+	CreatedAt time.Time
+	Postings  []Posting
+}
+
+// PostingFilter narrows down postings of an account. After is a cursor:
+// only postings with a greater Seq are returned. Zero values mean no filter.
+type PostingFilter struct {
+	After uint64
+	Limit int
+	Since time.Time
+	Until time.Time
+	Type  PostingType
+}
+
+func (f PostingFilter) match(p Posting) bool {
+	if p.Seq <= f.After {
+		return false
+	}
+	if !f.Since.IsZero() && p.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !p.CreatedAt.Before(f.Until) {
+		return false
+	}
+	if f.Type != "" && p.Type != f.Type {
+		return false
+	}
+	return true
+}
+
+// Ledger is an append-only journal of transactions. Entries are never
+// modified after being recorded, readers always get copies.
+type Ledger struct {
+	transactions []Transaction
+	postings     map[uuid.UUID][]Posting
+	// byID indexes transactions, reversed sums reversals of them
+	byID     map[uuid.UUID]int
+	reversed map[uuid.UUID]int64
+	seq      uint64
+	mu       *sync.RWMutex
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		postings: make(map[uuid.UUID][]Posting),
+		byID:     make(map[uuid.UUID]int),
+		reversed: make(map[uuid.UUID]int64),
+		mu:       &sync.RWMutex{},
+	}
+}
+
+// newTransaction builds a balanced debit/credit pair. fromBalance and
+// toBalance are the balances after the transaction is applied.
+func newTransaction(id uuid.UUID, kind TransactionKind, cur string, from, to uuid.UUID, amount, fromBalance, toBalance int64, now time.Time) Transaction {
+	return Transaction{
+		ID:        id,
+		Kind:      kind,
+		From:      from,
+		To:        to,
+		Amount:    amount,
+		Currency:  cur,
+		CreatedAt: now,
+		Postings: []Posting{
+			{TxID: id, AccountID: from, Counterparty: to, Type: Debit, Amount: amount, Currency: cur, Balance: fromBalance, CreatedAt: now},
+			{TxID: id, AccountID: to, Counterparty: from, Type: Credit, Amount: amount, Currency: cur, Balance: toBalance, CreatedAt: now},
+		},
+	}
+}
+
+// newExchangeTransaction builds a transaction balanced in each currency:
+// the system account buys the from currency and sells the to currency
+func newExchangeTransaction(id uuid.UUID, from, to Account, amount int64, conv fx.Conversion, now time.Time) Transaction {
+	return Transaction{
+		ID:        id,
+		Kind:      KindExchange,
+		From:      from.id,
+		To:        to.id,
+		Amount:    amount,
+		Currency:  from.currency,
+		ToAmount:  conv.Amount,
+		Rate:      conv.Rate,
+		Remainder: conv.Remainder,
+		CreatedAt: now,
+		Postings: []Posting{
+			{TxID: id, AccountID: from.id, Counterparty: to.id, Type: Debit, Amount: amount, Currency: from.currency, Balance: from.balance - amount, CreatedAt: now},
+			{TxID: id, AccountID: SystemAccountID, Counterparty: from.id, Type: Credit, Amount: amount, Currency: from.currency, CreatedAt: now},
+			{TxID: id, AccountID: SystemAccountID, Counterparty: to.id, Type: Debit, Amount: conv.Amount, Currency: to.currency, CreatedAt: now},
+			{TxID: id, AccountID: to.id, Counterparty: from.id, Type: Credit, Amount: conv.Amount, Currency: to.currency, Balance: to.balance + conv.Amount, CreatedAt: now},
+		},
+	}
+}
+
+// nextSeq returns the Seq the next posting recorded gets
+func (l *Ledger) nextSeq() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.seq + 1
+}
+
+// resume makes the next posting recorded get seq
+func (l *Ledger) resume(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq = seq - 1
+}
+
+func (l *Ledger) record(tx Transaction) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// postings are numbered on a copy, the caller's transaction is not
+	// modified
+	tx.Postings = append([]Posting(nil), tx.Postings...)
+	for i := range tx.Postings {
+		l.seq++
+		tx.Postings[i].Seq = l.seq
+		l.postings[tx.Postings[i].AccountID] = append(l.postings[tx.Postings[i].AccountID], tx.Postings[i])
+	}
+	l.byID[tx.ID] = len(l.transactions)
+	l.transactions = append(l.transactions, tx)
+	if tx.Kind == KindReversal {
+		l.reversed[tx.Reverses] += tx.Amount
+	}
+}
+
+func (l *Ledger) Transaction(id uuid.UUID) (Transaction, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	i, ok := l.byID[id]
+	if !ok {
+		return Transaction{}, false
+	}
+	return l.transactions[i], true
+}
+
+// Reversed returns the amount of the transaction already moved back
+func (l *Ledger) Reversed(id uuid.UUID) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.reversed[id]
+}
+
+func (l *Ledger) Transactions() []Transaction {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	res := make([]Transaction, len(l.transactions))
+	copy(res, l.transactions)
+	return res
+}
+
+func (l *Ledger) Postings(id uuid.UUID) []Posting {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	res := make([]Posting, len(l.postings[id]))
+	copy(res, l.postings[id])
+	return res
+}
+
+// Find returns postings of the account matching the filter in the order
+// they were recorded. The second value reports whether more postings match
+// beyond the limit.
+func (l *Ledger) Find(id uuid.UUID, f PostingFilter) ([]Posting, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	res := []Posting{}
+	for _, p := range l.postings[id] {
+		if !f.match(p) {
+			continue
+		}
+		if f.Limit > 0 && len(res) == f.Limit {
+			return res, true
+		}
+		res = append(res, p)
+	}
+	return res, false
+}
+
+// Balance derives the account balance from its postings only. For the
+// system account it adds up all currencies, see BalanceIn.
+func (l *Ledger) Balance(id uuid.UUID) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var balance int64
+	for _, p := range l.postings[id] {
+		balance += p.Signed()
+	}
+	return balance
+}
+
+// BalanceIn derives the balance of postings in a single currency
+func (l *Ledger) BalanceIn(id uuid.UUID, cur string) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var balance int64
+	for _, p := range l.postings[id] {
+		if p.Currency == cur {
+			balance += p.Signed()
+		}
+	}
+	return balance
+}
@@ -0,0 +1,127 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLedger_RecordsOpeningAndTransfer(t *testing.T) {
+	b := NewBank()
+
+	from, err := b.CreateAccount(5000)
+	assert.Nil(t, err)
+	to, err := b.CreateAccount(0)
+	assert.Nil(t, err)
+
+	_, err = b.Transfer(from, to, 1500)
+	assert.Nil(t, err)
+
+	// zero opening balance is not recorded
+	txs := b.Ledger().Transactions()
+	assert.Len(t, txs, 2)
+	assert.Equal(t, KindOpening, txs[0].Kind)
+	assert.Equal(t, SystemAccountID, txs[0].From)
+	assert.Equal(t, KindTransfer, txs[1].Kind)
+
+	postings := b.Ledger().Postings(from)
+	assert.Len(t, postings, 2)
+	assert.Equal(t, Credit, postings[0].Type)
+	assert.Equal(t, Debit, postings[1].Type)
+	assert.Equal(t, int64(1500), postings[1].Amount)
+	assert.Equal(t, int64(3500), postings[1].Balance)
+	assert.Equal(t, to, postings[1].Counterparty)
+	assert.Equal(t, txs[1].ID, postings[1].TxID)
+}
+
+func TestLedger_BalancesDerivedFromPostings(t *testing.T) {
+	b := NewBank()
+
+	a1, _ := b.CreateAccount(10000)
+	a2, _ := b.CreateAccount(2500)
+	a3, _ := b.CreateAccount(0)
+
+	_, err := b.Transfer(a1, a2, 700)
+	assert.Nil(t, err)
+	_, err = b.Transfer(a2, a3, 3000)
+	assert.Nil(t, err)
+	_, err = b.Transfer(a3, a1, 1)
+	assert.Nil(t, err)
+
+	// failed transfer leaves no trace
+	_, err = b.Transfer(a3, a1, 1000000)
+	assert.NotNil(t, err)
+	assert.Len(t, b.Ledger().Transactions(), 5)
+
+	for _, uid := range []uuid.UUID{a1, a2, a3} {
+		balance, err := b.GetAccountBalance(uid)
+		assert.Nil(t, err)
+		assert.Equal(t, balance, strconv.FormatInt(b.Ledger().Balance(uid), 10))
+	}
+
+	// the whole ledger sums up to zero
+	assert.Equal(t, int64(-12500), b.Ledger().Balance(SystemAccountID))
+}
+
+func TestLedger_TransactionsAreBalanced(t *testing.T) {
+	b := NewBank()
+
+	a1, _ := b.CreateAccount(300)
+	a2, _ := b.CreateAccount(300)
+	_, err := b.Transfer(a1, a2, 150)
+	assert.Nil(t, err)
+
+	for _, tx := range b.Ledger().Transactions() {
+		var sum int64
+		for _, p := range tx.Postings {
+			sum += p.Signed()
+		}
+		assert.Equal(t, int64(0), sum, tx.ID.String())
+	}
+}
+
+func TestLedger_Find(t *testing.T) {
+	b := NewBank()
+
+	a1, _ := b.CreateAccount(10000)
+	a2, _ := b.CreateAccount(10000)
+	for i := 0; i < 5; i++ {
+		_, err := b.Transfer(a1, a2, 100)
+		assert.Nil(t, err)
+		_, err = b.Transfer(a2, a1, 10)
+		assert.Nil(t, err)
+	}
+
+	all, more, err := b.GetAccountPostings(a1, PostingFilter{})
+	assert.Nil(t, err)
+	assert.False(t, more)
+	assert.Len(t, all, 11)
+
+	// pagination with cursor
+	page, more, _ := b.GetAccountPostings(a1, PostingFilter{Limit: 4})
+	assert.True(t, more)
+	assert.Len(t, page, 4)
+	page, more, _ = b.GetAccountPostings(a1, PostingFilter{Limit: 4, After: page[3].Seq})
+	assert.True(t, more)
+	assert.Equal(t, all[4], page[0])
+	page, more, _ = b.GetAccountPostings(a1, PostingFilter{Limit: 4, After: page[3].Seq})
+	assert.False(t, more)
+	assert.Len(t, page, 3)
+
+	// direction
+	outgoing, _, _ := b.GetAccountPostings(a1, PostingFilter{Type: Debit})
+	assert.Len(t, outgoing, 5)
+	incoming, _, _ := b.GetAccountPostings(a1, PostingFilter{Type: Credit})
+	assert.Len(t, incoming, 6)
+
+	// time range
+	none, _, _ := b.GetAccountPostings(a1, PostingFilter{Since: time.Now().Add(time.Hour)})
+	assert.Len(t, none, 0)
+	none, _, _ = b.GetAccountPostings(a1, PostingFilter{Until: all[0].CreatedAt})
+	assert.Len(t, none, 0)
+
+	_, _, err = b.GetAccountPostings(uuid.New(), PostingFilter{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,190 @@
+package bank
+
+import (
+	"errors"
+	"github.com/JohnCGriffin/overflow"
+	"github.com/google/uuid"
+	"math"
+	"strconv"
+	"time"
+)
+
+// SpendingLimits cap outgoing transfers and exchanges of an account, in its
+// currency. Daily and monthly totals are over rolling windows of 24 hours
+// and 30 days. Zero values mean no limit.
+type SpendingLimits struct {
+	MaxAmount      int64 `json:"max_amount,omitempty"`
+	MaxDaily       int64 `json:"max_daily,omitempty"`
+	MaxMonthly     int64 `json:"max_monthly,omitempty"`
+	MaxHourlyCount int   `json:"max_hourly_count,omitempty"`
+}
+
+func (l SpendingLimits) none() bool {
+	return l == SpendingLimits{}
+}
+
+func (l SpendingLimits) validate() error {
+	if l.MaxAmount < 0 || l.MaxDaily < 0 || l.MaxMonthly < 0 || l.MaxHourlyCount < 0 {
+		return errors.New("limits can not be negative")
+	}
+	return nil
+}
+
+// check tells whether amount can be sent on top of what is spent already
+func (l SpendingLimits) check(s Spending, amount int64) error {
+	if l.MaxAmount > 0 && amount > l.MaxAmount {
+		return &LimitError{Code: LimitSingleAmount, Limit: l.MaxAmount}
+	}
+	if l.MaxDaily > 0 {
+		if total, ok := overflow.Add64(s.Daily, amount); !ok || total > l.MaxDaily {
+			return &LimitError{Code: LimitDailyAmount, Limit: l.MaxDaily, Used: s.Daily}
+		}
+	}
+	if l.MaxMonthly > 0 {
+		if total, ok := overflow.Add64(s.Monthly, amount); !ok || total > l.MaxMonthly {
+			return &LimitError{Code: LimitMonthlyAmount, Limit: l.MaxMonthly, Used: s.Monthly}
+		}
+	}
+	if l.MaxHourlyCount > 0 && s.HourlyCount >= l.MaxHourlyCount {
+		return &LimitError{Code: LimitHourlyCount, Limit: int64(l.MaxHourlyCount), Used: int64(s.HourlyCount)}
+	}
+	return nil
+}
+
+// Limits returns spending limits of the account
+func (ac Account) Limits() SpendingLimits { return ac.limits }
+
+type LimitCode string
+
+const (
+	LimitSingleAmount  LimitCode = "limit_single_amount"
+	LimitDailyAmount   LimitCode = "limit_daily_amount"
+	LimitMonthlyAmount LimitCode = "limit_monthly_amount"
+	LimitHourlyCount   LimitCode = "limit_hourly_count"
+)
+
+// LimitError rejects a transfer breaching a spending limit, Code tells
+// which one. Used is what the window had taken before the transfer.
+type LimitError struct {
+	Code  LimitCode
+	Limit int64
+	Used  int64
+}
+
+func (e *LimitError) Error() string {
+	switch e.Code {
+	case LimitSingleAmount:
+		return "transfer exceeds the single transfer limit"
+	case LimitDailyAmount:
+		return "transfer exceeds the daily limit"
+	case LimitMonthlyAmount:
+		return "transfer exceeds the monthly limit"
+	}
+	return "no more than " + strconv.Itoa(int(e.Limit)) + " transfers are allowed per hour"
+}
+
+// Spending is what an account has sent within the limit windows
+type Spending struct {
+	Daily       int64
+	Monthly     int64
+	HourlyCount int
+}
+
+func (s Spending) add(amount int64) Spending {
+	s.Daily = saturatingAdd(s.Daily, amount)
+	s.Monthly = saturatingAdd(s.Monthly, amount)
+	s.HourlyCount++
+	return s
+}
+
+func saturatingAdd(a int64, b int64) int64 {
+	res, ok := overflow.Add64(a, b)
+	if !ok {
+		return math.MaxInt64
+	}
+	return res
+}
+
+// spent sums transfers, exchanges and hold captures sent from the account
+// in the windows ending at the time. Postings are recorded in time order,
+// so the scan stops at the first one older than a month.
+func (l *Ledger) spent(id uuid.UUID, at time.Time) Spending {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var s Spending
+	month, day, hour := at.Add(-30*24*time.Hour), at.Add(-24*time.Hour), at.Add(-time.Hour)
+
+	postings := l.postings[id]
+	for i := len(postings) - 1; i >= 0; i-- {
+		p := postings[i]
+		if !p.CreatedAt.After(month) {
+			break
+		}
+		if p.Type != Debit || p.CreatedAt.After(at) {
+			continue
+		}
+		if kind := l.transactions[l.byID[p.TxID]].Kind; kind != KindTransfer && kind != KindExchange && kind != KindCapture {
+			continue
+		}
+
+		s.Monthly = saturatingAdd(s.Monthly, p.Amount)
+		if p.CreatedAt.After(day) {
+			s.Daily = saturatingAdd(s.Daily, p.Amount)
+		}
+		if p.CreatedAt.After(hour) {
+			s.HourlyCount++
+		}
+	}
+	return s
+}
+
+// checkLimits validates the transfer against spending limits of the
+// originating account, pending is spent by transfers not recorded yet.
+// Active holds are spent as well.
+func (b *Bank) checkLimits(from Account, amount int64, at time.Time, pending Spending) error {
+	if from.limits.none() {
+		return nil
+	}
+
+	s := b.ledger.spent(from.id, at)
+	for _, p := range []Spending{pending, b.holds.pending(from.id, at)} {
+		s.Daily = saturatingAdd(s.Daily, p.Daily)
+		s.Monthly = saturatingAdd(s.Monthly, p.Monthly)
+		s.HourlyCount += p.HourlyCount
+	}
+	return from.limits.check(s, amount)
+}
+
+// SpendingOf returns what the account has sent within the limit windows
+func (b *Bank) SpendingOf(id uuid.UUID) (Spending, error) {
+	if _, err := b.storage.GetAccount(id); err != nil {
+		return Spending{}, err
+	}
+	return b.ledger.spent(id, now()), nil
+}
+
+// SetSpendingLimits replaces spending limits of the account, zero limits
+// remove them
+func (b *Bank) SetSpendingLimits(id uuid.UUID, limits SpendingLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(id)
+	defer unlock()
+
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return err
+	}
+
+	if ac.status == AccountClosed {
+		return ErrAccountClosed
+	}
+
+	return b.commit(&limitsChanged{AccountID: id, Limits: limits, At: now()})
+}
@@ -0,0 +1,174 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedger_Spent(t *testing.T) {
+	l := NewLedger()
+	a1, a2 := uuid.New(), uuid.New()
+	at := time.Date(2019, time.June, 30, 12, 0, 0, 0, time.UTC)
+
+	record := func(kind TransactionKind, from uuid.UUID, to uuid.UUID, amount int64, ago time.Duration) {
+		l.record(newTransaction(uuid.New(), kind, "EUR", from, to, amount, 0, 0, at.Add(-ago)))
+	}
+	record(KindTransfer, a1, a2, 1, 31*24*time.Hour)
+	record(KindTransfer, a1, a2, 10, 29*24*time.Hour)
+	record(KindTransfer, a1, a2, 100, 2*time.Hour)
+	record(KindTransfer, a1, a2, 1000, 30*time.Minute)
+	// incoming money and reversals are not spending
+	record(KindTransfer, a2, a1, 10000, 10*time.Minute)
+	record(KindReversal, a1, a2, 100000, 5*time.Minute)
+	// captured holds are
+	record(KindCapture, a1, a2, 5, 20*time.Minute)
+
+	s := l.spent(a1, at)
+	assert.Equal(t, int64(1115), s.Monthly)
+	assert.Equal(t, int64(1105), s.Daily)
+	assert.Equal(t, 2, s.HourlyCount)
+}
+
+func TestSpendingLimits_Check(t *testing.T) {
+	l := SpendingLimits{MaxAmount: 100, MaxDaily: 500, MaxMonthly: 1000, MaxHourlyCount: 3}
+
+	assert.Nil(t, l.check(Spending{Daily: 400, Monthly: 900, HourlyCount: 2}, 100))
+
+	err := l.check(Spending{}, 101)
+	assert.Equal(t, &LimitError{Code: LimitSingleAmount, Limit: 100}, err)
+	err = l.check(Spending{Daily: 401}, 100)
+	assert.Equal(t, LimitDailyAmount, err.(*LimitError).Code)
+	assert.Equal(t, int64(401), err.(*LimitError).Used)
+	err = l.check(Spending{Monthly: 901}, 100)
+	assert.Equal(t, LimitMonthlyAmount, err.(*LimitError).Code)
+	err = l.check(Spending{HourlyCount: 3}, 1)
+	assert.Equal(t, LimitHourlyCount, err.(*LimitError).Code)
+
+	assert.Nil(t, SpendingLimits{}.check(Spending{Daily: 1 << 62, HourlyCount: 1000}, 1<<62))
+	assert.NotNil(t, SpendingLimits{MaxAmount: -1}.validate())
+}
+
+func TestBank_SpendingLimits(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(10000)
+	a2, _ := b.CreateAccount(0)
+
+	assert.Nil(t, b.SetSpendingLimits(a1, SpendingLimits{MaxAmount: 500, MaxDaily: 1000, MaxHourlyCount: 3}))
+	assert.NotNil(t, b.SetSpendingLimits(a1, SpendingLimits{MaxDaily: -1}))
+	assert.Equal(t, ErrAccountNotFound, b.SetSpendingLimits(uuid.New(), SpendingLimits{}))
+
+	_, err := b.Transfer(a1, a2, 501)
+	assert.Equal(t, LimitSingleAmount, err.(*LimitError).Code)
+
+	_, err = b.Transfer(a1, a2, 500)
+	assert.Nil(t, err)
+
+	// the batch counts its own legs
+	_, err = b.TransferBatch([]TransferLeg{{From: a1, To: a2, Amount: 300}, {From: a1, To: a2, Amount: 300}})
+	if assert.IsType(t, &BatchError{}, err) {
+		legs := err.(*BatchError).Legs
+		assert.Len(t, legs, 1)
+		assert.Equal(t, LimitDailyAmount, legs[1].(*LimitError).Code)
+	}
+
+	_, err = b.Transfer(a1, a2, 100)
+	assert.Nil(t, err)
+	_, err = b.Transfer(a1, a2, 100)
+	assert.Nil(t, err)
+	_, err = b.Transfer(a1, a2, 100)
+	assert.Equal(t, LimitHourlyCount, err.(*LimitError).Code)
+
+	// incoming transfers are not limited
+	_, err = b.Transfer(a2, a1, 700)
+	assert.Nil(t, err)
+
+	spent, err := b.SpendingOf(a1)
+	assert.Nil(t, err)
+	assert.Equal(t, Spending{Daily: 700, Monthly: 700, HourlyCount: 3}, spent)
+
+	// zero limits remove them
+	assert.Nil(t, b.SetSpendingLimits(a1, SpendingLimits{}))
+	_, err = b.Transfer(a1, a2, 5000)
+	assert.Nil(t, err)
+}
+
+func TestBank_SpendingLimitsHolds(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(10000)
+	a2, _ := b.CreateAccount(0)
+	assert.Nil(t, b.SetSpendingLimits(a1, SpendingLimits{MaxAmount: 500, MaxDaily: 800}))
+
+	_, err := b.PlaceHold(a1, 501, 0)
+	assert.Equal(t, LimitSingleAmount, err.(*LimitError).Code)
+
+	// active holds are spending
+	h, err := b.PlaceHold(a1, 500, 0)
+	assert.Nil(t, err)
+	_, err = b.PlaceHold(a1, 400, 0)
+	assert.Equal(t, LimitDailyAmount, err.(*LimitError).Code)
+	_, err = b.Transfer(a1, a2, 400)
+	assert.Equal(t, LimitDailyAmount, err.(*LimitError).Code)
+
+	// so are captured ones, released ones are not
+	_, err = b.CaptureHold(h.ID, a2, 300)
+	assert.Nil(t, err)
+	spent, _ := b.SpendingOf(a1)
+	assert.Equal(t, int64(300), spent.Daily)
+	_, err = b.Transfer(a1, a2, 500)
+	assert.Nil(t, err)
+	_, err = b.Transfer(a1, a2, 1)
+	assert.Equal(t, LimitDailyAmount, err.(*LimitError).Code)
+}
+
+func TestBank_SpendingLimitsPersisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	limits := SpendingLimits{MaxAmount: 10, MaxMonthly: 100}
+	fill := func(b *Bank) uuid.UUID {
+		a1, _ := b.CreateAccount(1000)
+		assert.Nil(t, b.SetSpendingLimits(a1, limits))
+		return a1
+	}
+
+	check := func(b *Bank, a1 uuid.UUID) {
+		ac, _ := b.GetAccount(a1)
+		assert.Equal(t, limits, ac.Limits())
+	}
+
+	// write-ahead log, before and after snapshot
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	a1 := fill(b)
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1)
+	assert.Nil(t, b.Close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	a1 = fill(b)
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	check(b, a1)
+	assert.Nil(t, b.Close())
+}
@@ -0,0 +1,82 @@
+package bank
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+)
+
+// accountLocks hands out a mutex per account. An entry lives only while
+// someone holds or waits for it, so IDs sent by clients, known accounts or
+// not, do not pile up.
+type accountLocks struct {
+	locks map[uuid.UUID]*accountLock
+	mu    *sync.Mutex
+}
+
+type accountLock struct {
+	mu   *sync.Mutex
+	refs int
+}
+
+func newAccountLocks() *accountLocks {
+	return &accountLocks{
+		locks: make(map[uuid.UUID]*accountLock),
+		mu:    &sync.Mutex{},
+	}
+}
+
+func (l *accountLocks) get(id uuid.UUID) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.locks[id]
+	if !ok {
+		e = &accountLock{mu: &sync.Mutex{}}
+		l.locks[id] = e
+	}
+	e.refs++
+	return e.mu
+}
+
+// put drops the entry once nobody holds or waits for it
+func (l *accountLocks) put(id uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.locks[id]
+	e.refs--
+	if e.refs == 0 {
+		delete(l.locks, id)
+	}
+}
+
+// lock locks the accounts in UUID order, so that transfers between the same
+// accounts in opposite directions can not deadlock. Returns the unlock func.
+func (l *accountLocks) lock(ids ...uuid.UUID) func() {
+	sorted := make([]uuid.UUID, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+
+	var locked []uuid.UUID
+	var mutexes []*sync.Mutex
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		m := l.get(id)
+		m.Lock()
+		locked = append(locked, id)
+		mutexes = append(mutexes, m)
+	}
+
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+			l.put(locked[i])
+		}
+	}
+}
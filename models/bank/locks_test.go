@@ -0,0 +1,82 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestAccountLocks_OppositeOrder(t *testing.T) {
+	locks := newAccountLocks()
+	a, b := uuid.New(), uuid.New()
+
+	// would deadlock quickly if locks were taken in argument order
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			locks.lock(a, b)()
+		}()
+		go func() {
+			defer wg.Done()
+			locks.lock(b, a)()
+		}()
+	}
+	wg.Wait()
+
+	// same account twice is locked once
+	locks.lock(a, a)()
+	assert.Empty(t, locks.locks)
+}
+
+func TestBank_UnknownAccountsLocks(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+
+	for i := 0; i < 10; i++ {
+		_, err := b.Transfer(a1, uuid.New(), 10)
+		assert.Equal(t, ErrToNotFound, err)
+	}
+	assert.Empty(t, b.locks.locks)
+}
+
+func TestBank_ConcurrentTransfers(t *testing.T) {
+	b := NewBank()
+
+	ids := make([]uuid.UUID, 10)
+	for i := range ids {
+		ids[i], _ = b.CreateAccount(1000)
+	}
+
+	wg := &sync.WaitGroup{}
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				from, to := ids[r.Intn(len(ids))], ids[r.Intn(len(ids))]
+				b.Transfer(from, to, int64(r.Intn(300)+1))
+				b.GetAccountBalance(from)
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	// no money is created or lost and the ledger agrees with balances
+	var total int64
+	for _, id := range ids {
+		balance, err := b.GetAccountBalance(id)
+		assert.Nil(t, err)
+		assert.Equal(t, balance, strconv.FormatInt(b.Ledger().Balance(id), 10))
+
+		v, _ := strconv.ParseInt(balance, 10, 64)
+		assert.True(t, v >= 0)
+		total += v
+	}
+	assert.Equal(t, int64(10000), total)
+}
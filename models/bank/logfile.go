@@ -0,0 +1,189 @@
+package bank
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// logFile is an append-only file of checksummed lines "<crc32 hex> <body>".
+// Every append is fsync'd before it returns.
+type logFile struct {
+	file *os.File
+	size int64
+	mu   *sync.Mutex
+	// err is the failure of the last write, nil once one succeeds, or
+	// os.ErrClosed after close. It has its own lock, so checks do not wait
+	// for appends syncing the file.
+	err   error
+	errMu *sync.Mutex
+}
+
+// openLogFile opens or creates the file and returns bodies of the lines
+// already in it. A torn last line, left by a crash in the middle of a
+// write, is cut off.
+func openLogFile(path string) (*logFile, [][]byte, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l := &logFile{file: file, mu: &sync.Mutex{}, errMu: &sync.Mutex{}}
+	bodies, err := l.read()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return l, bodies, nil
+}
+
+func (l *logFile) read() ([][]byte, error) {
+	bodies, size, err := scanLines(l.file)
+	l.size = size
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.file.Truncate(l.size); err != nil {
+		return nil, err
+	}
+	if _, err := l.file.Seek(l.size, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return bodies, nil
+}
+
+// readLogFile returns bodies of the lines in the file without opening it
+// for writes
+func readLogFile(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bodies, _, err := scanLines(file)
+	return bodies, err
+}
+
+// scanLines returns bodies of the lines and the size of the file up to the
+// torn last line, if any
+func scanLines(file *os.File) ([][]byte, int64, error) {
+	var bodies [][]byte
+	var size int64
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// incomplete line is a torn write
+			break
+		}
+		if err != nil {
+			return nil, size, err
+		}
+
+		body, ok := decodeLine(line)
+		if !ok {
+			if _, err := r.Peek(1); err != io.EOF {
+				return nil, size, fmt.Errorf("%s corrupted at offset %d", file.Name(), size)
+			}
+			break
+		}
+
+		bodies = append(bodies, body)
+		size += int64(len(line))
+	}
+	return bodies, size, nil
+}
+
+func encodeLine(body []byte) []byte {
+	line := append([]byte(fmt.Sprintf("%08x ", crc32.ChecksumIEEE(body))), body...)
+	return append(line, '\n')
+}
+
+func decodeLine(line []byte) ([]byte, bool) {
+	parts := bytes.SplitN(bytes.TrimSuffix(line, []byte("\n")), []byte(" "), 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+
+	var sum uint32
+	if _, err := fmt.Sscanf(string(parts[0]), "%08x", &sum); err != nil || sum != crc32.ChecksumIEEE(parts[1]) {
+		return nil, false
+	}
+	return parts[1], true
+}
+
+func (l *logFile) append(body []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	line := encodeLine(body)
+	if _, err := l.file.Write(line); err != nil {
+		// drop whatever part of the line made it to the file
+		l.rollback()
+		l.setErr(err)
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.rollback()
+		l.setErr(err)
+		return err
+	}
+
+	l.size += int64(len(line))
+	l.setErr(nil)
+	return nil
+}
+
+func (l *logFile) rollback() {
+	l.file.Truncate(l.size)
+	l.file.Seek(l.size, io.SeekStart)
+}
+
+// reset drops all lines
+func (l *logFile) reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l.size = 0
+	return l.file.Sync()
+}
+
+func (l *logFile) setErr(err error) {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+
+	l.err = err
+}
+
+// check fails if the last write did or the file is closed. It never waits
+// for a write in progress, so it tells nothing of whether the next one
+// succeeds.
+func (l *logFile) check() error {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+
+	return l.err
+}
+
+func (l *logFile) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.setErr(os.ErrClosed)
+	return l.file.Close()
+}
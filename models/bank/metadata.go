@@ -0,0 +1,89 @@
+package bank
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxMetadataLength = 255
+	maxTags           = 32
+)
+
+var ErrExternalRefTaken = errors.New("external reference is already used by the owner")
+
+func validateMetadata(params AccountParams) error {
+	if len(params.Owner) > maxMetadataLength {
+		return errors.New("owner is too long")
+	}
+	if len(params.Name) > maxMetadataLength {
+		return errors.New("name is too long")
+	}
+	if len(params.ExternalRef) > maxMetadataLength {
+		return errors.New("external reference is too long")
+	}
+
+	if len(params.Tags) > maxTags {
+		return errors.New("account can not have more than " + strconv.Itoa(maxTags) + " tags")
+	}
+	for _, tag := range params.Tags {
+		if tag == "" {
+			return errors.New("tag can not be empty")
+		}
+		if len(tag) > maxMetadataLength {
+			return errors.New("tag is too long")
+		}
+	}
+	return nil
+}
+
+// externalRefs maps external references of every owner to accounts
+type externalRefs struct {
+	accounts map[string]uuid.UUID
+	mu       *sync.Mutex
+}
+
+func newExternalRefs() *externalRefs {
+	return &externalRefs{
+		accounts: make(map[string]uuid.UUID),
+		mu:       &sync.Mutex{},
+	}
+}
+
+func refKey(owner string, ref string) string {
+	return strconv.Quote(owner) + " " + strconv.Quote(ref)
+}
+
+// reserve takes the reference for the account unless another account has
+// it already. Empty references are not unique.
+func (r *externalRefs) reserve(owner string, ref string, id uuid.UUID) bool {
+	if ref == "" {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if taken, ok := r.accounts[refKey(owner, ref)]; ok && taken != id {
+		return false
+	}
+	r.accounts[refKey(owner, ref)] = id
+	return true
+}
+
+// release frees the reference reserved for the account which was not
+// created after all
+func (r *externalRefs) release(owner string, ref string, id uuid.UUID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.accounts[refKey(owner, ref)] == id {
+		delete(r.accounts, refKey(owner, ref))
+	}
+}
+
+func (r *externalRefs) put(ac Account) {
+	r.reserve(ac.owner, ac.externalRef, ac.id)
+}
@@ -0,0 +1,108 @@
+package bank
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBank_CreateAccountMetadata(t *testing.T) {
+	b := NewBank()
+
+	tags := []string{"vip", "salary"}
+	id, err := b.CreateAccountWith(AccountParams{Owner: "crm-42", Name: "Main", ExternalRef: "acc-1", Tags: tags})
+	assert.Nil(t, err)
+	tags[0] = "changed"
+
+	ac, _ := b.GetAccount(id)
+	assert.Equal(t, "crm-42", ac.Owner())
+	assert.Equal(t, "Main", ac.Name())
+	assert.Equal(t, "acc-1", ac.ExternalRef())
+	assert.Equal(t, []string{"vip", "salary"}, ac.Tags())
+
+	// reference is unique per owner
+	_, err = b.CreateAccountWith(AccountParams{Owner: "crm-42", ExternalRef: "acc-1"})
+	assert.Equal(t, ErrExternalRefTaken, err)
+	_, err = b.CreateAccountWith(AccountParams{Owner: "crm-43", ExternalRef: "acc-1"})
+	assert.Nil(t, err)
+	_, err = b.CreateAccountWith(AccountParams{Owner: "crm-42", ExternalRef: "acc-2"})
+	assert.Nil(t, err)
+
+	// empty references are not checked
+	_, err = b.CreateAccountWith(AccountParams{Owner: "crm-42"})
+	assert.Nil(t, err)
+	_, err = b.CreateAccountWith(AccountParams{Owner: "crm-42"})
+	assert.Nil(t, err)
+}
+
+func TestBank_CreateAccountMetadataValidation(t *testing.T) {
+	b := NewBank()
+	long := strings.Repeat("x", maxMetadataLength+1)
+
+	cases := map[string]AccountParams{
+		"long owner":     {Owner: long},
+		"long name":      {Name: long},
+		"long reference": {ExternalRef: long},
+		"long tag":       {Tags: []string{long}},
+		"empty tag":      {Tags: []string{""}},
+		"too many tags":  {Tags: make([]string, maxTags+1)},
+	}
+
+	for name, params := range cases {
+		_, err := b.CreateAccountWith(params)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestBank_MetadataPersisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	params := AccountParams{Owner: "crm-42", Name: "Main", ExternalRef: "acc-1", Tags: []string{"vip"}}
+	check := func(b *Bank) {
+		accounts, _ := b.storage.ListAccounts()
+		if assert.Len(t, accounts, 1) {
+			assert.Equal(t, "Main", accounts[0].Name())
+			assert.Equal(t, []string{"vip"}, accounts[0].Tags())
+		}
+
+		_, err := b.CreateAccountWith(params)
+		assert.Equal(t, ErrExternalRefTaken, err)
+	}
+
+	// write-ahead log, before and after snapshot
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	_, err = b.CreateAccountWith(params)
+	assert.Nil(t, err)
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b)
+	assert.Nil(t, b.Close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	_, err = b.CreateAccountWith(params)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	check(b)
+	assert.Nil(t, b.Close())
+}
@@ -0,0 +1,102 @@
+package bank
+
+import (
+	"simple_bank/metrics"
+	"time"
+)
+
+var (
+	accountsCreated = metrics.Default.NewCounter("simplebank_accounts_created_total",
+		"Accounts created.")
+	transfersSucceeded = metrics.Default.NewCounter("simplebank_transfers_succeeded_total",
+		"Transfers, exchanges, batch legs, scheduled runs, hold captures and reversals made.")
+	transfersFailed = metrics.Default.NewCounter("simplebank_transfers_failed_total",
+		"Transfers, exchanges, batch legs, scheduled runs, hold captures and reversals refused, by reason.", "reason")
+	lockWait = metrics.Default.NewHistogram("simplebank_bank_lock_wait_seconds",
+		"Time waited for the bank lock, shared by changes and exclusive for snapshots.",
+		[]float64{1e-6, 1e-5, 1e-4, 1e-3, 1e-2, .1, 1, 10}, "mode")
+
+	_ = metrics.Default.NewGaugeFunc("simplebank_money",
+		"Sum of account balances by currency in minor units, it changes with opening balances and exchanges only.",
+		[]string{"currency"}, func() []metrics.Sample { return GetBank().moneySamples() })
+)
+
+// readLock takes the bank lock shared by changes
+func (b *Bank) readLock() {
+	start := time.Now()
+	b.mu.RLock()
+	lockWait.Observe(time.Since(start).Seconds(), "read")
+}
+
+// writeLock takes the bank lock exclusively
+func (b *Bank) writeLock() {
+	start := time.Now()
+	b.mu.Lock()
+	lockWait.Observe(time.Since(start).Seconds(), "write")
+}
+
+// observeTransfer counts the transfer by its result
+func observeTransfer(err error) {
+	if err == nil {
+		transfersSucceeded.Inc()
+		return
+	}
+	transfersFailed.Inc(failureReason(err))
+}
+
+// observeBatch counts every leg of a made batch, or the failed legs of a
+// refused one
+func observeBatch(legs int, err error) {
+	if err == nil {
+		transfersSucceeded.Add(float64(legs))
+		return
+	}
+
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		transfersFailed.Inc(failureReason(err))
+		return
+	}
+	for _, legErr := range batchErr.Legs {
+		transfersFailed.Inc(failureReason(legErr))
+	}
+}
+
+// failureReason names the error with a few values fit for metric labels
+func failureReason(err error) string {
+	if e, ok := err.(*LimitError); ok {
+		return string(e.Code)
+	}
+
+	switch err {
+	case ErrAccountNotFound, ErrFromNotFound, ErrToNotFound:
+		return "account_not_found"
+	case ErrInsufficientFunds, ErrFeeNotCovered:
+		return "insufficient_funds"
+	case ErrDebitsFrozen, ErrAccountFrozen:
+		return "account_frozen"
+	case ErrAccountClosed:
+		return "account_closed"
+	}
+	return "other"
+}
+
+// moneySamples sums balances by currency. Accounts are read one by one, so
+// the sum may be off while transfers go on.
+func (b *Bank) moneySamples() []metrics.Sample {
+	accounts, err := b.storage.ListAccounts()
+	if err != nil {
+		return nil
+	}
+
+	sums := make(map[string]float64)
+	for _, ac := range accounts {
+		sums[ac.currency] += float64(ac.balance)
+	}
+
+	samples := make([]metrics.Sample, 0, len(sums))
+	for code, sum := range sums {
+		samples = append(samples, metrics.Sample{Labels: []string{code}, Value: sum})
+	}
+	return samples
+}
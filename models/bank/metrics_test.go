@@ -0,0 +1,62 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"simple_bank/models/currency"
+	"testing"
+)
+
+func TestBank_TransferMetrics(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(100)
+	a2, _ := b.CreateAccount(0)
+	assert.Nil(t, b.SetSpendingLimits(a2, SpendingLimits{MaxAmount: 10}))
+
+	succeeded := transfersSucceeded.Value()
+	insufficient := transfersFailed.Value("insufficient_funds")
+	notFound := transfersFailed.Value("account_not_found")
+	limit := transfersFailed.Value(string(LimitSingleAmount))
+
+	_, err := b.Transfer(a1, a2, 50)
+	assert.Nil(t, err)
+	_, err = b.Transfer(a1, a2, 500)
+	assert.Equal(t, ErrInsufficientFunds, err)
+	_, err = b.Transfer(a1, uuid.New(), 5)
+	assert.Equal(t, ErrToNotFound, err)
+	_, err = b.Transfer(a2, a1, 20)
+	assert.IsType(t, &LimitError{}, err)
+
+	assert.Equal(t, succeeded+1, transfersSucceeded.Value())
+	assert.Equal(t, insufficient+1, transfersFailed.Value("insufficient_funds"))
+	assert.Equal(t, notFound+1, transfersFailed.Value("account_not_found"))
+	assert.Equal(t, limit+1, transfersFailed.Value(string(LimitSingleAmount)))
+
+	// every way of moving money is counted
+	_, err = b.TransferBatch([]TransferLeg{{From: a1, To: a2, Amount: 5}, {From: a1, To: a2, Amount: 5}})
+	assert.Nil(t, err)
+	_, err = b.TransferBatch([]TransferLeg{{From: a1, To: a2, Amount: 500}})
+	assert.NotNil(t, err)
+	h, _ := b.PlaceHold(a1, 5, 0)
+	_, err = b.CaptureHold(h.ID, a2, 5)
+	assert.Nil(t, err)
+	txID, _ := b.Transfer(a1, a2, 5)
+	_, err = b.ReverseTransfer(txID, 0)
+	assert.Nil(t, err)
+
+	assert.Equal(t, succeeded+6, transfersSucceeded.Value())
+	assert.Equal(t, insufficient+2, transfersFailed.Value("insufficient_funds"))
+}
+
+func TestBank_MoneySamples(t *testing.T) {
+	b := NewBank()
+	b.CreateAccount(100)
+	b.CreateAccount(250)
+	b.CreateAccountWith(AccountParams{Balance: 7, Currency: "EUR"})
+
+	sums := make(map[string]float64)
+	for _, s := range b.moneySamples() {
+		sums[s.Labels[0]] = s.Value
+	}
+	assert.Equal(t, map[string]float64{currency.Default: 350, "EUR": 7}, sums)
+}
@@ -0,0 +1,67 @@
+package bank
+
+import (
+	"errors"
+	"github.com/JohnCGriffin/overflow"
+	"github.com/google/uuid"
+	"math"
+	"time"
+)
+
+// OverdraftLimit is how far below zero the balance may go
+func (ac Account) OverdraftLimit() int64 { return ac.overdraft }
+
+// withOverdraft adds the overdraft limit of the account to v, capped at the
+// largest int64
+func withOverdraft(v int64, ac Account) int64 {
+	res, ok := overflow.Add64(v, ac.overdraft)
+	if !ok {
+		return math.MaxInt64
+	}
+	return res
+}
+
+// Headroom is what can still be spent from the account: the available
+// balance plus the overdraft limit
+func (b *Bank) Headroom(id uuid.UUID) (int64, error) {
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return 0, err
+	}
+	return b.headroom(ac, now()), nil
+}
+
+func (b *Bank) headroom(ac Account, at time.Time) int64 {
+	return withOverdraft(b.available(ac, at), ac)
+}
+
+// SetOverdraftLimit changes how far below zero the balance may go. The
+// limit can not be lowered below what the account already spends of it.
+func (b *Bank) SetOverdraftLimit(id uuid.UUID, limit int64) error {
+	if limit < 0 {
+		return errors.New("overdraft limit can not be negative")
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(id)
+	defer unlock()
+
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return err
+	}
+
+	if ac.status == AccountClosed {
+		return ErrAccountClosed
+	}
+
+	at := now()
+	ac.overdraft = limit
+	if b.headroom(ac, at) < 0 {
+		return errors.New("account already uses more of the overdraft than the limit")
+	}
+
+	return b.commit(&overdraftChanged{AccountID: id, Limit: limit, At: at})
+}
@@ -0,0 +1,149 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBank_Overdraft(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccountWith(AccountParams{Balance: 100, Overdraft: 500})
+	a2, _ := b.CreateAccount(0)
+
+	_, err := b.CreateAccountWith(AccountParams{Overdraft: -1})
+	assert.NotNil(t, err)
+
+	headroom, _ := b.Headroom(a1)
+	assert.Equal(t, int64(600), headroom)
+
+	_, err = b.Transfer(a1, a2, 601)
+	assert.NotNil(t, err)
+	_, err = b.Transfer(a1, a2, 400)
+	assert.Nil(t, err)
+
+	ac, _ := b.GetAccount(a1)
+	assert.Equal(t, int64(-300), ac.Balance())
+	assert.Equal(t, int64(500), ac.OverdraftLimit())
+
+	// holds count against the overdraft too
+	h, err := b.PlaceHold(a1, 150, 0)
+	assert.Nil(t, err)
+	headroom, _ = b.Headroom(a1)
+	assert.Equal(t, int64(50), headroom)
+	_, err = b.Transfer(a1, a2, 51)
+	assert.NotNil(t, err)
+	_, err = b.CaptureHold(h.ID, a2, 150)
+	assert.Nil(t, err)
+
+	// accounts without a limit can not go below zero
+	_, err = b.Transfer(a2, a1, 551)
+	assert.NotNil(t, err)
+
+	// the limit can not be lowered below the debt
+	assert.NotNil(t, b.SetOverdraftLimit(a1, 400))
+	assert.NotNil(t, b.SetOverdraftLimit(a1, -1))
+	assert.Nil(t, b.SetOverdraftLimit(a1, 450))
+	headroom, _ = b.Headroom(a1)
+	assert.Equal(t, int64(0), headroom)
+	assert.Equal(t, ErrAccountNotFound, b.SetOverdraftLimit(uuid.New(), 100))
+
+	_, err = b.CloseAccount(a1, a2, "owner", "moving out")
+	assert.NotNil(t, err)
+}
+
+func TestBank_OverdraftNotReversed(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccountWith(AccountParams{Overdraft: 500})
+	a3, _ := b.CreateAccount(0)
+
+	txID, err := b.Transfer(a1, a2, 300)
+	assert.Nil(t, err)
+	_, err = b.Transfer(a2, a3, 200)
+	assert.Nil(t, err)
+
+	// the recipient could go into overdraft but reversals take real money
+	_, err = b.ReverseTransfer(txID, 0)
+	assert.Equal(t, ErrInsufficientFunds, err)
+	_, err = b.ReverseTransfer(txID, 100)
+	assert.Nil(t, err)
+
+	ac, _ := b.GetAccount(a2)
+	assert.Equal(t, int64(0), ac.Balance())
+}
+
+func TestBank_OverdraftOverflow(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccountWith(AccountParams{Balance: 100, Overdraft: math.MaxInt64})
+	a2, _ := b.CreateAccount(0)
+
+	headroom, _ := b.Headroom(a1)
+	assert.Equal(t, int64(math.MaxInt64), headroom)
+
+	_, err := b.Transfer(a1, a2, math.MaxInt64)
+	assert.Nil(t, err)
+
+	ac, _ := b.GetAccount(a1)
+	assert.Equal(t, int64(100-math.MaxInt64), ac.Balance())
+
+	// the balance would wrap around
+	a3, _ := b.CreateAccount(0)
+	_, err = b.Transfer(a1, a3, 102)
+	assert.NotNil(t, err)
+}
+
+func TestBank_OverdraftPersisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	fill := func(b *Bank) uuid.UUID {
+		a1, _ := b.CreateAccountWith(AccountParams{Overdraft: 100})
+		a2, _ := b.CreateAccount(0)
+		_, err := b.Transfer(a1, a2, 80)
+		assert.Nil(t, err)
+		assert.Nil(t, b.SetOverdraftLimit(a1, 200))
+		return a1
+	}
+
+	check := func(b *Bank, a1 uuid.UUID) {
+		ac, _ := b.GetAccount(a1)
+		assert.Equal(t, int64(-80), ac.Balance())
+		assert.Equal(t, int64(200), ac.OverdraftLimit())
+	}
+
+	// write-ahead log, before and after snapshot
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	a1 := fill(b)
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1)
+	assert.Nil(t, b.Close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	a1 = fill(b)
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	check(b, a1)
+	assert.Nil(t, b.Close())
+}
@@ -0,0 +1,546 @@
+package bank
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/uuid"
+	"simple_bank/models/clock"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts  = 3
+	DefaultRetryBackoff = time.Hour
+	maxAttempts         = 100
+	// startSkew is how far in the past a start time is taken as now, to
+	// allow for clock differences with the client
+	startSkew = time.Minute
+	// maxCatchUp is how many missed occurrences of a scheduled transfer
+	// are caught up, older ones are skipped as a single missed run
+	maxCatchUp = 5
+)
+
+var ErrScheduleNotFound = errors.New("no scheduled transfer found")
+
+type Frequency string
+
+const (
+	// Once is a single transfer at the start time
+	Once    Frequency = ""
+	Daily   Frequency = "daily"
+	Weekly  Frequency = "weekly"
+	Monthly Frequency = "monthly"
+)
+
+// Recurrence repeats a scheduled transfer at the time of day of its start.
+// Monthly transfers run on Day of every month, on the last day of months
+// shorter than that.
+type Recurrence struct {
+	Every Frequency `json:"every,omitempty"`
+	Day   int       `json:"day,omitempty"`
+}
+
+func (r Recurrence) validate() error {
+	switch r.Every {
+	case Once, Daily, Weekly:
+		if r.Day != 0 {
+			return errors.New("day is only allowed for monthly transfers")
+		}
+	case Monthly:
+		if r.Day < 1 || r.Day > 31 {
+			return errors.New("day of month must be between 1 and 31")
+		}
+	default:
+		return errors.New("recurrence must be daily, weekly or monthly")
+	}
+	return nil
+}
+
+// first returns the first occurrence not before start
+func (r Recurrence) first(start time.Time) time.Time {
+	if r.Every != Monthly {
+		return start
+	}
+
+	y, m, _ := start.Date()
+	t := monthDay(y, m, r.Day, start)
+	if t.Before(start) {
+		t = monthDay(y, m+1, r.Day, start)
+	}
+	return t
+}
+
+// next returns the occurrence after t, zero for single transfers
+func (r Recurrence) next(t time.Time) time.Time {
+	switch r.Every {
+	case Daily:
+		return t.AddDate(0, 0, 1)
+	case Weekly:
+		return t.AddDate(0, 0, 7)
+	case Monthly:
+		y, m, _ := t.Date()
+		return monthDay(y, m+1, r.Day, t)
+	}
+	return time.Time{}
+}
+
+// monthDay returns the day of the month at the time of day of t, clamped
+// to the last day of the month
+func monthDay(y int, m time.Month, day int, t time.Time) time.Time {
+	// day zero of the next month is the last one of this month
+	if last := time.Date(y, m+1, 0, 0, 0, 0, 0, t.Location()).Day(); day > last {
+		day = last
+	}
+	h, min, s := t.Clock()
+	return time.Date(y, m, day, h, min, s, t.Nanosecond(), t.Location())
+}
+
+// RetryPolicy tells how many times an occurrence is attempted, including
+// the first attempt, and how long to wait between attempts
+type RetryPolicy struct {
+	MaxAttempts int           `json:"max_attempts"`
+	Backoff     time.Duration `json:"backoff"`
+}
+
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	ScheduleCompleted ScheduleStatus = "completed"
+	// ScheduleFailed single transfers ran out of attempts
+	ScheduleFailed    ScheduleStatus = "failed"
+	ScheduleCancelled ScheduleStatus = "cancelled"
+)
+
+// ScheduledTransfer is a standing order. DueAt is the occurrence to be
+// executed next, NextRunAt is when, later than DueAt once the occurrence
+// has failed Attempts times. Occurrences out of attempts are skipped.
+type ScheduledTransfer struct {
+	ID         uuid.UUID      `json:"id"`
+	From       uuid.UUID      `json:"from"`
+	To         uuid.UUID      `json:"to"`
+	Amount     int64          `json:"amount"`
+	Currency   string         `json:"currency"`
+	Recurrence Recurrence     `json:"recurrence"`
+	Retry      RetryPolicy    `json:"retry"`
+	Status     ScheduleStatus `json:"status"`
+	DueAt      time.Time      `json:"due_at"`
+	NextRunAt  time.Time      `json:"next_run_at"`
+	Attempts   int            `json:"attempts"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+func (s ScheduledTransfer) cancelled(at time.Time) ScheduledTransfer {
+	s.Status = ScheduleCancelled
+	s.UpdatedAt = at
+	return s
+}
+
+// missed counts occurrences due by the time which are more than maxCatchUp
+// behind
+func (s ScheduledTransfer) missed(at time.Time) int {
+	if s.Recurrence.Every == Once {
+		return 0
+	}
+
+	n := 0
+	for t := s.DueAt; !t.After(at); t = s.Recurrence.next(t) {
+		n++
+	}
+	if n < maxCatchUp {
+		return 0
+	}
+	return n - maxCatchUp
+}
+
+// after returns the schedule as it is after the run
+func (s ScheduledTransfer) after(run ScheduledRun) ScheduledTransfer {
+	s.UpdatedAt = run.At
+
+	if run.Missed > 0 {
+		s.Attempts = 0
+		for i := 0; i < run.Missed; i++ {
+			s.DueAt = s.Recurrence.next(s.DueAt)
+		}
+		s.NextRunAt = s.DueAt
+		return s
+	}
+
+	if run.TxID == uuid.Nil {
+		s.Attempts++
+		if s.Attempts < s.Retry.MaxAttempts {
+			s.NextRunAt = run.At.Add(s.Retry.Backoff)
+			return s
+		}
+	}
+
+	// the occurrence is done, transferred or out of attempts
+	s.Attempts = 0
+	if s.Recurrence.Every == Once {
+		s.Status = ScheduleCompleted
+		if run.TxID == uuid.Nil {
+			s.Status = ScheduleFailed
+		}
+		return s
+	}
+
+	s.DueAt = s.Recurrence.next(s.DueAt)
+	s.NextRunAt = s.DueAt
+	return s
+}
+
+// ScheduledRun is an attempt to execute an occurrence of a scheduled
+// transfer, TxID is the transfer made by a successful one. Missed counts
+// occurrences from DueAt on which were skipped instead, being too far
+// behind to be caught up.
+type ScheduledRun struct {
+	ScheduleID uuid.UUID `json:"schedule_id"`
+	DueAt      time.Time `json:"due_at"`
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	TxID       uuid.UUID `json:"tx_id"`
+	Error      string    `json:"error,omitempty"`
+	Missed     int       `json:"missed,omitempty"`
+}
+
+// ScheduleParams describes a new scheduled transfer between accounts in
+// the same currency. Zero StartAt means now, a past one is rejected. Zero
+// Retry fields mean the defaults.
+type ScheduleParams struct {
+	From       uuid.UUID
+	To         uuid.UUID
+	Amount     int64
+	StartAt    time.Time
+	Recurrence Recurrence
+	Retry      RetryPolicy
+}
+
+// scheduleIndex keeps scheduled transfers and their runs in order, storage
+// only persists them
+type scheduleIndex struct {
+	schedules map[uuid.UUID]ScheduledTransfer
+	runs      map[uuid.UUID][]ScheduledRun
+	mu        *sync.RWMutex
+}
+
+func newScheduleIndex() *scheduleIndex {
+	return &scheduleIndex{
+		schedules: make(map[uuid.UUID]ScheduledTransfer),
+		runs:      make(map[uuid.UUID][]ScheduledRun),
+		mu:        &sync.RWMutex{},
+	}
+}
+
+func (idx *scheduleIndex) put(s ScheduledTransfer) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.schedules[s.ID] = s
+}
+
+func (idx *scheduleIndex) addRun(run ScheduledRun) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.runs[run.ScheduleID] = append(idx.runs[run.ScheduleID], run)
+}
+
+func (idx *scheduleIndex) get(id uuid.UUID) (ScheduledTransfer, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	s, ok := idx.schedules[id]
+	return s, ok
+}
+
+// activeOf returns active scheduled transfers from or to the account
+func (idx *scheduleIndex) activeOf(id uuid.UUID) []ScheduledTransfer {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var res []ScheduledTransfer
+	for _, s := range idx.schedules {
+		if s.Status == ScheduleActive && (s.From == id || s.To == id) {
+			res = append(res, s)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(res[i].ID[:], res[j].ID[:]) < 0
+	})
+	return res
+}
+
+func (idx *scheduleIndex) runsOf(id uuid.UUID) []ScheduledRun {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	res := make([]ScheduledRun, len(idx.runs[id]))
+	copy(res, idx.runs[id])
+	return res
+}
+
+// due returns active schedules to be run by the time, earliest first
+func (idx *scheduleIndex) due(at time.Time) []ScheduledTransfer {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var res []ScheduledTransfer
+	for _, s := range idx.schedules {
+		if s.Status == ScheduleActive && !s.NextRunAt.After(at) {
+			res = append(res, s)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].NextRunAt.Equal(res[j].NextRunAt) {
+			return res[i].NextRunAt.Before(res[j].NextRunAt)
+		}
+		return bytes.Compare(res[i].ID[:], res[j].ID[:]) < 0
+	})
+	return res
+}
+
+func (idx *scheduleIndex) all() ([]ScheduledTransfer, []ScheduledRun) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	schedules := make([]ScheduledTransfer, 0, len(idx.schedules))
+	for _, s := range idx.schedules {
+		schedules = append(schedules, s)
+	}
+	var runs []ScheduledRun
+	for _, r := range idx.runs {
+		runs = append(runs, r...)
+	}
+	return schedules, runs
+}
+
+// ScheduleTransfer creates a standing order, it is executed by a Scheduler
+func (b *Bank) ScheduleTransfer(p ScheduleParams) (ScheduledTransfer, error) {
+	if p.From == p.To {
+		return ScheduledTransfer{}, errors.New("accounts must be different")
+	}
+	if p.Amount <= 0 {
+		return ScheduledTransfer{}, errors.New("can not be zero or negative transfer")
+	}
+	if err := p.Recurrence.validate(); err != nil {
+		return ScheduledTransfer{}, err
+	}
+
+	if p.Retry.MaxAttempts == 0 {
+		p.Retry.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.Retry.Backoff == 0 {
+		p.Retry.Backoff = DefaultRetryBackoff
+	}
+	if p.Retry.MaxAttempts < 0 || p.Retry.MaxAttempts > maxAttempts {
+		return ScheduledTransfer{}, errors.New("max attempts must be between 1 and 100")
+	}
+	if p.Retry.Backoff < 0 {
+		return ScheduledTransfer{}, errors.New("retry backoff can not be negative")
+	}
+	at := now()
+	if !p.StartAt.IsZero() && p.StartAt.Before(at.Add(-startSkew)) {
+		return ScheduledTransfer{}, errors.New("start time can not be in the past")
+	}
+	if p.StartAt.Before(at) {
+		p.StartAt = at
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(p.From, p.To)
+	defer unlock()
+
+	from, to, err := b.getTransferAccounts(p.From, p.To)
+	if err != nil {
+		return ScheduledTransfer{}, err
+	}
+	if from.status == AccountClosed || to.status == AccountClosed {
+		return ScheduledTransfer{}, ErrAccountClosed
+	}
+	if from.currency != to.currency {
+		return ScheduledTransfer{}, errors.New("accounts have different currencies")
+	}
+
+	due := p.Recurrence.first(p.StartAt.UTC())
+
+	s := ScheduledTransfer{
+		ID:         uuid.New(),
+		From:       p.From,
+		To:         p.To,
+		Amount:     p.Amount,
+		Currency:   from.currency,
+		Recurrence: p.Recurrence,
+		Retry:      p.Retry,
+		Status:     ScheduleActive,
+		DueAt:      due,
+		NextRunAt:  due,
+		CreatedAt:  at,
+		UpdatedAt:  at,
+	}
+	if err := b.commit(&scheduleCreated{Schedule: s}); err != nil {
+		return ScheduledTransfer{}, err
+	}
+	return s, nil
+}
+
+func (b *Bank) GetScheduledTransfer(id uuid.UUID) (ScheduledTransfer, error) {
+	s, ok := b.schedules.get(id)
+	if !ok {
+		return ScheduledTransfer{}, ErrScheduleNotFound
+	}
+	return s, nil
+}
+
+// ScheduledRuns returns runs of the scheduled transfer, oldest first
+func (b *Bank) ScheduledRuns(id uuid.UUID) ([]ScheduledRun, error) {
+	if _, ok := b.schedules.get(id); !ok {
+		return nil, ErrScheduleNotFound
+	}
+	return b.schedules.runsOf(id), nil
+}
+
+// CancelScheduledTransfer stops the scheduled transfer, runs made so far
+// are kept
+func (b *Bank) CancelScheduledTransfer(id uuid.UUID) (ScheduledTransfer, error) {
+	s, ok := b.schedules.get(id)
+	if !ok {
+		return ScheduledTransfer{}, ErrScheduleNotFound
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	// runs hold the account locks as well
+	unlock := b.locks.lock(s.From, s.To)
+	defer unlock()
+
+	s, _ = b.schedules.get(id)
+	if s.Status != ScheduleActive {
+		return ScheduledTransfer{}, errors.New("scheduled transfer is already " + string(s.Status))
+	}
+
+	at := now()
+	if err := b.commit(&scheduleCancelled{ID: id, At: at}); err != nil {
+		return ScheduledTransfer{}, err
+	}
+
+	s.Status = ScheduleCancelled
+	s.UpdatedAt = at
+	return s, nil
+}
+
+// runSchedule makes one attempt of the scheduled transfer if it is due by
+// the time, the fee of the schedule is charged as for a single transfer.
+// Failed transfers are recorded as runs, the error is only returned if the
+// run can not be stored.
+func (b *Bank) runSchedule(id uuid.UUID, at time.Time) (bool, error) {
+	s, ok := b.schedules.get(id)
+	if !ok {
+		return false, ErrScheduleNotFound
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	feeSchedule := b.feeSchedule()
+	unlock := b.locks.lock(s.From, s.To)
+	defer unlock()
+
+	// it could have been cancelled while waiting for the locks
+	s, _ = b.schedules.get(id)
+	if s.Status != ScheduleActive || s.NextRunAt.After(at) {
+		return false, nil
+	}
+
+	if missed := s.missed(at); missed > 0 {
+		skipped := ScheduledRun{
+			ScheduleID: id,
+			DueAt:      s.DueAt,
+			At:         at,
+			Error:      strconv.Itoa(missed) + " occurrences missed",
+			Missed:     missed,
+		}
+		s = s.after(skipped)
+		if err := b.commit(&scheduleRan{Schedule: s, Run: skipped}); err != nil {
+			return false, err
+		}
+	}
+
+	run := ScheduledRun{
+		ScheduleID: id,
+		DueAt:      s.DueAt,
+		Attempt:    s.Attempts + 1,
+		At:         at,
+	}
+
+	var fee *feeCharge
+	from, to, err := b.getTransferAccounts(s.From, s.To)
+	if err == nil {
+		_, fee, err = b.checkTransferWithFee(feeSchedule, from, to, s.Amount, false, at, Spending{}, nil)
+	}
+	if err == nil {
+		run.TxID = uuid.New()
+	} else {
+		run.Error = err.Error()
+	}
+
+	if err := b.commit(&scheduleRan{Schedule: s.after(run), Run: run, Fee: fee}); err != nil {
+		return false, err
+	}
+	// the run is stored, err tells how its transfer went
+	observeTransfer(err)
+	return true, nil
+}
+
+// Scheduler executes scheduled transfers of the bank when they are due by
+// its clock
+type Scheduler struct {
+	bank  *Bank
+	clock clock.Clock
+}
+
+func NewScheduler(b *Bank, c clock.Clock) *Scheduler {
+	return &Scheduler{bank: b, clock: c}
+}
+
+// RunDue makes attempts due by now and returns how many were made. Up to
+// maxCatchUp missed occurrences of every scheduled transfer are caught up
+// one after another, so each of them is transferred once. Older ones are
+// skipped and recorded as a missed run.
+func (s *Scheduler) RunDue() (int, error) {
+	at := s.clock.Now()
+
+	n := 0
+	for i := 0; i < maxCatchUp; i++ {
+		due := s.bank.schedules.due(at)
+		if len(due) == 0 {
+			break
+		}
+
+		for _, st := range due {
+			ran, err := s.bank.runSchedule(st.ID, at)
+			if err != nil {
+				return n, err
+			}
+			if ran {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Start runs due transfers every interval until the bank is closed
+func (s *Scheduler) Start(interval time.Duration, onError func(error)) {
+	s.bank.startJob(interval, func() error {
+		_, err := s.RunDue()
+		return err
+	}, onError)
+}
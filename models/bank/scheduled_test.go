@@ -0,0 +1,281 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"simple_bank/models/clock"
+	"testing"
+	"time"
+)
+
+func TestRecurrence_Monthly(t *testing.T) {
+	r := Recurrence{Every: Monthly, Day: 31}
+
+	start := time.Date(2019, time.January, 15, 9, 30, 0, 0, time.UTC)
+	due := r.first(start)
+	assert.Equal(t, time.Date(2019, time.January, 31, 9, 30, 0, 0, time.UTC), due)
+
+	// short months run on their last day
+	due = r.next(due)
+	assert.Equal(t, time.Date(2019, time.February, 28, 9, 30, 0, 0, time.UTC), due)
+	due = r.next(due)
+	assert.Equal(t, time.Date(2019, time.March, 31, 9, 30, 0, 0, time.UTC), due)
+
+	r = Recurrence{Every: Monthly, Day: 10}
+	assert.Equal(t, time.Date(2019, time.February, 10, 9, 30, 0, 0, time.UTC), r.first(start))
+	assert.Equal(t, time.Date(2020, time.January, 10, 0, 0, 0, 0, time.UTC), r.next(time.Date(2019, time.December, 10, 0, 0, 0, 0, time.UTC)))
+
+	assert.NotNil(t, Recurrence{Every: Monthly}.validate())
+	assert.NotNil(t, Recurrence{Every: Daily, Day: 1}.validate())
+	assert.NotNil(t, Recurrence{Every: "yearly"}.validate())
+}
+
+func TestScheduler_Recurring(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+
+	start := time.Date(2119, time.March, 1, 8, 0, 0, 0, time.UTC)
+	c := clock.NewManual(start.Add(-time.Minute))
+	sc := NewScheduler(b, c)
+
+	s, err := b.ScheduleTransfer(ScheduleParams{
+		From:       a1,
+		To:         a2,
+		Amount:     400,
+		StartAt:    start,
+		Recurrence: Recurrence{Every: Daily},
+		Retry:      RetryPolicy{MaxAttempts: 2, Backoff: time.Hour},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, start, s.NextRunAt)
+
+	n, err := sc.RunDue()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// missed occurrences are caught up
+	c.Set(start.Add(24 * time.Hour))
+	n, err = sc.RunDue()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	balance, _ := b.GetAccountBalance(a2)
+	assert.Equal(t, "800", balance)
+
+	// third occurrence fails, is retried and skipped
+	c.Add(24 * time.Hour)
+	n, _ = sc.RunDue()
+	assert.Equal(t, 1, n)
+	s, _ = b.GetScheduledTransfer(s.ID)
+	assert.Equal(t, 1, s.Attempts)
+	assert.Equal(t, c.Now().Add(time.Hour), s.NextRunAt)
+
+	_, err = b.Transfer(a2, a1, 100)
+	assert.Nil(t, err)
+
+	c.Add(time.Hour)
+	n, _ = sc.RunDue()
+	assert.Equal(t, 1, n)
+	s, _ = b.GetScheduledTransfer(s.ID)
+	assert.Equal(t, 0, s.Attempts)
+	assert.Equal(t, start.Add(72*time.Hour), s.DueAt)
+
+	runs, err := b.ScheduledRuns(s.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, runs, 4) {
+		assert.Equal(t, start, runs[0].DueAt)
+		assert.NotEqual(t, uuid.Nil, runs[1].TxID)
+		assert.Equal(t, "originating balance not enough", runs[2].Error)
+		assert.Equal(t, uuid.Nil, runs[3].TxID)
+		assert.Equal(t, 2, runs[3].Attempt)
+	}
+
+	tx, ok := b.Ledger().Transaction(runs[0].TxID)
+	assert.True(t, ok)
+	assert.Equal(t, int64(400), tx.Amount)
+
+	s, err = b.CancelScheduledTransfer(s.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, ScheduleCancelled, s.Status)
+	_, err = b.CancelScheduledTransfer(s.ID)
+	assert.NotNil(t, err)
+
+	c.Add(30 * 24 * time.Hour)
+	n, _ = sc.RunDue()
+	assert.Equal(t, 0, n)
+}
+
+func TestScheduler_Once(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(100)
+	a2, _ := b.CreateAccount(0)
+
+	start := time.Date(2119, time.March, 1, 8, 0, 0, 0, time.UTC)
+	c := clock.NewManual(start)
+	sc := NewScheduler(b, c)
+
+	ok, _ := b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 100, StartAt: start})
+	failed, _ := b.ScheduleTransfer(ScheduleParams{From: a2, To: a1, Amount: 500, StartAt: start})
+
+	_, err := b.SetAccountStatus(a2, AccountFrozenDebits, "support", "check")
+	assert.Nil(t, err)
+
+	for i := 0; i < DefaultMaxAttempts; i++ {
+		n, err := sc.RunDue()
+		assert.Nil(t, err)
+		assert.True(t, n > 0)
+		c.Add(DefaultRetryBackoff)
+	}
+
+	s, _ := b.GetScheduledTransfer(ok.ID)
+	assert.Equal(t, ScheduleCompleted, s.Status)
+	s, _ = b.GetScheduledTransfer(failed.ID)
+	assert.Equal(t, ScheduleFailed, s.Status)
+
+	runs, _ := b.ScheduledRuns(failed.ID)
+	if assert.Len(t, runs, DefaultMaxAttempts) {
+		assert.Equal(t, ErrDebitsFrozen.Error(), runs[0].Error)
+	}
+}
+
+func TestScheduler_PastStart(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+
+	_, err := b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 10, StartAt: time.Date(2019, time.March, 1, 8, 0, 0, 0, time.UTC), Recurrence: Recurrence{Every: Daily}})
+	assert.NotNil(t, err)
+
+	// start a moment ago is taken as now
+	s, err := b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 10, StartAt: now().Add(-time.Second), Recurrence: Recurrence{Every: Daily}})
+	assert.Nil(t, err)
+	assert.False(t, s.DueAt.Before(s.CreatedAt))
+
+}
+
+func TestScheduler_LongOutage(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+
+	start := time.Date(2119, time.March, 1, 8, 0, 0, 0, time.UTC)
+	s, err := b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 10, StartAt: start, Recurrence: Recurrence{Every: Daily}})
+	assert.Nil(t, err)
+
+	// only the last occurrences of a month long outage are caught up
+	c := clock.NewManual(start.AddDate(0, 0, 30))
+	sc := NewScheduler(b, c)
+	for i := 0; i < 3; i++ {
+		_, err := sc.RunDue()
+		assert.Nil(t, err)
+	}
+
+	ac, _ := b.GetAccount(a2)
+	assert.Equal(t, int64(10*maxCatchUp), ac.Balance())
+
+	runs, _ := b.ScheduledRuns(s.ID)
+	if assert.Len(t, runs, 1+maxCatchUp) {
+		assert.Equal(t, start, runs[0].DueAt)
+		assert.Equal(t, 31-maxCatchUp, runs[0].Missed)
+		assert.Equal(t, uuid.Nil, runs[0].TxID)
+		assert.Equal(t, start.AddDate(0, 0, 31-maxCatchUp), runs[1].DueAt)
+	}
+	s, _ = b.GetScheduledTransfer(s.ID)
+	assert.Equal(t, start.AddDate(0, 0, 31), s.DueAt)
+}
+
+func TestBank_ScheduleTransferValidation(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(100)
+	a2, _ := b.CreateAccount(0)
+	usd, _ := b.CreateAccountWith(AccountParams{Currency: "USD"})
+
+	_, err := b.ScheduleTransfer(ScheduleParams{From: a1, To: a1, Amount: 100})
+	assert.NotNil(t, err)
+	_, err = b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 0})
+	assert.NotNil(t, err)
+	_, err = b.ScheduleTransfer(ScheduleParams{From: a1, To: usd, Amount: 100})
+	assert.NotNil(t, err)
+	_, err = b.ScheduleTransfer(ScheduleParams{From: a1, To: uuid.New(), Amount: 100})
+	assert.NotNil(t, err)
+	_, err = b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 100, Retry: RetryPolicy{MaxAttempts: -1}})
+	assert.NotNil(t, err)
+	_, err = b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 100, StartAt: now().Add(-time.Hour)})
+	assert.NotNil(t, err)
+
+	_, err = b.GetScheduledTransfer(uuid.New())
+	assert.Equal(t, ErrScheduleNotFound, err)
+	_, err = b.ScheduledRuns(uuid.New())
+	assert.Equal(t, ErrScheduleNotFound, err)
+}
+
+func TestScheduler_Persisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2119, time.March, 1, 8, 0, 0, 0, time.UTC)
+
+	fill := func(b *Bank) (uuid.UUID, uuid.UUID) {
+		a1, _ := b.CreateAccount(1000)
+		a2, _ := b.CreateAccount(0)
+		s, err := b.ScheduleTransfer(ScheduleParams{
+			From:       a1,
+			To:         a2,
+			Amount:     300,
+			StartAt:    start,
+			Recurrence: Recurrence{Every: Weekly},
+		})
+		assert.Nil(t, err)
+
+		n, err := NewScheduler(b, clock.NewManual(start.Add(7*24*time.Hour))).RunDue()
+		assert.Nil(t, err)
+		assert.Equal(t, 2, n)
+		return s.ID, a2
+	}
+
+	check := func(b *Bank, id uuid.UUID, a2 uuid.UUID) {
+		ac, _ := b.GetAccount(a2)
+		assert.Equal(t, int64(600), ac.Balance())
+
+		s, err := b.GetScheduledTransfer(id)
+		assert.Nil(t, err)
+		assert.Equal(t, start.Add(14*24*time.Hour), s.NextRunAt)
+		runs, _ := b.ScheduledRuns(id)
+		assert.Len(t, runs, 2)
+	}
+
+	// write-ahead log, before and after snapshot
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	id, a2 := fill(b)
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, id, a2)
+	assert.Nil(t, b.Close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, id, a2)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	id, a2 = fill(b)
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	check(b, id, a2)
+	assert.Nil(t, b.Close())
+}
@@ -0,0 +1,166 @@
+package bank
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+type AccountSort string
+
+const (
+	SortByCreatedAt AccountSort = "created_at"
+	SortByBalance   AccountSort = "balance"
+)
+
+// AccountCursor points at the last account of the previous page: Key is
+// the sort key of it, creation time in nanoseconds or balance
+type AccountCursor struct {
+	Key int64
+	ID  uuid.UUID
+}
+
+// AccountQuery filters and orders accounts. Zero values mean no filter,
+// accounts are sorted by creation time by default. Name matches
+// case-insensitive substrings, Tag matches accounts having it.
+type AccountQuery struct {
+	Sort  AccountSort
+	Desc  bool
+	After *AccountCursor
+	Limit int
+
+	CreatedSince time.Time
+	CreatedUntil time.Time
+	UpdatedSince time.Time
+	UpdatedUntil time.Time
+	MinBalance   *int64
+	MaxBalance   *int64
+
+	Currency    string
+	Status      AccountStatus
+	Owner       string
+	Name        string
+	ExternalRef string
+	Tag         string
+}
+
+func (q AccountQuery) match(ac Account) bool {
+	if !inWindow(ac.createdAt, q.CreatedSince, q.CreatedUntil) || !inWindow(ac.updatedAt, q.UpdatedSince, q.UpdatedUntil) {
+		return false
+	}
+	if q.MinBalance != nil && ac.balance < *q.MinBalance {
+		return false
+	}
+	if q.MaxBalance != nil && ac.balance > *q.MaxBalance {
+		return false
+	}
+	if q.Currency != "" && ac.currency != q.Currency {
+		return false
+	}
+	if q.Status != "" && ac.Status() != q.Status {
+		return false
+	}
+	if q.Owner != "" && ac.owner != q.Owner {
+		return false
+	}
+	if q.Name != "" && !strings.Contains(strings.ToLower(ac.name), strings.ToLower(q.Name)) {
+		return false
+	}
+	if q.ExternalRef != "" && ac.externalRef != q.ExternalRef {
+		return false
+	}
+	if q.Tag != "" && !hasTag(ac, q.Tag) {
+		return false
+	}
+	return true
+}
+
+// key is the value accounts are sorted by
+func (q AccountQuery) key(ac Account) int64 {
+	if q.Sort == SortByBalance {
+		return ac.balance
+	}
+	return ac.createdAt.UnixNano()
+}
+
+// less orders accounts by the sort key, ties are broken by ID so every
+// account has a stable place for the cursor
+func (q AccountQuery) less(a AccountCursor, b AccountCursor) bool {
+	if a.Key != b.Key {
+		return (a.Key < b.Key) != q.Desc
+	}
+	if q.Desc {
+		return bytes.Compare(a.ID[:], b.ID[:]) > 0
+	}
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// Cursor returns the cursor pointing at the account
+func (q AccountQuery) Cursor(ac Account) AccountCursor {
+	return AccountCursor{Key: q.key(ac), ID: ac.id}
+}
+
+func inWindow(t time.Time, since time.Time, until time.Time) bool {
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !until.IsZero() && !t.Before(until) {
+		return false
+	}
+	return true
+}
+
+func hasTag(ac Account, tag string) bool {
+	for _, t := range ac.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// FindAccounts returns a page of accounts matching the query. The second
+// value reports whether more accounts match beyond the limit. Sorting by
+// balance needs the currency filter. All accounts are scanned, it is meant
+// for back office use.
+func (b *Bank) FindAccounts(q AccountQuery) ([]Account, bool, error) {
+	switch q.Sort {
+	case "":
+		q.Sort = SortByCreatedAt
+	case SortByCreatedAt, SortByBalance:
+	default:
+		return nil, false, errors.New("accounts can be sorted by created_at or balance")
+	}
+	// minor units of different currencies do not compare
+	if q.Sort == SortByBalance && q.Currency == "" {
+		return nil, false, errors.New("currency is required to sort by balance")
+	}
+
+	accounts, err := b.storage.ListAccounts()
+	if err != nil {
+		return nil, false, err
+	}
+
+	res := []Account{}
+	for _, ac := range accounts {
+		if !q.match(ac) {
+			continue
+		}
+		if q.After != nil && !q.less(*q.After, q.Cursor(ac)) {
+			continue
+		}
+		res = append(res, ac)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return q.less(q.Cursor(res[i]), q.Cursor(res[j]))
+	})
+
+	if q.Limit > 0 && len(res) > q.Limit {
+		return res[:q.Limit], true, nil
+	}
+	return res, false, nil
+}
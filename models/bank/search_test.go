@@ -0,0 +1,90 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBank_FindAccounts(t *testing.T) {
+	b := NewBank()
+
+	var ids []uuid.UUID
+	for i, balance := range []int64{300, 100, 200, 100} {
+		id, _ := b.CreateAccountWith(AccountParams{Balance: balance, Owner: "crm-1", Tags: []string{"n" + strconv.Itoa(i)}})
+		ids = append(ids, id)
+		time.Sleep(time.Millisecond)
+	}
+	usd, _ := b.CreateAccountWith(AccountParams{Balance: 500, Currency: "USD", Name: "Travel Card"})
+
+	find := func(q AccountQuery) []uuid.UUID {
+		accounts, _, err := b.FindAccounts(q)
+		assert.Nil(t, err)
+		res := []uuid.UUID{}
+		for _, ac := range accounts {
+			res = append(res, ac.id)
+		}
+		return res
+	}
+
+	assert.Equal(t, append(ids, usd), find(AccountQuery{}))
+	assert.Equal(t, []uuid.UUID{usd, ids[3], ids[2], ids[1], ids[0]}, find(AccountQuery{Desc: true}))
+	assert.Equal(t, ids, find(AccountQuery{Owner: "crm-1"}))
+	assert.Equal(t, []uuid.UUID{usd}, find(AccountQuery{Currency: "USD"}))
+	assert.Equal(t, []uuid.UUID{usd}, find(AccountQuery{Name: "travel"}))
+	assert.Equal(t, []uuid.UUID{ids[2]}, find(AccountQuery{Tag: "n2"}))
+
+	min, max := int64(150), int64(300)
+	assert.Equal(t, []uuid.UUID{ids[0], ids[2]}, find(AccountQuery{Currency: "RUB", MinBalance: &min, MaxBalance: &max}))
+
+	ac, _ := b.GetAccount(ids[2])
+	assert.Equal(t, ids[2:], find(AccountQuery{Owner: "crm-1", CreatedSince: ac.createdAt}))
+	assert.Equal(t, ids[:2], find(AccountQuery{Owner: "crm-1", CreatedUntil: ac.createdAt}))
+
+	_, err := b.Transfer(ids[0], ids[1], 1)
+	assert.Nil(t, err)
+	ac, _ = b.GetAccount(ids[0])
+	assert.Equal(t, ids[:2], find(AccountQuery{UpdatedSince: ac.updatedAt}))
+
+	_, err = b.SetAccountStatus(ids[3], AccountFrozenAll, "support", "test")
+	assert.Nil(t, err)
+	assert.Equal(t, ids[3:], find(AccountQuery{Status: AccountFrozenAll}))
+
+	_, _, err = b.FindAccounts(AccountQuery{Sort: "name"})
+	assert.NotNil(t, err)
+	_, _, err = b.FindAccounts(AccountQuery{Sort: SortByBalance})
+	assert.NotNil(t, err)
+}
+
+func TestBank_FindAccountsPages(t *testing.T) {
+	b := NewBank()
+	for _, balance := range []int64{5, 1, 3, 1, 4, 1} {
+		b.CreateAccount(balance)
+	}
+
+	for _, desc := range []bool{false, true} {
+		q := AccountQuery{Sort: SortByBalance, Desc: desc, Limit: 4, Currency: "RUB"}
+
+		var balances []int64
+		for {
+			page, more, err := b.FindAccounts(q)
+			assert.Nil(t, err)
+			for _, ac := range page {
+				balances = append(balances, ac.balance)
+			}
+			if !more {
+				break
+			}
+			cursor := q.Cursor(page[len(page)-1])
+			q.After = &cursor
+		}
+
+		if desc {
+			assert.Equal(t, []int64{5, 4, 3, 1, 1, 1}, balances)
+		} else {
+			assert.Equal(t, []int64{1, 1, 1, 3, 4, 5}, balances)
+		}
+	}
+}
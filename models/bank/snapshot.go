@@ -0,0 +1,330 @@
+package bank
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"simple_bank/models/currency"
+	"time"
+)
+
+const (
+	walFileName      = "bank.wal"
+	snapshotFileName = "bank.snapshot"
+)
+
+type accountState struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Balance   int64     `json:"balance"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status,omitempty"`
+	Overdraft int64     `json:"overdraft,omitempty"`
+	// Limits is nil for accounts without spending limits
+	Limits *SpendingLimits `json:"limits,omitempty"`
+
+	Owner       string   `json:"owner,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	ExternalRef string   `json:"external_ref,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+func (ac Account) state() accountState {
+	st := accountState{
+		ID:        ac.id,
+		CreatedAt: ac.createdAt,
+		UpdatedAt: ac.updatedAt,
+		Balance:   ac.balance,
+		Currency:  ac.currency,
+		Status:    string(ac.status),
+		Overdraft: ac.overdraft,
+
+		Owner:       ac.owner,
+		Name:        ac.name,
+		ExternalRef: ac.externalRef,
+		Tags:        ac.tags,
+	}
+	if !ac.limits.none() {
+		limits := ac.limits
+		st.Limits = &limits
+	}
+	return st
+}
+
+func (st accountState) account() Account {
+	ac := Account{
+		id:        st.ID,
+		createdAt: st.CreatedAt,
+		updatedAt: st.UpdatedAt,
+		balance:   st.Balance,
+		currency:  st.Currency,
+		status:    AccountStatus(st.Status),
+		overdraft: st.Overdraft,
+
+		owner:       st.Owner,
+		name:        st.Name,
+		externalRef: st.ExternalRef,
+		tags:        st.Tags,
+	}
+	if st.Limits != nil {
+		ac.limits = *st.Limits
+	}
+	// accounts stored before currencies were introduced
+	if ac.currency == "" {
+		ac.currency = currency.Default
+	}
+	return ac
+}
+
+// snapshot is the full bank state as of the WAL record Seq
+type snapshot struct {
+	Seq          uint64              `json:"seq"`
+	Accounts     []accountState      `json:"accounts"`
+	Transactions []Transaction       `json:"transactions"`
+	Idempotency  []IdempotencyRecord `json:"idempotency"`
+	Holds        []Hold              `json:"holds"`
+	Statuses     []StatusChange      `json:"statuses"`
+	Schedules    []ScheduledTransfer `json:"schedules"`
+	Runs         []ScheduledRun      `json:"runs"`
+	Interest     *InterestState      `json:"interest,omitempty"`
+}
+
+// Open restores an in-memory bank from the snapshot and the WAL found in
+// dir and keeps logging every change there. Directory is created if
+// missing.
+func Open(dir string) (*Bank, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	b := NewBank()
+	b.dir = dir
+
+	seq, err := b.loadSnapshot(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	wal, records, err := openWAL(filepath.Join(dir, walFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	// events which failed to apply when logged are skipped
+	aborted := make(map[uint64]bool)
+	for _, rec := range records {
+		if rec.Type != (&eventAborted{}).kind() {
+			continue
+		}
+		var e eventAborted
+		if err := json.Unmarshal(rec.Data, &e); err != nil {
+			wal.close()
+			return nil, err
+		}
+		aborted[e.Seq] = true
+	}
+
+	for _, rec := range records {
+		if rec.Seq <= seq || aborted[rec.Seq] {
+			continue
+		}
+
+		if rec.Posting != 0 {
+			b.ledger.resume(rec.Posting)
+		}
+		e, err := decodeEvent(rec.Type, rec.Data)
+		if err == nil {
+			err = e.apply(b)
+		}
+		if err != nil {
+			wal.close()
+			return nil, err
+		}
+	}
+
+	if wal.seq < seq {
+		wal.seq = seq
+	}
+	b.wal = wal
+
+	return b, nil
+}
+
+func (b *Bank) loadSnapshot(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, err
+	}
+
+	for _, st := range s.Accounts {
+		ac := st.account()
+		if err := b.storage.CreateAccount(ac, nil); err != nil {
+			return 0, err
+		}
+		b.refs.put(ac)
+	}
+	for _, tx := range s.Transactions {
+		b.ledger.record(tx)
+	}
+	for _, rec := range s.Idempotency {
+		b.idempotency.put(rec)
+	}
+	for _, h := range s.Holds {
+		b.holds.put(h)
+	}
+	for _, ch := range s.Statuses {
+		b.statuses.add(ch)
+	}
+	for _, st := range s.Schedules {
+		b.schedules.put(st)
+	}
+	for _, run := range s.Runs {
+		b.schedules.addRun(run)
+	}
+	if s.Interest != nil {
+		b.interest.set(*s.Interest)
+	}
+
+	return s.Seq, nil
+}
+
+// Snapshot writes the whole bank state to disk and truncates the WAL
+func (b *Bank) Snapshot() error {
+	if b.wal == nil {
+		return errors.New("bank is not persistent")
+	}
+
+	err := b.snapshot()
+	b.wal.snapshotTaken(err)
+	return err
+}
+
+func (b *Bank) snapshot() error {
+	b.writeLock()
+	defer b.mu.Unlock()
+
+	accounts, err := b.storage.ListAccounts()
+	if err != nil {
+		return err
+	}
+
+	s := snapshot{
+		Seq:          b.wal.seq,
+		Accounts:     make([]accountState, 0, len(accounts)),
+		Transactions: b.ledger.Transactions(),
+		Idempotency:  b.idempotency.live(now()),
+		Holds:        b.holds.all(),
+		Statuses:     b.statuses.all(),
+	}
+	s.Schedules, s.Runs = b.schedules.all()
+	interest := b.interest.get()
+	s.Interest = &interest
+	for _, ac := range accounts {
+		s.Accounts = append(s.Accounts, ac.state())
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileSync(filepath.Join(b.dir, snapshotFileName), data); err != nil {
+		return err
+	}
+
+	return b.wal.reset()
+}
+
+// StartSnapshots takes a snapshot every interval until the bank is closed
+func (b *Bank) StartSnapshots(interval time.Duration, onError func(error)) {
+	b.startJob(interval, b.Snapshot, onError)
+}
+
+// startJob runs the job every interval until the bank is closed, Close
+// waits for a running one to finish
+func (b *Bank) startJob(interval time.Duration, job func() error, onError func(error)) {
+	ticker := time.NewTicker(interval)
+
+	b.jobs.Add(1)
+	go func() {
+		defer b.jobs.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := job(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-b.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops background jobs, takes the final snapshot if there is a WAL
+// and releases the storage. Changes in progress finish before the
+// snapshot, later ones fail.
+func (b *Bank) Close() error {
+	close(b.done)
+	b.jobs.Wait()
+
+	if b.wal != nil {
+		err := b.Snapshot()
+		if closeErr := b.wal.close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			b.storage.Close()
+			return err
+		}
+	}
+
+	return b.storage.Close()
+}
+
+// writeFileSync replaces the file atomically: data goes to a temporary
+// file first which is then renamed over the target
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// persist the rename itself
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
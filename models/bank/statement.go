@@ -0,0 +1,74 @@
+package bank
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Statement lists postings of the account made in [From, To). Opening is
+// the balance before them, Closing is Opening plus all of them, so it is
+// the balance after the last one.
+type Statement struct {
+	AccountID uuid.UUID
+	Currency  string
+	From      time.Time
+	To        time.Time
+	Opening   int64
+	Closing   int64
+	Entries   []StatementEntry
+}
+
+// StatementEntry is a posting with the kind of its transaction
+type StatementEntry struct {
+	Posting
+	Kind TransactionKind
+}
+
+// Statement returns the statement of the account for the period, zero
+// from starts when the account was created and zero to ends now
+func (b *Bank) Statement(id uuid.UUID, from time.Time, to time.Time) (Statement, error) {
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	if from.IsZero() {
+		from = ac.createdAt
+	}
+	if to.IsZero() {
+		to = now()
+	}
+	if !from.Before(to) {
+		return Statement{}, errors.New("statement period must end after it starts")
+	}
+
+	s := b.ledger.statement(id, from, to)
+	s.Currency = ac.currency
+	return s, nil
+}
+
+// statement reads the postings under a single lock, so the balances
+// reconcile even while transfers go on
+func (l *Ledger) statement(id uuid.UUID, from time.Time, to time.Time) Statement {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	s := Statement{AccountID: id, From: from, To: to, Entries: []StatementEntry{}}
+	for _, p := range l.postings[id] {
+		if p.CreatedAt.Before(from) {
+			s.Opening = p.Balance
+			continue
+		}
+		if !p.CreatedAt.Before(to) {
+			break
+		}
+		s.Entries = append(s.Entries, StatementEntry{Posting: p, Kind: l.transactions[l.byID[p.TxID]].Kind})
+	}
+
+	s.Closing = s.Opening
+	for _, e := range s.Entries {
+		s.Closing += e.Signed()
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLedger_Statement(t *testing.T) {
+	l := NewLedger()
+	a1, a2 := uuid.New(), uuid.New()
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	l.record(newTransaction(uuid.New(), KindOpening, "USD", SystemAccountID, a1, 1000, 0, 1000, day))
+	l.record(newTransaction(uuid.New(), KindTransfer, "USD", a1, a2, 300, 700, 300, day.Add(24*time.Hour)))
+	l.record(newTransaction(uuid.New(), KindFee, "USD", a1, a2, 10, 690, 310, day.Add(24*time.Hour)))
+	l.record(newTransaction(uuid.New(), KindTransfer, "USD", a2, a1, 50, 260, 740, day.Add(48*time.Hour)))
+	l.record(newTransaction(uuid.New(), KindTransfer, "USD", a1, a2, 40, 700, 300, day.Add(72*time.Hour)))
+
+	s := l.statement(a1, day.Add(24*time.Hour), day.Add(72*time.Hour))
+	assert.Equal(t, int64(1000), s.Opening)
+	assert.Equal(t, int64(740), s.Closing)
+	if assert.Len(t, s.Entries, 3) {
+		assert.Equal(t, KindTransfer, s.Entries[0].Kind)
+		assert.Equal(t, KindFee, s.Entries[1].Kind)
+		assert.Equal(t, Credit, s.Entries[2].Type)
+		// the closing balance is the one after the last posting
+		assert.Equal(t, s.Closing, s.Entries[2].Balance)
+	}
+
+	// a period without postings carries the balance over
+	s = l.statement(a1, day.Add(100*time.Hour), day.Add(200*time.Hour))
+	assert.Equal(t, int64(700), s.Opening)
+	assert.Equal(t, int64(700), s.Closing)
+	assert.Len(t, s.Entries, 0)
+
+	s = l.statement(a2, time.Time{}, day.Add(200*time.Hour))
+	assert.Equal(t, int64(0), s.Opening)
+	assert.Equal(t, int64(300), s.Closing)
+	assert.Len(t, s.Entries, 4)
+}
+
+func TestBank_Statement(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccountWith(AccountParams{Balance: 1000, Currency: "EUR"})
+	a2, _ := b.CreateAccountWith(AccountParams{Currency: "EUR"})
+	_, err := b.Transfer(a1, a2, 100)
+	assert.Nil(t, err)
+
+	s, err := b.Statement(a1, time.Time{}, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "EUR", s.Currency)
+	assert.Equal(t, int64(0), s.Opening)
+	assert.Equal(t, int64(900), s.Closing)
+	assert.Len(t, s.Entries, 2)
+
+	_, err = b.Statement(uuid.New(), time.Time{}, time.Time{})
+	assert.Equal(t, ErrAccountNotFound, err)
+	at := time.Now()
+	_, err = b.Statement(a1, at, at)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,272 @@
+package bank
+
+import (
+	"errors"
+	"github.com/JohnCGriffin/overflow"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+type AccountStatus string
+
+const (
+	AccountActive AccountStatus = "active"
+	// AccountFrozenDebits accounts can receive money but not spend it
+	AccountFrozenDebits AccountStatus = "frozen-debits"
+	AccountFrozenAll    AccountStatus = "frozen-all"
+	// AccountClosed is final, closed accounts have zero balance
+	AccountClosed AccountStatus = "closed"
+)
+
+var (
+	ErrDebitsFrozen  = errors.New("account is frozen for debits")
+	ErrAccountFrozen = errors.New("account is frozen")
+	ErrAccountClosed = errors.New("account is closed")
+)
+
+// canDebit tells whether money can leave the account
+func (ac Account) canDebit() error {
+	switch ac.status {
+	case AccountFrozenDebits:
+		return ErrDebitsFrozen
+	case AccountFrozenAll:
+		return ErrAccountFrozen
+	case AccountClosed:
+		return ErrAccountClosed
+	}
+	return nil
+}
+
+// canCredit tells whether money can enter the account
+func (ac Account) canCredit() error {
+	switch ac.status {
+	case AccountFrozenAll:
+		return ErrAccountFrozen
+	case AccountClosed:
+		return ErrAccountClosed
+	}
+	return nil
+}
+
+// StatusChange records who changed the account status and why. Closing
+// sweeps the balance to the SweepTo account with the TxID transaction.
+type StatusChange struct {
+	AccountID uuid.UUID     `json:"account_id"`
+	From      AccountStatus `json:"from"`
+	To        AccountStatus `json:"to"`
+	Actor     string        `json:"actor"`
+	Reason    string        `json:"reason"`
+	SweepTo   uuid.UUID     `json:"sweep_to"`
+	TxID      uuid.UUID     `json:"tx_id"`
+	// Cancelled are the active scheduled transfers of a closed account,
+	// cancelled with it
+	Cancelled []uuid.UUID `json:"cancelled,omitempty"`
+	At        time.Time   `json:"at"`
+}
+
+// statusHistory keeps status changes of every account in order, storage
+// only persists them
+type statusHistory struct {
+	changes map[uuid.UUID][]StatusChange
+	mu      *sync.RWMutex
+}
+
+func newStatusHistory() *statusHistory {
+	return &statusHistory{
+		changes: make(map[uuid.UUID][]StatusChange),
+		mu:      &sync.RWMutex{},
+	}
+}
+
+func (h *statusHistory) add(ch StatusChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.changes[ch.AccountID] = append(h.changes[ch.AccountID], ch)
+}
+
+func (h *statusHistory) get(id uuid.UUID) []StatusChange {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	res := make([]StatusChange, len(h.changes[id]))
+	copy(res, h.changes[id])
+	return res
+}
+
+func (h *statusHistory) all() []StatusChange {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var res []StatusChange
+	for _, changes := range h.changes {
+		res = append(res, changes...)
+	}
+	return res
+}
+
+// StatusHistory returns status changes of the account, oldest first
+func (b *Bank) StatusHistory(id uuid.UUID) ([]StatusChange, error) {
+	if _, err := b.storage.GetAccount(id); err != nil {
+		return nil, err
+	}
+	return b.statuses.get(id), nil
+}
+
+// SetAccountStatus freezes or unfreezes the account, see CloseAccount for
+// closing it
+func (b *Bank) SetAccountStatus(id uuid.UUID, status AccountStatus, actor string, reason string) (StatusChange, error) {
+	switch status {
+	case AccountActive, AccountFrozenDebits, AccountFrozenAll:
+	default:
+		return StatusChange{}, errors.New("status must be active, frozen-debits or frozen-all")
+	}
+
+	if err := checkActorAndReason(actor, reason); err != nil {
+		return StatusChange{}, err
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(id)
+	defer unlock()
+
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return StatusChange{}, err
+	}
+
+	if ac.status == AccountClosed {
+		return StatusChange{}, ErrAccountClosed
+	}
+	if ac.Status() == status {
+		return StatusChange{}, errors.New("account already has this status")
+	}
+
+	ch := StatusChange{
+		AccountID: id,
+		From:      ac.Status(),
+		To:        status,
+		Actor:     actor,
+		Reason:    reason,
+		At:        now(),
+	}
+	if err := b.commit(&statusChanged{Change: ch}); err != nil {
+		return StatusChange{}, err
+	}
+	return ch, nil
+}
+
+// CloseAccount closes the account for good. The balance must be zero, or
+// it is moved to the sweepTo account in the same currency. Overdrawn
+// accounts must be paid back first. Zero sweepTo
+// means there is no sweep account. Accounts with active holds and fee or
+// interest source accounts can not be closed. Active scheduled transfers
+// from or to the account are cancelled with it.
+func (b *Bank) CloseAccount(id uuid.UUID, sweepTo uuid.UUID, actor string, reason string) (StatusChange, error) {
+	if err := checkActorAndReason(actor, reason); err != nil {
+		return StatusChange{}, err
+	}
+	if id == sweepTo {
+		return StatusChange{}, errors.New("accounts must be different")
+	}
+
+	b.readLock()
+	defer b.mu.RUnlock()
+
+	unlock := b.locks.lock(id, sweepTo)
+	defer unlock()
+
+	ac, err := b.storage.GetAccount(id)
+	if err != nil {
+		return StatusChange{}, err
+	}
+
+	if ac.status == AccountClosed {
+		return StatusChange{}, ErrAccountClosed
+	}
+	if b.systemAccount(id) {
+		return StatusChange{}, errors.New("fee and interest source accounts can not be closed")
+	}
+
+	at := now()
+	if b.available(ac, at) != ac.balance {
+		return StatusChange{}, errors.New("account has active holds")
+	}
+	if ac.balance < 0 {
+		return StatusChange{}, errors.New("account is overdrawn")
+	}
+
+	ch := StatusChange{
+		AccountID: id,
+		From:      ac.Status(),
+		To:        AccountClosed,
+		Actor:     actor,
+		Reason:    reason,
+		At:        at,
+	}
+	// schedules of the account hold its lock when they run
+	for _, st := range b.schedules.activeOf(id) {
+		ch.Cancelled = append(ch.Cancelled, st.ID)
+	}
+
+	if ac.balance != 0 {
+		if sweepTo == uuid.Nil {
+			return StatusChange{}, errors.New("account balance is not zero, sweep account is required")
+		}
+
+		sweep, err := b.storage.GetAccount(sweepTo)
+		if err == ErrAccountNotFound {
+			return StatusChange{}, errors.New("sweep account not found")
+		} else if err != nil {
+			return StatusChange{}, err
+		}
+
+		if err := sweep.canCredit(); err != nil {
+			return StatusChange{}, err
+		}
+		if sweep.currency != ac.currency {
+			return StatusChange{}, errors.New("accounts have different currencies")
+		}
+		if _, ok := overflow.Add64(sweep.balance, ac.balance); !ok {
+			return StatusChange{}, errors.New("overflow of to balance")
+		}
+
+		ch.SweepTo = sweepTo
+		ch.TxID = uuid.New()
+	}
+
+	if err := b.commit(&statusChanged{Change: ch}); err != nil {
+		return StatusChange{}, err
+	}
+	return ch, nil
+}
+
+// systemAccount tells the account is a fee account or an interest source
+func (b *Bank) systemAccount(id uuid.UUID) bool {
+	if s := b.feeSchedule(); s != nil {
+		for _, feeAccount := range s.Accounts() {
+			if feeAccount == id {
+				return true
+			}
+		}
+	}
+	for _, source := range b.interest.get().Sources {
+		if source == id {
+			return true
+		}
+	}
+	return false
+}
+
+func checkActorAndReason(actor string, reason string) error {
+	if actor == "" {
+		return errors.New("actor is required")
+	}
+	if reason == "" {
+		return errors.New("reason is required")
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBank_FreezeDebits(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(1000)
+
+	ac, _ := b.GetAccount(a1)
+	assert.Equal(t, AccountActive, ac.Status())
+
+	ch, err := b.SetAccountStatus(a1, AccountFrozenDebits, "support", "card stolen")
+	assert.Nil(t, err)
+	assert.Equal(t, AccountActive, ch.From)
+	assert.Equal(t, AccountFrozenDebits, ch.To)
+
+	_, err = b.Transfer(a1, a2, 100)
+	assert.Equal(t, ErrDebitsFrozen, err)
+	_, err = b.PlaceHold(a1, 100, 0)
+	assert.Equal(t, ErrDebitsFrozen, err)
+
+	// incoming money is still accepted
+	txID, err := b.Transfer(a2, a1, 100)
+	assert.Nil(t, err)
+	_, err = b.ReverseTransfer(txID, 0)
+	assert.Equal(t, ErrDebitsFrozen, err)
+
+	_, err = b.SetAccountStatus(a1, AccountActive, "support", "card blocked")
+	assert.Nil(t, err)
+	_, err = b.Transfer(a1, a2, 100)
+	assert.Nil(t, err)
+}
+
+func TestBank_FreezeAll(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(1000)
+
+	h, _ := b.PlaceHold(a2, 100, 0)
+
+	_, err := b.SetAccountStatus(a1, AccountFrozenAll, "compliance", "investigation")
+	assert.Nil(t, err)
+
+	_, err = b.Transfer(a1, a2, 100)
+	assert.Equal(t, ErrAccountFrozen, err)
+	_, err = b.Transfer(a2, a1, 100)
+	assert.Equal(t, ErrAccountFrozen, err)
+	_, err = b.CaptureHold(h.ID, a1, 100)
+	assert.Equal(t, ErrAccountFrozen, err)
+
+	_, err = b.SetAccountStatus(a1, AccountFrozenAll, "compliance", "again")
+	assert.NotNil(t, err)
+	_, err = b.SetAccountStatus(a1, AccountClosed, "compliance", "done")
+	assert.NotNil(t, err)
+	_, err = b.SetAccountStatus(a1, AccountActive, "", "no actor")
+	assert.NotNil(t, err)
+	_, err = b.SetAccountStatus(a1, AccountActive, "compliance", "")
+	assert.NotNil(t, err)
+	_, err = b.SetAccountStatus(uuid.New(), AccountActive, "compliance", "unknown")
+	assert.Equal(t, ErrAccountNotFound, err)
+}
+
+func TestBank_CloseAccount(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	empty, _ := b.CreateAccount(0)
+	usd, _ := b.CreateAccountWith(AccountParams{Currency: "USD"})
+
+	ch, err := b.CloseAccount(empty, uuid.Nil, "owner", "not needed")
+	assert.Nil(t, err)
+	assert.Equal(t, uuid.Nil, ch.TxID)
+
+	// balance must be swept
+	_, err = b.CloseAccount(a1, uuid.Nil, "owner", "moving out")
+	assert.NotNil(t, err)
+	_, err = b.CloseAccount(a1, usd, "owner", "moving out")
+	assert.NotNil(t, err)
+	_, err = b.CloseAccount(a1, empty, "owner", "moving out")
+	assert.Equal(t, ErrAccountClosed, err)
+
+	h, _ := b.PlaceHold(a1, 100, 0)
+	_, err = b.CloseAccount(a1, a2, "owner", "moving out")
+	assert.NotNil(t, err)
+	assert.Nil(t, b.ReleaseHold(h.ID))
+
+	ch, err = b.CloseAccount(a1, a2, "owner", "moving out")
+	assert.Nil(t, err)
+	assert.Equal(t, a2, ch.SweepTo)
+
+	balance, _ := b.GetAccountBalance(a1)
+	assert.Equal(t, "0", balance)
+	balance, _ = b.GetAccountBalance(a2)
+	assert.Equal(t, "1000", balance)
+	sweep, ok := b.Ledger().Transaction(ch.TxID)
+	assert.True(t, ok)
+	assert.Equal(t, KindClosing, sweep.Kind)
+
+	// closed is final
+	_, err = b.Transfer(a2, a1, 100)
+	assert.Equal(t, ErrAccountClosed, err)
+	_, err = b.SetAccountStatus(a1, AccountActive, "owner", "changed my mind")
+	assert.Equal(t, ErrAccountClosed, err)
+	_, err = b.CloseAccount(a1, a2, "owner", "moving out")
+	assert.Equal(t, ErrAccountClosed, err)
+
+	history, err := b.StatusHistory(a1)
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "owner", history[0].Actor)
+	assert.Equal(t, "moving out", history[0].Reason)
+}
+
+func TestBank_CloseAccountSystem(t *testing.T) {
+	b := NewBank()
+	feeAccount, _ := b.CreateAccount(0)
+	source, _ := b.CreateAccount(0)
+	b.SetFees(testFees(t, flatFee(feeAccount, "1")))
+	assert.Nil(t, b.SetInterestAccount(source))
+
+	_, err := b.CloseAccount(feeAccount, uuid.Nil, "support", "cleanup")
+	assert.NotNil(t, err)
+	_, err = b.CloseAccount(source, uuid.Nil, "support", "cleanup")
+	assert.NotNil(t, err)
+}
+
+func TestBank_CloseAccountCancelsSchedules(t *testing.T) {
+	b := NewBank()
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	a3, _ := b.CreateAccount(0)
+
+	from, _ := b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 10, Recurrence: Recurrence{Every: Daily}})
+	to, _ := b.ScheduleTransfer(ScheduleParams{From: a2, To: a1, Amount: 10, Recurrence: Recurrence{Every: Weekly}})
+	other, _ := b.ScheduleTransfer(ScheduleParams{From: a2, To: a3, Amount: 10, Recurrence: Recurrence{Every: Weekly}})
+
+	ch, err := b.CloseAccount(a1, a3, "owner", "moving out")
+	assert.Nil(t, err)
+	assert.Len(t, ch.Cancelled, 2)
+
+	for _, id := range []uuid.UUID{from.ID, to.ID} {
+		s, _ := b.GetScheduledTransfer(id)
+		assert.Equal(t, ScheduleCancelled, s.Status)
+	}
+	s, _ := b.GetScheduledTransfer(other.ID)
+	assert.Equal(t, ScheduleActive, s.Status)
+}
+
+func TestBank_StatusesPersisted(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	fill := func(b *Bank) (uuid.UUID, uuid.UUID) {
+		a1, _ := b.CreateAccount(1000)
+		a2, _ := b.CreateAccount(0)
+		_, err := b.SetAccountStatus(a1, AccountFrozenAll, "support", "suspicious")
+		assert.Nil(t, err)
+		_, err = b.SetAccountStatus(a1, AccountActive, "support", "cleared")
+		assert.Nil(t, err)
+		_, err = b.ScheduleTransfer(ScheduleParams{From: a1, To: a2, Amount: 10, Recurrence: Recurrence{Every: Daily}})
+		assert.Nil(t, err)
+		_, err = b.CloseAccount(a1, a2, "owner", "moving out")
+		assert.Nil(t, err)
+		return a1, a2
+	}
+
+	check := func(b *Bank, a1 uuid.UUID, a2 uuid.UUID) {
+		ac, _ := b.GetAccount(a1)
+		assert.Equal(t, AccountClosed, ac.Status())
+		assert.Equal(t, int64(0), ac.Balance())
+		ac, _ = b.GetAccount(a2)
+		assert.Equal(t, int64(1000), ac.Balance())
+
+		history, _ := b.StatusHistory(a1)
+		if assert.Len(t, history, 3) {
+			assert.Equal(t, "cleared", history[1].Reason)
+		}
+		assert.Empty(t, b.schedules.activeOf(a1))
+	}
+
+	// write-ahead log, before and after snapshot
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	a1, a2 := fill(b)
+	assert.Nil(t, b.wal.close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1, a2)
+	assert.Nil(t, b.Close())
+
+	b, err = Open(dir)
+	assert.Nil(t, err)
+	check(b, a1, a2)
+	assert.Nil(t, b.Close())
+
+	// single file storage
+	path := filepath.Join(dir, "bank.db")
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	a1, a2 = fill(b)
+	assert.Nil(t, b.Close())
+
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err = New(s)
+	assert.Nil(t, err)
+	check(b, a1, a2)
+	assert.Nil(t, b.Close())
+}
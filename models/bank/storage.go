@@ -0,0 +1,281 @@
+package bank
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+var ErrAccountNotFound = errors.New("no account found")
+
+// Storage keeps accounts of the bank. Bank does all the validation and
+// serializes writes, storage only has to keep the state consistent: a
+// change is either stored completely or not at all.
+type Storage interface {
+	// CreateAccount stores a new account together with its opening
+	// transaction, if there is one
+	CreateAccount(ac Account, opening *Transaction) error
+	// GetAccount returns ErrAccountNotFound for unknown IDs
+	GetAccount(id uuid.UUID) (Account, error)
+	// ApplyTransfer stores the transaction and sets balances of the
+	// accounts it touches to those of its postings
+	ApplyTransfer(tx Transaction) error
+	// ApplyBatch stores the transactions in order, all of them or none
+	ApplyBatch(txs []Transaction) error
+	ListAccounts() ([]Account, error)
+	// Transactions returns stored transactions to rebuild the ledger on
+	// start. Volatile storage returns none.
+	Transactions() ([]Transaction, error)
+	SaveIdempotencyRecord(rec IdempotencyRecord) error
+	// IdempotencyRecords returns stored records which are not expired yet.
+	// Volatile storage returns none.
+	IdempotencyRecords() ([]IdempotencyRecord, error)
+	// SaveHold stores the hold state together with its capture
+	// transaction and its fee, if there are ones, applied as by ApplyBatch
+	SaveHold(h Hold, txs []Transaction) error
+	// Holds returns stored holds. Volatile storage returns none.
+	Holds() ([]Hold, error)
+	// ChangeStatus sets the account status and stores the change together
+	// with the sweep transaction of a closed account, if there is one.
+	// Scheduled transfers the change cancels are stored as cancelled.
+	ChangeStatus(ch StatusChange, sweep *Transaction) error
+	// StatusChanges returns stored status changes in order. Volatile
+	// storage returns none.
+	StatusChanges() ([]StatusChange, error)
+	SetOverdraftLimit(id uuid.UUID, limit int64, at time.Time) error
+	SetSpendingLimits(id uuid.UUID, limits SpendingLimits, at time.Time) error
+	// SaveScheduledTransfer stores the scheduled transfer state together
+	// with its run and the transfer made by it and its fee, if there are
+	// ones, applied as by ApplyBatch
+	SaveScheduledTransfer(s ScheduledTransfer, run *ScheduledRun, txs []Transaction) error
+	// ScheduledTransfers returns stored scheduled transfers and their runs
+	// in order. Volatile storage returns none.
+	ScheduledTransfers() ([]ScheduledTransfer, []ScheduledRun, error)
+	// SaveInterest stores the interest state together with the interest
+	// transactions posted, applied as by ApplyBatch
+	SaveInterest(st InterestState, txs []Transaction) error
+	// Interest returns the stored interest state, nil if there is none.
+	// Volatile storage returns none.
+	Interest() (*InterestState, error)
+	// Check fails if the last write of the storage failed or it is closed
+	Check() error
+	Close() error
+}
+
+// MemoryStorage keeps accounts in a map. Transactions, idempotency records,
+// holds, status changes, scheduled transfers and the interest state are
+// not kept, the bank indexes them already.
+type MemoryStorage struct {
+	accounts map[uuid.UUID]*Account
+	mu       *sync.RWMutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		accounts: make(map[uuid.UUID]*Account),
+		mu:       &sync.RWMutex{},
+	}
+}
+
+func (s *MemoryStorage) CreateAccount(ac Account, opening *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[ac.id]; ok {
+		return errors.New("account already exists")
+	}
+
+	s.accounts[ac.id] = &ac
+	return nil
+}
+
+func (s *MemoryStorage) GetAccount(id uuid.UUID) (Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ac, ok := s.accounts[id]
+	if !ok {
+		return Account{}, ErrAccountNotFound
+	}
+	return *ac, nil
+}
+
+func (s *MemoryStorage) ApplyTransfer(tx Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applyTransfer(tx)
+}
+
+func (s *MemoryStorage) ApplyBatch(txs []Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applyBatch(txs)
+}
+
+func (s *MemoryStorage) applyBatch(txs []Transaction) error {
+	for _, tx := range txs {
+		for _, p := range tx.Postings {
+			if _, ok := s.accounts[p.AccountID]; !ok && p.AccountID != SystemAccountID {
+				return ErrAccountNotFound
+			}
+		}
+	}
+
+	for _, tx := range txs {
+		applyPostings(s.accounts, tx)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) applyTransfer(tx Transaction) error {
+	for _, p := range tx.Postings {
+		if p.AccountID == SystemAccountID {
+			continue
+		}
+		if _, ok := s.accounts[p.AccountID]; !ok {
+			return ErrAccountNotFound
+		}
+	}
+
+	applyPostings(s.accounts, tx)
+	return nil
+}
+
+func (s *MemoryStorage) ListAccounts() ([]Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Account, 0, len(s.accounts))
+	for _, ac := range s.accounts {
+		res = append(res, *ac)
+	}
+	return res, nil
+}
+
+func (s *MemoryStorage) Transactions() ([]Transaction, error) {
+	return nil, nil
+}
+
+func (s *MemoryStorage) SaveIdempotencyRecord(rec IdempotencyRecord) error {
+	return nil
+}
+
+func (s *MemoryStorage) IdempotencyRecords() ([]IdempotencyRecord, error) {
+	return nil, nil
+}
+
+func (s *MemoryStorage) SaveHold(h Hold, txs []Transaction) error {
+	if len(txs) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applyBatch(txs)
+}
+
+func (s *MemoryStorage) Holds() ([]Hold, error) {
+	return nil, nil
+}
+
+func (s *MemoryStorage) ChangeStatus(ch StatusChange, sweep *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ac, ok := s.accounts[ch.AccountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	if sweep != nil {
+		if err := s.applyTransfer(*sweep); err != nil {
+			return err
+		}
+	}
+
+	ac.status = ch.To
+	ac.updatedAt = ch.At
+	return nil
+}
+
+func (s *MemoryStorage) StatusChanges() ([]StatusChange, error) {
+	return nil, nil
+}
+
+func (s *MemoryStorage) SetOverdraftLimit(id uuid.UUID, limit int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ac, ok := s.accounts[id]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	ac.overdraft = limit
+	ac.updatedAt = at
+	return nil
+}
+
+func (s *MemoryStorage) SetSpendingLimits(id uuid.UUID, limits SpendingLimits, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ac, ok := s.accounts[id]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	ac.limits = limits
+	ac.updatedAt = at
+	return nil
+}
+
+func (s *MemoryStorage) SaveScheduledTransfer(st ScheduledTransfer, run *ScheduledRun, txs []Transaction) error {
+	if len(txs) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applyBatch(txs)
+}
+
+func (s *MemoryStorage) ScheduledTransfers() ([]ScheduledTransfer, []ScheduledRun, error) {
+	return nil, nil, nil
+}
+
+func (s *MemoryStorage) SaveInterest(st InterestState, txs []Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applyBatch(txs)
+}
+
+func (s *MemoryStorage) Interest() (*InterestState, error) {
+	return nil, nil
+}
+
+func (s *MemoryStorage) Check() error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// applyPostings sets balances of the accounts touched by the transaction,
+// the system account is not stored
+func applyPostings(accounts map[uuid.UUID]*Account, tx Transaction) {
+	for _, p := range tx.Postings {
+		if p.AccountID == SystemAccountID {
+			continue
+		}
+		accounts[p.AccountID].balance = p.Balance
+		accounts[p.AccountID].updatedAt = tx.CreatedAt
+	}
+}
@@ -0,0 +1,119 @@
+package bank
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testStorages(t *testing.T, f func(t *testing.T, s Storage)) {
+	t.Run("memory", func(t *testing.T) {
+		f(t, NewMemoryStorage())
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir := tempBankDir(t)
+		defer os.RemoveAll(dir)
+
+		s, err := OpenFileStorage(filepath.Join(dir, "bank.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		f(t, s)
+	})
+}
+
+func TestStorage_Accounts(t *testing.T) {
+	testStorages(t, func(t *testing.T, s Storage) {
+		ac := Account{id: uuid.New(), createdAt: now(), updatedAt: now(), balance: 100}
+		assert.Nil(t, s.CreateAccount(ac, nil))
+		assert.NotNil(t, s.CreateAccount(ac, nil))
+
+		got, err := s.GetAccount(ac.id)
+		assert.Nil(t, err)
+		assert.Equal(t, ac, got)
+
+		_, err = s.GetAccount(uuid.New())
+		assert.Equal(t, ErrAccountNotFound, err)
+
+		list, err := s.ListAccounts()
+		assert.Nil(t, err)
+		assert.Equal(t, []Account{ac}, list)
+	})
+}
+
+func TestStorage_ApplyTransfer(t *testing.T) {
+	testStorages(t, func(t *testing.T, s Storage) {
+		from := Account{id: uuid.New(), balance: 100}
+		to := Account{id: uuid.New(), balance: 5}
+		assert.Nil(t, s.CreateAccount(from, nil))
+		assert.Nil(t, s.CreateAccount(to, nil))
+
+		tx := newTransaction(uuid.New(), KindTransfer, "RUB", from.id, to.id, 30, 70, 35, now())
+		assert.Nil(t, s.ApplyTransfer(tx))
+
+		got, _ := s.GetAccount(from.id)
+		assert.Equal(t, int64(70), got.balance)
+		assert.Equal(t, tx.CreatedAt, got.updatedAt)
+		got, _ = s.GetAccount(to.id)
+		assert.Equal(t, int64(35), got.balance)
+
+		// nothing changes if any of the accounts is unknown
+		tx = newTransaction(uuid.New(), KindTransfer, "RUB", from.id, uuid.New(), 30, 40, 30, now())
+		assert.Equal(t, ErrAccountNotFound, s.ApplyTransfer(tx))
+		got, _ = s.GetAccount(from.id)
+		assert.Equal(t, int64(70), got.balance)
+	})
+}
+
+func TestFileStorage_Reopen(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bank.db")
+
+	s, err := OpenFileStorage(path)
+	assert.Nil(t, err)
+	b, err := New(s)
+	assert.Nil(t, err)
+
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	for i := 0; i < 10; i++ {
+		_, err = b.Transfer(a1, a2, 10)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, b.Close())
+
+	// outdated account records are compacted away on open
+	info, _ := os.Stat(path)
+	s, err = OpenFileStorage(path)
+	assert.Nil(t, err)
+	compacted, _ := os.Stat(path)
+	assert.True(t, compacted.Size() < info.Size())
+
+	restored, err := New(s)
+	assert.Nil(t, err)
+	defer restored.Close()
+
+	balance, _ := restored.GetAccountBalance(a1)
+	assert.Equal(t, "900", balance)
+	balance, _ = restored.GetAccountBalance(a2)
+	assert.Equal(t, "100", balance)
+	assert.Equal(t, b.Ledger().Transactions(), restored.Ledger().Transactions())
+
+	_, err = restored.Transfer(a2, a1, 100)
+	assert.Nil(t, err)
+	balance, _ = restored.GetAccountBalance(a1)
+	assert.Equal(t, "1000", balance)
+
+	// transactions are read back from the file, not kept by the storage
+	txs, err := s.Transactions()
+	assert.Nil(t, err)
+	if assert.Len(t, txs, len(restored.Ledger().Transactions())) {
+		assert.Equal(t, int64(100), txs[len(txs)-1].Amount)
+	}
+}
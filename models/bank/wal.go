@@ -0,0 +1,101 @@
+package bank
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// WAL is an append-only log of bank events, used with the in-memory storage
+type WAL struct {
+	log *logFile
+	seq uint64
+	mu  *sync.Mutex
+	// snapshotErr is the failure of the last snapshot, records pile up in
+	// the log until one succeeds
+	snapshotErr error
+}
+
+// walRecord is a logged event, Posting is the Seq of the first posting it
+// makes, so replay numbers postings as they were numbered when logged
+type walRecord struct {
+	Seq     uint64          `json:"seq"`
+	Posting uint64          `json:"posting,omitempty"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// openWAL opens or creates the log and returns records already in it
+func openWAL(path string) (*WAL, []walRecord, error) {
+	log, bodies, err := openLogFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := &WAL{log: log, mu: &sync.Mutex{}}
+	records := make([]walRecord, 0, len(bodies))
+	for _, body := range bodies {
+		var rec walRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			log.close()
+			return nil, nil, err
+		}
+		records = append(records, rec)
+		w.seq = rec.Seq
+	}
+
+	return w, records, nil
+}
+
+// append logs the event and returns the Seq of its record
+func (w *WAL) append(e event, posting uint64) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(walRecord{Seq: w.seq + 1, Posting: posting, Type: e.kind(), Data: data})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := w.log.append(body); err != nil {
+		return 0, err
+	}
+	w.seq++
+	return w.seq, nil
+}
+
+// reset drops all records, they must be covered by a snapshot already
+func (w *WAL) reset() error {
+	return w.log.reset()
+}
+
+// snapshotTaken records the result of a snapshot
+func (w *WAL) snapshotTaken(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.snapshotErr = err
+}
+
+// check fails if the last write of the log or the last snapshot failed
+func (w *WAL) check() error {
+	if err := w.log.check(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.snapshotErr != nil {
+		return errors.New("last snapshot failed: " + w.snapshotErr.Error())
+	}
+	return nil
+}
+
+func (w *WAL) close() error {
+	return w.log.close()
+}
@@ -0,0 +1,302 @@
+package bank
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tempBankDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "simplebank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestOpen_ReplaysWAL(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+
+	a1, _ := b.CreateAccount(10000)
+	a2, _ := b.CreateAccount(500)
+	_, err = b.Transfer(a1, a2, 2500)
+	assert.Nil(t, err)
+
+	// simulate a crash: no snapshot, WAL left as is
+	assert.Nil(t, b.wal.close())
+
+	restored, err := Open(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+
+	balance, err := restored.GetAccountBalance(a1)
+	assert.Nil(t, err)
+	assert.Equal(t, "7500", balance)
+	balance, err = restored.GetAccountBalance(a2)
+	assert.Nil(t, err)
+	assert.Equal(t, "3000", balance)
+
+	assert.Equal(t, b.Ledger().Transactions(), restored.Ledger().Transactions())
+	assert.Equal(t, b.Ledger().Postings(a1), restored.Ledger().Postings(a1))
+}
+
+func TestOpen_ReplaysPostingSeq(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+
+	// unrelated transfers commit concurrently
+	var accounts []uuid.UUID
+	for i := 0; i < 8; i++ {
+		id, _ := b.CreateAccount(1000)
+		accounts = append(accounts, id)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < len(accounts); i += 2 {
+		wg.Add(1)
+		go func(from uuid.UUID, to uuid.UUID) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				b.Transfer(from, to, 1)
+			}
+		}(accounts[i], accounts[i+1])
+	}
+	wg.Wait()
+	assert.Nil(t, b.wal.close())
+
+	restored, err := Open(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+
+	assert.Equal(t, b.Ledger().Transactions(), restored.Ledger().Transactions())
+	for _, id := range accounts {
+		assert.Equal(t, b.Ledger().Postings(id), restored.Ledger().Postings(id))
+	}
+}
+
+func TestOpen_SnapshotAndWAL(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+
+	a1, _ := b.CreateAccount(10000)
+	a2, _ := b.CreateAccount(0)
+	_, err = b.Transfer(a1, a2, 100)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Snapshot())
+
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	// changes after the snapshot live in the WAL only
+	_, err = b.Transfer(a1, a2, 200)
+	assert.Nil(t, err)
+	a3, _ := b.CreateAccount(42)
+	assert.Nil(t, b.wal.close())
+
+	restored, err := Open(dir)
+	assert.Nil(t, err)
+
+	for id, expected := range map[uuid.UUID]string{a1: "9700", a2: "300", a3: "42"} {
+		balance, err := restored.GetAccountBalance(id)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, balance)
+	}
+	assert.Len(t, restored.Ledger().Transactions(), 4)
+
+	// sequence goes on after restore
+	_, err = restored.Transfer(a2, a3, 300)
+	assert.Nil(t, err)
+	assert.Nil(t, restored.Close())
+
+	restored, err = Open(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+
+	balance, _ := restored.GetAccountBalance(a3)
+	assert.Equal(t, "342", balance)
+	assert.Len(t, restored.Ledger().Transactions(), 5)
+}
+
+func TestOpen_TornWALRecord(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	a1, _ := b.CreateAccount(100)
+	assert.Nil(t, b.wal.close())
+
+	// half written record at the end of the log
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	_, err = f.WriteString(`0badc0de {"seq":2,"type":"transfer","da`)
+	assert.Nil(t, err)
+	f.Close()
+
+	restored, err := Open(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+
+	balance, err := restored.GetAccountBalance(a1)
+	assert.Nil(t, err)
+	assert.Equal(t, "100", balance)
+
+	a2, err := restored.CreateAccount(1)
+	assert.Nil(t, err)
+	_, err = restored.Transfer(a1, a2, 1)
+	assert.Nil(t, err)
+}
+
+func TestOpen_CorruptedWAL(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, walFileName)
+	err := ioutil.WriteFile(path, []byte("00000000 {\"seq\":1}\n00000000 {\"seq\":2}\n"), 0600)
+	assert.Nil(t, err)
+
+	_, err = Open(dir)
+	assert.NotNil(t, err)
+}
+
+func TestBank_SnapshotInMemory(t *testing.T) {
+	assert.NotNil(t, NewBank().Snapshot())
+	assert.Nil(t, NewBank().Close())
+}
+
+func TestBank_CloseWaitsForJobs(t *testing.T) {
+	b := NewBank()
+
+	var running, runs int32
+	started := make(chan struct{}, 1)
+	b.startJob(time.Millisecond, func() error {
+		atomic.StoreInt32(&running, 1)
+		atomic.AddInt32(&runs, 1)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&running, 0)
+		return nil
+	}, nil)
+
+	<-started
+	assert.Nil(t, b.Close())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&running))
+
+	n := atomic.LoadInt32(&runs)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt32(&runs))
+}
+
+func TestOpen_ReplaysExchangeWithoutRates(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+	b.SetRates(testRates(t, `{"rates": {"EUR/USD": "1.1"}}`))
+
+	eur, _ := b.CreateAccountWith(AccountParams{Balance: 1000, Currency: "EUR"})
+	usd, _ := b.CreateAccountWith(AccountParams{Balance: 0, Currency: "USD"})
+	_, err = b.Exchange(eur, usd, 1000)
+	assert.Nil(t, err)
+	assert.Nil(t, b.wal.close())
+
+	// conversion is taken from the log, not from the current rates
+	restored, err := Open(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+
+	balance, _ := restored.GetAccountBalance(usd)
+	assert.Equal(t, "1100", balance)
+	assert.Equal(t, b.Ledger().Transactions(), restored.Ledger().Transactions())
+}
+
+func TestOpen_ReplaysReversal(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+	txID, _ := b.Transfer(a1, a2, 600)
+	_, err = b.ReverseTransfer(txID, 200)
+	assert.Nil(t, err)
+	assert.Nil(t, b.wal.close())
+
+	restored, err := Open(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), restored.Ledger().Reversed(txID))
+	assert.Nil(t, restored.Close())
+
+	// reversed amount is rebuilt from the snapshot too
+	restored, err = Open(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+	_, err = restored.ReverseTransfer(txID, 401)
+	assert.NotNil(t, err)
+	_, err = restored.ReverseTransfer(txID, 400)
+	assert.Nil(t, err)
+}
+
+type failingStorage struct {
+	Storage
+}
+
+func (s failingStorage) ApplyTransfer(tx Transaction) error {
+	return errors.New("disk is full")
+}
+
+func TestOpen_SkipsAbortedEvents(t *testing.T) {
+	dir := tempBankDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := Open(dir)
+	assert.Nil(t, err)
+
+	a1, _ := b.CreateAccount(1000)
+	a2, _ := b.CreateAccount(0)
+
+	// the transfer is logged but fails to apply
+	storage := b.storage
+	b.storage = failingStorage{storage}
+	_, err = b.Transfer(a1, a2, 100)
+	assert.NotNil(t, err)
+	b.storage = storage
+
+	_, err = b.Transfer(a1, a2, 300)
+	assert.Nil(t, err)
+	assert.Nil(t, b.wal.close())
+
+	restored, err := Open(dir)
+	assert.Nil(t, err)
+	defer restored.Close()
+
+	balance, _ := restored.GetAccountBalance(a1)
+	assert.Equal(t, "700", balance)
+	balance, _ = restored.GetAccountBalance(a2)
+	assert.Equal(t, "300", balance)
+	assert.Equal(t, b.Ledger().Transactions(), restored.Ledger().Transactions())
+	assert.Equal(t, b.Ledger().Postings(a1), restored.Ledger().Postings(a1))
+}
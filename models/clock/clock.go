@@ -0,0 +1,49 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells time to background jobs, tests drive them with Manual
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now().UTC().Round(0) }
+
+// System is the wall clock in UTC
+var System Clock = systemClock{}
+
+// Manual stands still until it is set or advanced
+type Manual struct {
+	t  time.Time
+	mu *sync.Mutex
+}
+
+func NewManual(t time.Time) *Manual {
+	return &Manual{t: t, mu: &sync.Mutex{}}
+}
+
+func (c *Manual) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.t
+}
+
+func (c *Manual) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.t = t
+}
+
+func (c *Manual) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.t = c.t.Add(d)
+}
@@ -0,0 +1,38 @@
+package currency
+
+import (
+	"errors"
+	"strings"
+)
+
+// Default is the currency of accounts created without one, balances used
+// to be kept in kopecks
+const Default = "RUB"
+
+// Currency is an ISO 4217 currency, amounts are kept in its minor units.
+// Exponent is the number of minor unit digits, e.g. 2 for cents.
+type Currency struct {
+	Code     string
+	Exponent int
+}
+
+var currencies = map[string]int{
+	"AED": 2, "AUD": 2, "BHD": 3, "BRL": 2, "BYN": 2, "CAD": 2, "CHF": 2,
+	"CLP": 0, "CNY": 2, "CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "GEL": 2,
+	"HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "IQD": 3, "ISK": 0,
+	"JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "KZT": 2, "LYD": 3, "MXN": 2,
+	"NOK": 2, "NZD": 2, "OMR": 3, "PLN": 2, "RUB": 2, "SAR": 2, "SEK": 2,
+	"SGD": 2, "THB": 2, "TND": 3, "TRY": 2, "UAH": 2, "USD": 2, "VND": 0,
+	"XAF": 0, "XOF": 0, "ZAR": 2,
+}
+
+// Get looks the currency up by its code, code is case insensitive
+func Get(code string) (Currency, error) {
+	code = strings.ToUpper(code)
+
+	exp, ok := currencies[code]
+	if !ok {
+		return Currency{}, errors.New("unknown currency " + code)
+	}
+	return Currency{Code: code, Exponent: exp}, nil
+}
@@ -0,0 +1,30 @@
+package currency
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	cases := map[string]struct {
+		code     string
+		expected Currency
+		ok       bool
+	}{
+		"rouble":     {code: "RUB", expected: Currency{"RUB", 2}, ok: true},
+		"yen":        {code: "JPY", expected: Currency{"JPY", 0}, ok: true},
+		"dinar":      {code: "KWD", expected: Currency{"KWD", 3}, ok: true},
+		"lower case": {code: "usd", expected: Currency{"USD", 2}, ok: true},
+		"unknown":    {code: "XXX", ok: false},
+		"empty":      {code: "", ok: false},
+	}
+
+	for key, item := range cases {
+		c, err := Get(item.code)
+		assert.Equal(t, item.ok, err == nil, key)
+		assert.Equal(t, item.expected, c, key)
+	}
+
+	_, err := Get(Default)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,239 @@
+package fees
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/JohnCGriffin/overflow"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"math/big"
+	"simple_bank/models/currency"
+	"sync"
+)
+
+type Kind string
+
+const (
+	Flat    Kind = "flat"
+	Percent Kind = "percent"
+	Tiered  Kind = "tiered"
+)
+
+// Rule is the fee of a transfer, in minor units of the sender currency.
+// Flat charges Amount. Percent charges Rate, a decimal fraction of the
+// transferred amount rounded half up, kept between Min and Max when they
+// are set. Tiered charges by the first tier the amount fits in.
+type Rule struct {
+	Kind   Kind   `json:"type"`
+	Amount int64  `json:"amount,omitempty"`
+	Rate   string `json:"rate,omitempty"`
+	Min    int64  `json:"min,omitempty"`
+	Max    int64  `json:"max,omitempty"`
+	Tiers  []Tier `json:"tiers,omitempty"`
+
+	rate *big.Rat
+}
+
+// Tier applies its flat or percent rule to amounts up to UpTo, zero UpTo
+// of the last tier takes any amount
+type Tier struct {
+	UpTo int64 `json:"up_to"`
+	Rule
+}
+
+// Schedule holds fee rules by currency and the bank accounts fees are
+// paid to
+type Schedule struct {
+	rules    map[string]Rule
+	accounts map[string]uuid.UUID
+}
+
+// scheduleFile is the fees file format, amounts are in minor units and
+// rates are decimal strings to keep them exact:
+//
+//	{"accounts": {"USD": "<account id>"},
+//	 "fees": {"USD": {"type": "percent", "rate": "0.01", "min": 50, "max": 2000}}}
+type scheduleFile struct {
+	Accounts map[string]uuid.UUID `json:"accounts"`
+	Fees     map[string]Rule      `json:"fees"`
+}
+
+func ParseSchedule(data []byte) (*Schedule, error) {
+	var f scheduleFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	s := &Schedule{rules: make(map[string]Rule), accounts: make(map[string]uuid.UUID)}
+	for code, id := range f.Accounts {
+		cur, err := currency.Get(code)
+		if err != nil {
+			return nil, err
+		}
+		s.accounts[cur.Code] = id
+	}
+
+	for code, rule := range f.Fees {
+		cur, err := currency.Get(code)
+		if err != nil {
+			return nil, err
+		}
+		if err := rule.parse(true); err != nil {
+			return nil, errors.New(cur.Code + " fee: " + err.Error())
+		}
+		if _, ok := s.accounts[cur.Code]; !ok {
+			return nil, errors.New("no fee account for " + cur.Code)
+		}
+		s.rules[cur.Code] = rule
+	}
+
+	return s, nil
+}
+
+// parse validates the rule and parses its rate, tiers can not be nested
+func (r *Rule) parse(tiers bool) error {
+	if r.Amount < 0 || r.Min < 0 || r.Max < 0 {
+		return errors.New("amounts can not be negative")
+	}
+
+	switch r.Kind {
+	case Flat:
+	case Percent:
+		rate, ok := new(big.Rat).SetString(r.Rate)
+		if !ok || rate.Sign() < 0 || rate.Cmp(big.NewRat(1, 1)) > 0 {
+			return errors.New("rate must be a decimal fraction between 0 and 1")
+		}
+		if r.Max > 0 && r.Min > r.Max {
+			return errors.New("min is greater than max")
+		}
+		r.rate = rate
+	case Tiered:
+		if !tiers {
+			return errors.New("tiers can not be nested")
+		}
+		if len(r.Tiers) == 0 {
+			return errors.New("no tiers")
+		}
+		for i := range r.Tiers {
+			t := &r.Tiers[i]
+			last := i == len(r.Tiers)-1
+			if t.UpTo < 0 || (t.UpTo == 0 && !last) || (t.UpTo > 0 && i > 0 && t.UpTo <= r.Tiers[i-1].UpTo) {
+				return errors.New("tiers must be in ascending order of up_to")
+			}
+			if err := t.Rule.parse(false); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unknown fee type " + string(r.Kind))
+	}
+	return nil
+}
+
+// fee returns the fee of the amount, false if no tier takes it
+func (r Rule) fee(amount int64) (int64, bool) {
+	switch r.Kind {
+	case Flat:
+		return r.Amount, true
+	case Percent:
+		fee := roundHalfUp(new(big.Rat).Mul(big.NewRat(amount, 1), r.rate))
+		if fee < r.Min {
+			fee = r.Min
+		}
+		if r.Max > 0 && fee > r.Max {
+			fee = r.Max
+		}
+		return fee, true
+	case Tiered:
+		for _, t := range r.Tiers {
+			if t.UpTo == 0 || amount <= t.UpTo {
+				return t.Rule.fee(amount)
+			}
+		}
+	}
+	return 0, false
+}
+
+// roundHalfUp rounds the non-negative number to an integer, the amount
+// times a rate up to 1 always fits in int64
+func roundHalfUp(r *big.Rat) int64 {
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if new(big.Int).Mul(m, big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	return q.Int64()
+}
+
+// Fee returns the fee of transferring the amount in the currency and the
+// account it is paid to. Currencies without a rule are free.
+func (s *Schedule) Fee(amount int64, code string) (int64, uuid.UUID, error) {
+	rule, ok := s.rules[code]
+	if !ok {
+		return 0, uuid.Nil, nil
+	}
+	if amount < 0 {
+		return 0, uuid.Nil, errors.New("can not charge a fee of negative amount")
+	}
+
+	fee, ok := rule.fee(amount)
+	if !ok {
+		return 0, uuid.Nil, errors.New("no fee tier for the amount")
+	}
+	if _, ok := overflow.Add64(amount, fee); !ok {
+		return 0, uuid.Nil, errors.New("fee is too big")
+	}
+	return fee, s.accounts[code], nil
+}
+
+// Accounts returns the fee accounts by currency
+func (s *Schedule) Accounts() map[string]uuid.UUID {
+	res := make(map[string]uuid.UUID, len(s.accounts))
+	for code, id := range s.accounts {
+		res[code] = id
+	}
+	return res
+}
+
+func (s *Schedule) Len() int {
+	return len(s.rules)
+}
+
+// Fees is a schedule loaded from a file which can be reloaded at runtime
+type Fees struct {
+	path     string
+	schedule *Schedule
+	mu       *sync.RWMutex
+}
+
+func Load(path string) (*Fees, error) {
+	f := &Fees{path: path, mu: &sync.RWMutex{}}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again, the current schedule is kept if it fails
+func (f *Fees) Reload() error {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	s, err := ParseSchedule(data)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.schedule = s
+	return nil
+}
+
+func (f *Fees) Schedule() *Schedule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.schedule
+}
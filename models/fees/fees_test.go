@@ -0,0 +1,115 @@
+package fees
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const account = "6f1c3c2e-7a0e-4c8e-9d6b-2b9f3c1d5e7a"
+
+func TestSchedule_Fee(t *testing.T) {
+	s, err := ParseSchedule([]byte(`{
+		"accounts": {"USD": "` + account + `", "eur": "` + account + `", "JPY": "` + account + `"},
+		"fees": {
+			"USD": {"type": "percent", "rate": "0.015", "min": 50, "max": 2000},
+			"EUR": {"type": "flat", "amount": 100},
+			"JPY": {"type": "tiered", "tiers": [
+				{"up_to": 10000, "type": "flat", "amount": 0},
+				{"up_to": 100000, "type": "flat", "amount": 200},
+				{"type": "percent", "rate": "0.001"}
+			]}
+		}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, s.Len())
+
+	cases := map[string]struct {
+		amount int64
+		code   string
+		fee    int64
+	}{
+		"percent":           {amount: 10000, code: "USD", fee: 150},
+		"percent half up":   {amount: 10100, code: "USD", fee: 152},
+		"percent min":       {amount: 100, code: "USD", fee: 50},
+		"percent max":       {amount: 1000000, code: "USD", fee: 2000},
+		"flat":              {amount: 1, code: "EUR", fee: 100},
+		"first tier":        {amount: 10000, code: "JPY", fee: 0},
+		"second tier":       {amount: 10001, code: "JPY", fee: 200},
+		"open tier":         {amount: 1000000, code: "JPY", fee: 1000},
+		"no rule":           {amount: 1000, code: "GBP", fee: 0},
+		"percent of little": {amount: 1, code: "USD", fee: 50},
+	}
+
+	for key, item := range cases {
+		fee, id, err := s.Fee(item.amount, item.code)
+		assert.Nil(t, err, key)
+		assert.Equal(t, item.fee, fee, key)
+		if item.code != "GBP" {
+			assert.Equal(t, uuid.MustParse(account), id, key)
+		}
+	}
+
+	// the fee does not fit next to the amount
+	_, _, err = s.Fee(9223372036854775807, "EUR")
+	assert.NotNil(t, err)
+}
+
+func TestParseSchedule_Errors(t *testing.T) {
+	accounts := `"accounts": {"USD": "` + account + `"}, `
+	cases := map[string]string{
+		"bad json":         `{"fees": `,
+		"unknown currency": `{"accounts": {"ABC": "` + account + `"}}`,
+		"unknown type":     `{` + accounts + `"fees": {"USD": {"type": "free"}}}`,
+		"no account":       `{"fees": {"USD": {"type": "flat", "amount": 1}}}`,
+		"negative":         `{` + accounts + `"fees": {"USD": {"type": "flat", "amount": -1}}}`,
+		"bad rate":         `{` + accounts + `"fees": {"USD": {"type": "percent", "rate": "x"}}}`,
+		"rate above one":   `{` + accounts + `"fees": {"USD": {"type": "percent", "rate": "1.5"}}}`,
+		"min above max":    `{` + accounts + `"fees": {"USD": {"type": "percent", "rate": "0.1", "min": 5, "max": 1}}}`,
+		"no tiers":         `{` + accounts + `"fees": {"USD": {"type": "tiered"}}}`,
+		"unordered tiers":  `{` + accounts + `"fees": {"USD": {"type": "tiered", "tiers": [{"up_to": 10, "type": "flat"}, {"up_to": 5, "type": "flat"}]}}}`,
+		"open middle tier": `{` + accounts + `"fees": {"USD": {"type": "tiered", "tiers": [{"type": "flat"}, {"up_to": 5, "type": "flat"}]}}}`,
+		"nested tiers":     `{` + accounts + `"fees": {"USD": {"type": "tiered", "tiers": [{"type": "tiered"}]}}}`,
+	}
+
+	for key, input := range cases {
+		_, err := ParseSchedule([]byte(input))
+		assert.NotNil(t, err, key)
+	}
+}
+
+func TestFees_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fees.json")
+
+	schedule := func(amount string) []byte {
+		return []byte(`{"accounts": {"USD": "` + account + `"}, "fees": {"USD": {"type": "flat", "amount": ` + amount + `}}}`)
+	}
+
+	assert.Nil(t, ioutil.WriteFile(path, schedule("10"), 0600))
+	f, err := Load(path)
+	assert.Nil(t, err)
+	fee, _, _ := f.Schedule().Fee(100, "USD")
+	assert.Equal(t, int64(10), fee)
+
+	assert.Nil(t, ioutil.WriteFile(path, schedule("20"), 0600))
+	assert.Nil(t, f.Reload())
+	fee, _, _ = f.Schedule().Fee(100, "USD")
+	assert.Equal(t, int64(20), fee)
+
+	// broken file keeps the previous schedule
+	assert.Nil(t, ioutil.WriteFile(path, schedule("-1"), 0600))
+	assert.NotNil(t, f.Reload())
+	fee, _, _ = f.Schedule().Fee(100, "USD")
+	assert.Equal(t, int64(20), fee)
+
+	_, err = Load(filepath.Join(dir, "missing.json"))
+	assert.NotNil(t, err)
+}
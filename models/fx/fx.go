@@ -0,0 +1,196 @@
+package fx
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"simple_bank/models/currency"
+	"strings"
+	"sync"
+)
+
+type RoundingMode string
+
+const (
+	// HalfEven is banker's rounding: ties go to the even neighbour
+	HalfEven RoundingMode = "half-even"
+	HalfUp   RoundingMode = "half-up"
+)
+
+// Table holds exchange rates between currency pairs. Rate of "USD/EUR" is
+// how many euros one dollar buys. Pairs are not inverted implicitly.
+type Table struct {
+	Rounding RoundingMode
+	rates    map[string]*big.Rat
+}
+
+// tableFile is the rates file format, rates are decimal strings to keep
+// them exact:
+//
+//	{"rounding": "half-even", "rates": {"USD/EUR": "0.9213"}}
+type tableFile struct {
+	Rounding RoundingMode      `json:"rounding"`
+	Rates    map[string]string `json:"rates"`
+}
+
+// Conversion is the result of converting an amount. Remainder is the part
+// of the exact converted amount lost by rounding, in minor units of the
+// target currency.
+type Conversion struct {
+	Rate      string
+	Amount    int64
+	Remainder string
+}
+
+func ParseTable(data []byte) (*Table, error) {
+	var f tableFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	t := &Table{Rounding: f.Rounding, rates: make(map[string]*big.Rat)}
+	switch t.Rounding {
+	case "":
+		t.Rounding = HalfEven
+	case HalfEven, HalfUp:
+	default:
+		return nil, errors.New("unknown rounding mode " + string(f.Rounding))
+	}
+
+	for pair, rate := range f.Rates {
+		codes := strings.Split(strings.ToUpper(pair), "/")
+		if len(codes) != 2 {
+			return nil, errors.New("invalid currency pair " + pair)
+		}
+		for _, code := range codes {
+			if _, err := currency.Get(code); err != nil {
+				return nil, err
+			}
+		}
+
+		r, ok := new(big.Rat).SetString(rate)
+		if !ok || r.Sign() <= 0 {
+			return nil, errors.New("invalid rate " + rate + " for " + pair)
+		}
+		t.rates[codes[0]+"/"+codes[1]] = r
+	}
+
+	return t, nil
+}
+
+func (t *Table) Len() int {
+	return len(t.rates)
+}
+
+// Convert converts the amount in minor units of one currency into minor
+// units of another one
+func (t *Table) Convert(amount int64, from, to currency.Currency) (Conversion, error) {
+	rate, ok := t.rates[from.Code+"/"+to.Code]
+	if !ok {
+		return Conversion{}, errors.New("no exchange rate for " + from.Code + "/" + to.Code)
+	}
+	if amount < 0 {
+		return Conversion{}, errors.New("can not convert negative amount")
+	}
+
+	// exact amount in target minor units
+	exact := new(big.Rat).Mul(big.NewRat(amount, 1), rate)
+	exact.Mul(exact, pow10Rat(to.Exponent-from.Exponent))
+
+	rounded := round(exact, t.Rounding)
+	if !rounded.IsInt64() {
+		return Conversion{}, errors.New("converted amount is too big")
+	}
+
+	remainder := new(big.Rat).Sub(exact, new(big.Rat).SetInt(rounded))
+	return Conversion{
+		Rate:      rate.FloatString(decimals(rate)),
+		Amount:    rounded.Int64(),
+		Remainder: remainder.FloatString(decimals(remainder)),
+	}, nil
+}
+
+// round rounds the non-negative number to an integer
+func round(r *big.Rat, mode RoundingMode) *big.Int {
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+
+	// compare the dropped fraction with one half
+	switch new(big.Int).Mul(m, big.NewInt(2)).Cmp(r.Denom()) {
+	case 1:
+		q.Add(q, big.NewInt(1))
+	case 0:
+		if mode == HalfUp || q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+func pow10Rat(exp int) *big.Rat {
+	p := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(exp))), nil)
+	if exp < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), p)
+	}
+	return new(big.Rat).SetInt(p)
+}
+
+// decimals returns the number of digits the decimal representation of r
+// needs, denominators here are always products of 2s and 5s
+func decimals(r *big.Rat) int {
+	d := new(big.Int).Set(r.Denom())
+	ten := big.NewInt(10)
+	n := 0
+	for d.Cmp(big.NewInt(1)) != 0 && n < 64 {
+		d.Quo(d, new(big.Int).GCD(nil, nil, d, ten))
+		n++
+	}
+	return n
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Rates is a table loaded from a file which can be reloaded at runtime
+type Rates struct {
+	path  string
+	table *Table
+	mu    *sync.RWMutex
+}
+
+func Load(path string) (*Rates, error) {
+	r := &Rates{path: path, mu: &sync.RWMutex{}}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the file again, the current table is kept if it fails
+func (r *Rates) Reload() error {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	t, err := ParseTable(data)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.table = t
+	return nil
+}
+
+func (r *Rates) Table() *Table {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.table
+}
@@ -0,0 +1,106 @@
+package fx
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"simple_bank/models/currency"
+	"testing"
+)
+
+var (
+	usd = currency.Currency{Code: "USD", Exponent: 2}
+	eur = currency.Currency{Code: "EUR", Exponent: 2}
+	jpy = currency.Currency{Code: "JPY", Exponent: 0}
+	kwd = currency.Currency{Code: "KWD", Exponent: 3}
+)
+
+func TestTable_Convert(t *testing.T) {
+	data := []byte(`{"rates": {"USD/EUR": "0.925", "EUR/USD": "1.5", "USD/JPY": "150.25", "JPY/KWD": "0.00205", "usd/kwd": "0.3"}}`)
+	halfEven, err := ParseTable(data)
+	assert.Nil(t, err)
+	assert.Equal(t, HalfEven, halfEven.Rounding)
+	assert.Equal(t, 5, halfEven.Len())
+
+	halfUp, err := ParseTable([]byte(`{"rounding": "half-up", "rates": {"USD/EUR": "0.925", "EUR/USD": "1.5"}}`))
+	assert.Nil(t, err)
+
+	cases := map[string]struct {
+		table     *Table
+		amount    int64
+		from, to  currency.Currency
+		rate      string
+		converted int64
+		remainder string
+	}{
+		"exact":              {table: halfEven, amount: 1000, from: usd, to: eur, rate: "0.925", converted: 925, remainder: "0"},
+		"tie up to even":     {table: halfEven, amount: 5, from: eur, to: usd, rate: "1.5", converted: 8, remainder: "-0.5"},
+		"tie down to even":   {table: halfEven, amount: 3, from: eur, to: usd, rate: "1.5", converted: 4, remainder: "0.5"},
+		"tie half up":        {table: halfUp, amount: 3, from: eur, to: usd, rate: "1.5", converted: 5, remainder: "-0.5"},
+		"below half":         {table: halfEven, amount: 1, from: usd, to: eur, rate: "0.925", converted: 1, remainder: "-0.075"},
+		"to zero exponent":   {table: halfEven, amount: 1001, from: usd, to: jpy, rate: "150.25", converted: 1504, remainder: "0.0025"},
+		"from zero exponent": {table: halfEven, amount: 1000, from: jpy, to: kwd, rate: "0.00205", converted: 2050, remainder: "0"},
+		"to three exponent":  {table: halfEven, amount: 1, from: usd, to: kwd, rate: "0.3", converted: 3, remainder: "0"},
+	}
+
+	for key, item := range cases {
+		conv, err := item.table.Convert(item.amount, item.from, item.to)
+		assert.Nil(t, err, key)
+		assert.Equal(t, item.rate, conv.Rate, key)
+		assert.Equal(t, item.converted, conv.Amount, key)
+		assert.Equal(t, item.remainder, conv.Remainder, key)
+	}
+
+	_, err = halfEven.Convert(100, eur, jpy)
+	assert.NotNil(t, err)
+
+	_, err = halfEven.Convert(9223372036854775807, usd, jpy)
+	assert.NotNil(t, err)
+}
+
+func TestParseTable_Errors(t *testing.T) {
+	cases := map[string]string{
+		"bad json":         `{"rates": `,
+		"unknown rounding": `{"rounding": "up", "rates": {}}`,
+		"bad pair":         `{"rates": {"USDEUR": "1"}}`,
+		"unknown currency": `{"rates": {"USD/ABC": "1"}}`,
+		"bad rate":         `{"rates": {"USD/EUR": "abc"}}`,
+		"negative rate":    `{"rates": {"USD/EUR": "-1"}}`,
+	}
+
+	for key, input := range cases {
+		_, err := ParseTable([]byte(input))
+		assert.NotNil(t, err, key)
+	}
+}
+
+func TestRates_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rates.json")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"rates": {"USD/EUR": "0.9"}}`), 0600))
+	rates, err := Load(path)
+	assert.Nil(t, err)
+
+	conv, _ := rates.Table().Convert(100, usd, eur)
+	assert.Equal(t, int64(90), conv.Amount)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"rates": {"USD/EUR": "0.8"}}`), 0600))
+	assert.Nil(t, rates.Reload())
+	conv, _ = rates.Table().Convert(100, usd, eur)
+	assert.Equal(t, int64(80), conv.Amount)
+
+	// broken file keeps the previous table
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"rates": {"USD/EUR": "x"}}`), 0600))
+	assert.NotNil(t, rates.Reload())
+	conv, _ = rates.Table().Convert(100, usd, eur)
+	assert.Equal(t, int64(80), conv.Amount)
+
+	_, err = Load(filepath.Join(dir, "missing.json"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,41 @@
+// Package reqctx keeps the request-scoped values shared by middlewares and
+// handlers in the gin context
+package reqctx
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"simple_bank/models/bank"
+)
+
+// keys of request-scoped values in the gin context
+const (
+	requestIDKey = "request_id"
+	loggerKey    = "logger"
+)
+
+// Set stores the request ID and the logger tagged with it
+func Set(c *gin.Context, id string, logger *zap.Logger) {
+	c.Set(requestIDKey, id)
+	c.Set(loggerKey, logger)
+}
+
+// RequestID returns the ID of the request, empty if it has none
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// Logger returns the logger of the request, a no-op one if it has none
+func Logger(c *gin.Context) *zap.Logger {
+	if l, ok := c.Get(loggerKey); ok {
+		if logger, ok := l.(*zap.Logger); ok {
+			return logger
+		}
+	}
+	return zap.NewNop()
+}
+
+// Bank returns the bank logging events of the request with its logger
+func Bank(c *gin.Context) *bank.Bank {
+	return bank.GetBank().WithLogger(Logger(c))
+}
@@ -3,23 +3,81 @@ package server
 import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"net/http"
+	"simple_bank/config"
 	"simple_bank/handlers"
+	"simple_bank/metrics"
 	"simple_bank/middlewares"
 )
 
+// NewRouter creates the router with default limits
 func NewRouter(logger *zap.Logger) *gin.Engine {
+	return newRouter(logger, config.Default().Limits)
+}
+
+func newRouter(logger *zap.Logger, limits config.Limits) *gin.Engine {
 	router := gin.New()
 
+	router.Use(middlewares.RequestID(logger))
 	router.Use(middlewares.ZapLogger(logger))
+	router.Use(middlewares.Metrics(router))
 	router.Use(gin.Recovery())
+	router.Use(middlewares.BodyLimit(limits.MaxBodyBytes))
 
 	router.GET("/", func(c *gin.Context) {
 		c.String(200, "This is your banking application")
 	})
+	router.GET("/metrics", gin.WrapH(metrics.Default.Handler()))
+	router.GET("/healthz", handlers.HealthHandler)
+	router.GET("/readyz", handlers.ReadyHandler)
 
-	router.PUT("/createAccount", handlers.CreateAccountHandler)
+	idempotency := middlewares.Idempotency(logger, limits.IdempotencyTTL)
+
+	router.PUT("/createAccount", idempotency, handlers.CreateAccountHandler)
 	router.GET("/balance/:id", handlers.GetBalanceByIdHandler)
-	router.POST("/transfer", handlers.TransferHandler)
+	router.GET("/accounts", handlers.ListAccountsHandler)
+	router.GET("/accounts/:id", handlers.GetAccountHandler)
+	router.GET("/accounts/:id/transactions", handlers.GetTransactionsHandler)
+	router.GET("/accounts/:id/statement", handlers.GetStatementHandler)
+	router.POST("/transfer", idempotency, handlers.TransferHandler)
+	router.POST("/transfer/quote", handlers.QuoteTransferHandler)
+	router.POST("/transfers/:id", staticParam("id", "batch"), idempotency, handlers.BatchTransferHandler)
+	router.POST("/transfers/:id/reverse", idempotency, handlers.ReverseTransferHandler)
+
+	router.POST("/holds", idempotency, handlers.PlaceHoldHandler)
+	router.GET("/holds/:id", handlers.GetHoldHandler)
+	router.POST("/holds/:id/capture", idempotency, handlers.CaptureHoldHandler)
+	router.POST("/holds/:id/release", idempotency, handlers.ReleaseHoldHandler)
+
+	router.POST("/scheduled-transfers", idempotency, handlers.ScheduleTransferHandler)
+	router.GET("/scheduled-transfers/:id", handlers.GetScheduledTransferHandler)
+	router.DELETE("/scheduled-transfers/:id", handlers.CancelScheduledTransferHandler)
+	router.GET("/scheduled-transfers/:id/runs", handlers.GetScheduledRunsHandler)
+
+	admin := router.Group("/admin")
+	admin.POST("/fx/reload", handlers.ReloadRatesHandler)
+	admin.POST("/fees/reload", handlers.ReloadFeesHandler)
+	admin.POST("/accounts/:id/status", handlers.SetAccountStatusHandler)
+	admin.POST("/accounts/:id/close", handlers.CloseAccountHandler)
+	admin.GET("/accounts/:id/status", handlers.GetStatusHistoryHandler)
+	admin.POST("/accounts/:id/overdraft", handlers.SetOverdraftLimitHandler)
+	admin.GET("/accounts/:id/limits", handlers.GetSpendingLimitsHandler)
+	admin.PUT("/accounts/:id/limits", handlers.SetSpendingLimitsHandler)
+	admin.GET("/accounts/:id/interest", handlers.GetAccountInterestHandler)
+	admin.PUT("/accounts/:id/interest", handlers.SetAccountInterestHandler)
+	admin.PUT("/interest/products/:name", handlers.SetInterestProductHandler)
+	admin.POST("/interest/source", handlers.SetInterestSourceHandler)
 
 	return router
 }
+
+// staticParam serves the route only for the value of the path parameter.
+// gin can not have /transfers/batch next to /transfers/:id/reverse, so
+// the batch route is registered as a wildcard one.
+func staticParam(name string, value string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Param(name) != value {
+			c.AbortWithStatus(http.StatusNotFound)
+		}
+	}
+}
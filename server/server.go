@@ -1,18 +1,181 @@
 package server
 
-import "go.uber.org/zap"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"simple_bank/config"
+	"simple_bank/handlers"
+	"simple_bank/models/bank"
+	"simple_bank/models/clock"
+	"simple_bank/models/fees"
+	"simple_bank/models/fx"
+	"syscall"
+	"time"
+)
 
-func Init() {
+// Exit codes of Init
+const (
+	ExitOK = iota
+	ExitServeFailed
+	ExitDrainTimeout
+	ExitFlushFailed
+	ExitBadConfig
+	ExitRestoreFailed
+)
 
+// Init runs the server until SIGINT or SIGTERM, then stops accepting
+// connections, drains in-flight requests, flushes the bank and returns the
+// exit code
+func Init(c config.Config) int {
+	level, _ := c.Log.ZapLevel()
 	cfg := zap.NewProductionConfig()
-	cfg.OutputPaths = []string{"log/simplebank.log"}
-	logger, _ := cfg.Build()
+	cfg.Level = zap.NewAtomicLevelAt(level)
+	cfg.OutputPaths = c.Log.Outputs
+	logger, err := cfg.Build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can not create logger:", err)
+		return ExitBadConfig
+	}
 
-	logger.Info("Starting Server")
+	logger.Info("Starting Server", zap.String("storage", c.Storage.Kind), zap.String("addr", c.Server.Addr))
 
-	r := NewRouter(logger)
-	r.Run(":" +
-		"8080")
-	defer logger.Sync()
-	defer logger.Info("Stopping Server")
+	_bank, err := openBank(c.Storage)
+	if err != nil {
+		logger.Error("Can not restore bank", zap.Error(err))
+		logger.Sync()
+		return ExitRestoreFailed
+	}
+	_bank.SetLogger(logger)
+	bank.SetBank(_bank)
+
+	// rates file is optional, exchange between currencies is refused without it
+	if _, err := os.Stat(c.Storage.RatesFile); err == nil {
+		rates, err := fx.Load(c.Storage.RatesFile)
+		if err != nil {
+			logger.Error("Can not load exchange rates", zap.Error(err))
+			return stop(_bank, ExitBadConfig, logger)
+		}
+		_bank.SetRates(rates)
+	} else {
+		logger.Warn("No exchange rates file, currency exchange is disabled", zap.String("path", c.Storage.RatesFile))
+	}
+
+	// fees file is optional, transfers are free without it
+	if _, err := os.Stat(c.Storage.FeesFile); err == nil {
+		f, err := fees.Load(c.Storage.FeesFile)
+		if err != nil {
+			logger.Error("Can not load fees", zap.Error(err))
+			return stop(_bank, ExitBadConfig, logger)
+		}
+		_bank.SetFees(f)
+	} else {
+		logger.Warn("No fees file, transfers are free", zap.String("path", c.Storage.FeesFile))
+	}
+
+	if c.Storage.Kind == "wal" {
+		_bank.StartSnapshots(c.Storage.SnapshotInterval, func(err error) {
+			logger.Error("Can not take bank snapshot", zap.Error(err))
+		})
+	}
+
+	bank.NewScheduler(_bank, clock.System).Start(c.Jobs.SchedulerInterval, func(err error) {
+		logger.Error("Can not run scheduled transfers", zap.Error(err))
+	})
+	bank.NewInterestEngine(_bank, clock.System).Start(c.Jobs.InterestInterval, func(err error) {
+		logger.Error("Can not accrue interest", zap.Error(err))
+	})
+
+	gin.SetMode(c.Server.Mode)
+	srv := &http.Server{
+		Addr:           c.Server.Addr,
+		Handler:        newRouter(logger, c.Limits),
+		ReadTimeout:    c.Server.ReadTimeout,
+		WriteTimeout:   c.Server.WriteTimeout,
+		IdleTimeout:    c.Server.IdleTimeout,
+		MaxHeaderBytes: c.Limits.MaxHeaderBytes,
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	return stop(_bank, serve(srv, signals, c.Server, logger), logger)
+}
+
+// stop flushes the bank and the logger and returns the exit code, which is
+// code unless the bank can not be flushed
+func stop(b *bank.Bank, code int, logger *zap.Logger) int {
+	logger.Info("Stopping Server")
+	if err := b.Close(); err != nil {
+		logger.Error("Can not flush bank", zap.Error(err))
+		code = ExitFlushFailed
+	}
+	logger.Info("Server stopped", zap.Int("code", code))
+	logger.Sync()
+	return code
+}
+
+// serve runs srv until it fails or a signal comes. Readiness fails then and
+// srv keeps serving for the shutdown delay, so the orchestrator stops
+// routing traffic to it, a second signal cuts the delay short. Then srv is
+// shut down waiting for in-flight requests up to the shutdown timeout.
+func serve(srv *http.Server, stop <-chan os.Signal, c config.Server, logger *zap.Logger) int {
+	failed := make(chan error, 1)
+	go func() {
+		failed <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-failed:
+		logger.Error("Server failed", zap.Error(err))
+		return ExitServeFailed
+	case sig := <-stop:
+		logger.Info("Shutting down", zap.String("signal", sig.String()), zap.Duration("delay", c.ShutdownDelay))
+	}
+
+	handlers.SetShuttingDown(true)
+	select {
+	case <-time.After(c.ShutdownDelay):
+	case <-stop:
+	case err := <-failed:
+		logger.Error("Server failed", zap.Error(err))
+		return ExitServeFailed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("Can not drain requests", zap.Error(err))
+		return ExitDrainTimeout
+	}
+	return ExitOK
+}
+
+// openBank creates the bank on top of the selected storage:
+// memory keeps accounts until restart only, wal adds write-ahead log and
+// snapshots, file keeps everything in a single file
+func openBank(c config.Storage) (*bank.Bank, error) {
+	switch c.Kind {
+	case "memory":
+		return bank.NewBank(), nil
+	case "wal":
+		return bank.Open(c.DataDir)
+	case "file":
+		if err := os.MkdirAll(c.DataDir, 0700); err != nil {
+			return nil, err
+		}
+		s, err := bank.OpenFileStorage(filepath.Join(c.DataDir, "bank.db"))
+		if err != nil {
+			return nil, err
+		}
+		return bank.New(s)
+	}
+
+	return nil, errors.New("unknown storage " + c.Kind)
 }